@@ -0,0 +1,237 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ingress-controller/controller/annotation"
+	"ingress-controller/kube"
+	"ingress-controller/kube/admission"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/kube/secret"
+	"ingress-controller/nginx"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// maxReviewSize bounds the AdmissionReviews read by the webhook.
+const maxReviewSize = 3 << 20
+
+// review collects the problems found while an ingress is dry-run, they are
+// reported to the client instead of being logged and posted as events.
+type review struct {
+	rejected []string
+	warnings []string
+	// secrets and secretErrs are the secrets the ingress refers to and the
+	// errors of those that could not be fetched
+	secrets    map[string]*secret.Secret
+	secretErrs map[string]error
+	// scratch is the directory the files of secrets are written to, it is
+	// removed after the dry-run
+	scratch string
+}
+
+// handles reports whether an ingress would be handled by this controller,
+// so that ingresses of other controllers are not validated.
+func (c *Controller) handles(is *ingress.Ingress) bool {
+	if nss := namespaces(); len(nss) > 0 && !contains(nss, is.Metadata.Namespace) {
+		return false
+	}
+
+	if *ingressSelector != "" {
+		if match, ok := kube.MatchLabels(*ingressSelector, is.Metadata.Labels); ok && !match {
+			return false
+		}
+	}
+
+	return ingress.FilterIngress(is, c.classes)
+}
+
+// reviewSecrets fetches the secrets an ingress refers to for a dry-run, it
+// is called before mu is locked so that the worker does not wait for the
+// apiserver. Secrets referenced by the applied config are not fetched again.
+func (c *Controller) reviewSecrets(is *ingress.Ingress) *review {
+	r := &review{secrets: map[string]*secret.Secret{}, secretErrs: map[string]error{}}
+
+	get := func(namespace, name string) {
+		fullname := namespace + "/" + name
+
+		if _, ok := r.secrets[fullname]; ok || r.secretErrs[fullname] != nil {
+			return
+		}
+
+		if sec, ok := c.secretInformer.Lookup(fullname); ok {
+			r.secrets[fullname] = sec
+			return
+		}
+
+		sec := new(secret.Secret)
+
+		if err := kube.Get(c.kc, secret.ReadFunc(namespace, name), sec); err != nil {
+			r.secretErrs[fullname] = err
+			return
+		}
+
+		r.secrets[fullname] = sec
+	}
+
+	for _, tls := range is.Spec.TLS {
+		if tls.SecretName != "" {
+			get(is.Metadata.Namespace, tls.SecretName)
+		}
+	}
+
+	if cfg, _ := annotation.Parse(is); cfg.AuthSecret != "" {
+		get(cfg.AuthSecretNamespace, cfg.AuthSecret)
+	}
+
+	return r
+}
+
+// dryRun applies an ingress in place of its current version, tests the
+// resulting config with nginx and restores the previous state. r holds the
+// secrets of reviewSecrets, their files are written to a scratch directory
+// so the dry-run leaves no file and takes no reference behind.
+func (c *Controller) dryRun(is *ingress.Ingress, r *review) error {
+	scratch, err := os.MkdirTemp(*nginx.Prefix, "dry-run-")
+
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(scratch)
+
+	r.scratch = scratch
+
+	// the applied ingress keeps its secrets, so restoring it neither
+	// fetches nor rewrites them
+	applied, ok := c.issCache[is.Name()]
+
+	if ok {
+		c.detachIngress(applied)
+	}
+
+	c.review = r
+	addErr := c.addIngress(is)
+
+	if len(r.rejected) == 0 && addErr == nil {
+		err = c.ngx.Validate(withoutNgxPrefix(scratch))
+	}
+
+	c.detachIngress(is)
+	delete(c.issCache, is.Name())
+
+	if ok {
+		c.review = new(review)
+
+		if err := c.addIngress(applied); err != nil {
+			log.Printf("controller: restore ingress %s: %s", applied.Name(), err)
+		}
+	}
+
+	c.review = nil
+	return err
+}
+
+// admit validates the ingress of an admission request.
+func (c *Controller) admit(req *admission.Request) *admission.Response {
+	res := &admission.Response{UID: req.UID, Allowed: true}
+
+	if len(req.Object) == 0 || req.Operation == "DELETE" {
+		return res
+	}
+
+	deny := func(code int, reason, msg string) *admission.Response {
+		res.Allowed = false
+		res.Result = &kube.Status{Code: code, Reason: reason, Message: msg}
+		return res
+	}
+
+	is := new(ingress.Ingress)
+
+	if err := json.Unmarshal(req.Object, is); err != nil || is.Metadata == nil {
+		return deny(http.StatusBadRequest, "BadRequest", fmt.Sprintf("decode ingress: %v", err))
+	}
+
+	if is.Metadata.Namespace == "" {
+		is.Metadata.Namespace = req.Namespace
+	}
+
+	if is.Metadata.Name == "" {
+		is.Metadata.Name = req.Name
+	}
+
+	if atomic.LoadInt32(&c.synced) == 0 {
+		res.Warnings = []string{"ingress not validated, the controller is starting"}
+		return res
+	}
+
+	c.mu.Lock()
+	handles := c.handles(is)
+	c.mu.Unlock()
+
+	if !handles {
+		return res
+	}
+
+	r := c.reviewSecrets(is)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	err := c.dryRun(is, r)
+	res.Warnings = r.warnings
+
+	var cfgErr *nginx.ConfigError
+
+	switch {
+	case len(r.rejected) > 0:
+		return deny(http.StatusUnprocessableEntity, "Invalid", strings.Join(r.rejected, "; "))
+	case errors.As(err, &cfgErr):
+		return deny(http.StatusUnprocessableEntity, "Invalid", cfgErr.Error())
+	case err != nil:
+		return deny(http.StatusInternalServerError, "InternalError", err.Error())
+	}
+
+	return res
+}
+
+// ServeHTTP answers AdmissionReviews of Ingresses. An ingress is rejected
+// when it conflicts with the applied config or nginx refuses it.
+func (c *Controller) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var rv admission.Review
+
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxReviewSize)).Decode(&rv); err != nil || rv.Request == nil {
+		http.Error(w, "invalid AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	res := c.admit(rv.Request)
+
+	if !res.Allowed {
+		log.Printf("controller: admission: ingress %s/%s denied: %s", rv.Request.Namespace, rv.Request.Name, res.Result.Message)
+	}
+
+	apiVersion := rv.APIVersion
+
+	if apiVersion == "" {
+		apiVersion = admission.APIVersion
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	json.NewEncoder(w).Encode(&admission.Review{
+		APIVersion: apiVersion,
+		Kind:       "AdmissionReview",
+		Response:   res,
+	})
+}
@@ -0,0 +1,178 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"ingress-controller/controller/annotation"
+	"ingress-controller/kube"
+	"ingress-controller/kube/admission"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/kube/secret"
+	"ingress-controller/nginx"
+	"io"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeSecretClient serves secrets and the lists of other resources by
+// collection path, records the patches sent and counts the requests sent
+// while mu is held.
+type fakeSecretClient struct {
+	mu       sync.Mutex
+	secrets  map[string]*secret.Secret
+	lists    map[string][]interface{}
+	patches  []string
+	requests []string
+	// locked counts the requests sent while controllerMu was held
+	controllerMu *sync.Mutex
+	locked       int
+}
+
+func (f *fakeSecretClient) Do(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.controllerMu != nil {
+		if f.controllerMu.TryLock() {
+			f.controllerMu.Unlock()
+		} else {
+			f.locked++
+		}
+	}
+
+	f.requests = append(f.requests, r.URL.Path)
+
+	respond := func(code int, body interface{}) (*http.Response, error) {
+		data, _ := json.Marshal(body)
+		return &http.Response{StatusCode: code, Status: http.StatusText(code), Body: io.NopCloser(bytes.NewReader(data))}, nil
+	}
+
+	if r.Method == http.MethodPatch {
+		body, _ := io.ReadAll(r.Body)
+		f.patches = append(f.patches, string(body))
+		return respond(http.StatusOK, struct{}{})
+	}
+
+	if items, ok := f.lists[r.URL.Path]; ok {
+		return respond(http.StatusOK, map[string]interface{}{
+			"metadata": kube.ListMeta{ResourceVersion: "1"},
+			"items":    items,
+		})
+	}
+
+	parts := strings.Split(r.URL.Path, "/")
+
+	if len(parts) == 7 && parts[5] == "secrets" {
+		if sec, ok := f.secrets[parts[4]+"/"+parts[6]]; ok {
+			return respond(http.StatusOK, sec)
+		}
+	}
+
+	return respond(http.StatusNotFound, nil)
+}
+
+func newTestSecret(namespace, name, typ string, data map[string][]byte) *secret.Secret {
+	return &secret.Secret{Metadata: &kube.Metadata{Namespace: namespace, Name: name}, Type: typ, Data: data}
+}
+
+// prefixFiles lists the files of the nginx prefix.
+func prefixFiles(t *testing.T) []string {
+	var files []string
+
+	err := filepath.WalkDir(*nginx.Prefix, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			files = append(files, strings.TrimPrefix(p, *nginx.Prefix))
+		}
+
+		return err
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(files)
+	return files
+}
+
+func TestDryRunSideEffects(t *testing.T) {
+	defer func(prefix string) { *nginx.Prefix = prefix }(*nginx.Prefix)
+	*nginx.Prefix = t.TempDir()
+
+	client := &fakeSecretClient{secrets: map[string]*secret.Secret{
+		"default/tls":   newTestSecret("default", "tls", secret.TypeTLS, map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")}),
+		"default/users": newTestSecret("default", "users", secret.TypeOpaque, map[string][]byte{"auth": []byte("user:pass")}),
+		"default/new":   newTestSecret("default", "new", secret.TypeTLS, map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")}),
+	}}
+
+	c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), client)
+	c.classes = ingress.NewClasses(nil)
+	c.setupSecretInformer()
+	atomic.StoreInt32(&c.synced, 1)
+
+	newIngress := func(tlsSecret string) *ingress.Ingress {
+		is := &ingress.Ingress{Metadata: &kube.Metadata{
+			Namespace:   "default",
+			Name:        "web",
+			Annotations: map[string]string{annotation.AuthSecret: "users"},
+		}}
+		is.Spec.TLS = append(is.Spec.TLS, &ingress.TLS{Host: []string{"example.com"}, SecretName: tlsSecret})
+		is.Spec.Rules = append(is.Spec.Rules, &ingress.Rule{Host: "example.com"})
+		return is
+	}
+
+	// the applied version holds the secrets tls and users
+	applied := newIngress("tls")
+
+	if err := c.addIngress(applied); err != nil {
+		t.Fatal(err)
+	}
+
+	files := prefixFiles(t)
+	refs := c.secretInformer.Refs()
+	client.controllerMu = &c.mu
+	client.requests = nil
+
+	for _, tlsSecret := range []string{"new", "missing"} {
+		object, _ := json.Marshal(newIngress(tlsSecret))
+		res := c.admit(&admission.Request{UID: "1", Namespace: "default", Name: "web", Operation: "UPDATE", Object: object})
+
+		// without NO_NGINX=1 the config can not be tested
+		if !res.Allowed && res.Result.Reason != "InternalError" {
+			t.Errorf("%s: denied: %s", tlsSecret, res.Result.Message)
+		}
+
+		if tlsSecret == "missing" && (len(res.Warnings) != 1 || !strings.HasPrefix(res.Warnings[0], "tls secret")) {
+			t.Errorf("%s: warnings %v, want the missing secret", tlsSecret, res.Warnings)
+		}
+	}
+
+	if client.locked > 0 {
+		t.Errorf("%d requests sent while mu was held", client.locked)
+	}
+
+	// only the secrets the applied config does not hold are fetched
+	want := []string{"/api/v1/namespaces/default/secrets/new", "/api/v1/namespaces/default/secrets/missing"}
+
+	if strings.Join(client.requests, ",") != strings.Join(want, ",") {
+		t.Errorf("requests %v, want %v", client.requests, want)
+	}
+
+	if got := prefixFiles(t); strings.Join(got, ",") != strings.Join(files, ",") {
+		t.Errorf("files %v after the dry-runs, want %v", got, files)
+	}
+
+	if got := c.secretInformer.Refs(); len(got) != len(refs) || got["default/tls"] != refs["default/tls"] || got["default/users"] != refs["default/users"] {
+		t.Errorf("secret references %v after the dry-runs, want %v", got, refs)
+	}
+
+	if c.issCache["default/web"] != applied {
+		t.Error("the applied ingress was not restored")
+	}
+}
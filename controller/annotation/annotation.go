@@ -1,26 +1,213 @@
 package annotation
 
 import (
+	"flag"
+	"fmt"
 	"ingress-controller/kube/ingress"
+	"ingress-controller/nginx"
+	"net/http"
+	"strings"
 )
 
 const (
-	Prefix              = "nginx.ingress.kubernetes.io/"
-	AuthSecret          = Prefix + "auth-secret"
-	AuthSecretNamespace = Prefix + "auth-secret-namespace"
-	EnableAccessLog     = Prefix + "enable-access-log"
-	ForceSSLRedirect    = Prefix + "force-ssl-redirect"
-	RewriteTarget       = Prefix + "rewrite-target"
-	UseRegex            = Prefix + "use-regex"
+	Prefix                = "nginx.ingress.kubernetes.io/"
+	AuthSecret            = Prefix + "auth-secret"
+	AuthSecretNamespace   = Prefix + "auth-secret-namespace"
+	EnableAccessLog       = Prefix + "enable-access-log"
+	ForceSSLRedirect      = Prefix + "force-ssl-redirect"
+	RewriteTarget         = Prefix + "rewrite-target"
+	UseRegex              = Prefix + "use-regex"
+	PermanentRedirect     = Prefix + "permanent-redirect"
+	PermanentRedirectCode = Prefix + "permanent-redirect-code"
+	TemporalRedirect      = Prefix + "temporal-redirect"
+	TemporalRedirectCode  = Prefix + "temporal-redirect-code"
+	ProxyConnectTimeout   = Prefix + "proxy-connect-timeout"
+	ProxyReadTimeout      = Prefix + "proxy-read-timeout"
+	ProxySendTimeout      = Prefix + "proxy-send-timeout"
+	ProxyBodySize         = Prefix + "proxy-body-size"
+	ProxyRequestBuffering = Prefix + "proxy-request-buffering"
+	WhitelistSourceRange  = Prefix + "whitelist-source-range"
 )
 
-func ParseAuthSecret(is *ingress.Ingress) (namespace, name string, ok bool) {
-	if name = is.Metadata.Annotations[AuthSecret]; name != "" {
-		if namespace = is.Metadata.Annotations[AuthSecretNamespace]; namespace == "" {
-			namespace = is.Metadata.Namespace
+var valueDenylist = flag.String(
+	"annotation-value-denylist",
+	"load_module,lua_,_by_lua,include,root,alias,location,server,proxy_pass",
+	"comma separated nginx directive names annotation values must not contain as a word, a name starting or ending with _ also matches a part of a word",
+)
+
+// quoteChars end a quoted value or a directive or block of the nginx
+// config, no annotation value needs them.
+const quoteChars = "'\";{}"
+
+// checkDenylist rejects values with control characters, quotes, the
+// characters ending a directive or block, or directive names of
+// -annotation-value-denylist, they are a sign of an attempt to inject
+// directives into the nginx config. The values are rendered quoted, the
+// denylist is a second line of defense.
+func checkDenylist(v string) error {
+	for _, r := range v {
+		if r < ' ' || r == 0x7f {
+			return fmt.Errorf("%q contains a control character", v)
+		}
+	}
+
+	if i := strings.IndexAny(v, quoteChars); i >= 0 {
+		return fmt.Errorf("%q contains the forbidden %q", v, v[i:i+1])
+	}
+
+	words := strings.Fields(strings.ToLower(v))
+
+	for _, name := range strings.Split(*valueDenylist, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+
+		if name == "" {
+			continue
+		}
+
+		partial := strings.HasPrefix(name, "_") || strings.HasSuffix(name, "_")
+
+		for _, word := range words {
+			if word == name || (partial && strings.Contains(word, name)) {
+				return fmt.Errorf("%q contains the forbidden %q", v, name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Error is an invalid annotation.
+type Error struct {
+	Key string
+	// Fatal reports an annotation that restricts access or redirects, the
+	// ingress must not be served without it.
+	Fatal bool
+	Err   error
+}
+
+func (e *Error) Error() string {
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type Redirect struct {
+	URL  string
+	Code int
+}
+
+// Config is the validated annotation config of an ingress, it applies to
+// each of its locations.
+type Config struct {
+	AuthSecret          string
+	AuthSecretNamespace string
+	EnableAccessLog     bool
+	ForceSSLRedirect    bool
+	UseRegex            bool
+	// RewriteTarget replaces the part of the URI matched by the regex of a
+	// path, e.g. /$2.
+	RewriteTarget string
+	// Redirect answers every path with a redirect instead of proxying it,
+	// temporal-redirect wins over permanent-redirect.
+	Redirect              *Redirect
+	permanentRedirect     Redirect
+	temporalRedirect      Redirect
+	ProxyConnectTimeout   string
+	ProxyReadTimeout      string
+	ProxySendTimeout      string
+	ProxyBodySize         string
+	ProxyRequestBuffering string
+	// WhitelistSourceRange are the CIDRs allowed to access the locations,
+	// all when empty.
+	WhitelistSourceRange []string
+}
+
+var parsers = []parser{
+	fatal(field(AuthSecret, parseName, func(cfg *Config, v string) { cfg.AuthSecret = v })),
+	fatal(field(AuthSecretNamespace, parseName, func(cfg *Config, v string) { cfg.AuthSecretNamespace = v })),
+	field(EnableAccessLog, parseBool, func(cfg *Config, v bool) { cfg.EnableAccessLog = v }),
+	field(ForceSSLRedirect, parseBool, func(cfg *Config, v bool) { cfg.ForceSSLRedirect = v }),
+	field(UseRegex, parseBool, func(cfg *Config, v bool) { cfg.UseRegex = v }),
+	field(RewriteTarget, parseRewriteTarget, func(cfg *Config, v string) { cfg.RewriteTarget = v }),
+	fatal(field(PermanentRedirect, parseURL, func(cfg *Config, v string) { cfg.permanentRedirect.URL = v })),
+	field(PermanentRedirectCode, intRange(http.StatusMultipleChoices, http.StatusPermanentRedirect), func(cfg *Config, v int) { cfg.permanentRedirect.Code = v }),
+	fatal(field(TemporalRedirect, parseURL, func(cfg *Config, v string) { cfg.temporalRedirect.URL = v })),
+	field(TemporalRedirectCode, intRange(http.StatusMultipleChoices, http.StatusPermanentRedirect), func(cfg *Config, v int) { cfg.temporalRedirect.Code = v }),
+	field(ProxyConnectTimeout, nginx.ParseTime, func(cfg *Config, v string) { cfg.ProxyConnectTimeout = v }),
+	field(ProxyReadTimeout, nginx.ParseTime, func(cfg *Config, v string) { cfg.ProxyReadTimeout = v }),
+	field(ProxySendTimeout, nginx.ParseTime, func(cfg *Config, v string) { cfg.ProxySendTimeout = v }),
+	field(ProxyBodySize, nginx.ParseSize, func(cfg *Config, v string) { cfg.ProxyBodySize = v }),
+	field(ProxyRequestBuffering, enum("on", "off"), func(cfg *Config, v string) { cfg.ProxyRequestBuffering = v }),
+	fatal(field(WhitelistSourceRange, parseCIDRList, func(cfg *Config, v []string) { cfg.WhitelistSourceRange = v })),
+}
+
+// Parse returns the config of the annotations of an ingress. Invalid
+// annotations are left at their defaults and returned as *Error.
+func Parse(is *ingress.Ingress) (*Config, []error) {
+	cfg := &Config{
+		EnableAccessLog:   true,
+		permanentRedirect: Redirect{Code: http.StatusMovedPermanently},
+		temporalRedirect:  Redirect{Code: http.StatusFound},
+	}
+
+	var errs []error
+
+	for _, p := range parsers {
+		v, ok := is.Metadata.Annotations[p.key]
+
+		if !ok {
+			continue
 		}
-		ok = true
+
+		err := checkDenylist(v)
+
+		if err == nil {
+			err = p.parse(strings.TrimSpace(v), cfg)
+		}
+
+		if err != nil {
+			errs = append(errs, &Error{Key: p.key, Fatal: p.fatal, Err: err})
+		}
+	}
+
+	if cfg.AuthSecret != "" && cfg.AuthSecretNamespace == "" {
+		cfg.AuthSecretNamespace = is.Metadata.Namespace
+	}
+
+	if cfg.temporalRedirect.URL != "" {
+		cfg.Redirect = &cfg.temporalRedirect
+	} else if cfg.permanentRedirect.URL != "" {
+		cfg.Redirect = &cfg.permanentRedirect
+	}
+
+	return cfg, errs
+}
+
+// Directives returns the directives of the config added to each location.
+func (cfg *Config) Directives() []nginx.Directive {
+	var directives []nginx.Directive
+
+	add := func(name, value string) {
+		if value != "" {
+			directives = append(directives, nginx.Directive{name, value})
+		}
+	}
+
+	add("proxy_read_timeout", cfg.ProxyReadTimeout)
+	add("proxy_connect_timeout", cfg.ProxyConnectTimeout)
+	add("proxy_send_timeout", cfg.ProxySendTimeout)
+	add("client_max_body_size", cfg.ProxyBodySize)
+	add("proxy_request_buffering", cfg.ProxyRequestBuffering)
+
+	if len(cfg.WhitelistSourceRange) > 0 {
+		for _, cidr := range cfg.WhitelistSourceRange {
+			add("allow", cidr)
+		}
+
+		add("deny", "all")
 	}
 
-	return
+	return directives
 }
@@ -0,0 +1,196 @@
+package annotation
+
+import (
+	"ingress-controller/kube"
+	"ingress-controller/kube/ingress"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func newIngress(annotations map[string]string) *ingress.Ingress {
+	return &ingress.Ingress{Metadata: &kube.Metadata{Name: "web", Namespace: "default", Annotations: annotations}}
+}
+
+func TestParsers(t *testing.T) {
+	keys := map[string]bool{}
+
+	for _, p := range parsers {
+		if keys[p.key] {
+			t.Errorf("%s is parsed twice", p.key)
+		}
+
+		keys[p.key] = true
+	}
+}
+
+func TestFatalErrors(t *testing.T) {
+	_, errs := Parse(newIngress(map[string]string{
+		WhitelistSourceRange:  "example.com",
+		ProxyRequestBuffering: "yes",
+	}))
+
+	fatal := map[string]bool{}
+
+	for _, err := range errs {
+		annErr := err.(*Error)
+		fatal[annErr.Key] = annErr.Fatal
+	}
+
+	if len(fatal) != 2 || !fatal[WhitelistSourceRange] || fatal[ProxyRequestBuffering] {
+		t.Errorf("got fatal errors %v, want only %s", fatal, WhitelistSourceRange)
+	}
+}
+
+func TestParse(t *testing.T) {
+	defaults := func() *Config {
+		return &Config{
+			EnableAccessLog:   true,
+			permanentRedirect: Redirect{Code: http.StatusMovedPermanently},
+			temporalRedirect:  Redirect{Code: http.StatusFound},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		errs        int
+		want        func(cfg *Config)
+	}{
+		{
+			name: "none",
+			want: func(*Config) {},
+		},
+		{
+			name: "proxy settings",
+			annotations: map[string]string{
+				ProxyReadTimeout:      "120",
+				ProxyConnectTimeout:   " 5s ",
+				ProxyBodySize:         "0",
+				ProxyRequestBuffering: "off",
+				EnableAccessLog:       "false",
+			},
+			want: func(cfg *Config) {
+				cfg.ProxyReadTimeout = "120s"
+				cfg.ProxyConnectTimeout = "5s"
+				cfg.ProxyBodySize = "0"
+				cfg.ProxyRequestBuffering = "off"
+				cfg.EnableAccessLog = false
+			},
+		},
+		{
+			name: "invalid proxy settings",
+			annotations: map[string]string{
+				ProxyReadTimeout:      "0",
+				ProxySendTimeout:      "1w",
+				ProxyBodySize:         "8mb",
+				ProxyRequestBuffering: "yes",
+				EnableAccessLog:       "no",
+			},
+			errs: 5,
+			want: func(*Config) {},
+		},
+		{
+			name:        "auth secret in the namespace of the ingress",
+			annotations: map[string]string{AuthSecret: "users"},
+			want: func(cfg *Config) {
+				cfg.AuthSecret = "users"
+				cfg.AuthSecretNamespace = "default"
+			},
+		},
+		{
+			name:        "auth secret of another namespace",
+			annotations: map[string]string{AuthSecret: "users", AuthSecretNamespace: "auth"},
+			want: func(cfg *Config) {
+				cfg.AuthSecret = "users"
+				cfg.AuthSecretNamespace = "auth"
+			},
+		},
+		{
+			name:        "temporal redirect wins",
+			annotations: map[string]string{PermanentRedirect: "https://a.example.com", TemporalRedirect: "https://b.example.com", TemporalRedirectCode: "307"},
+			want: func(cfg *Config) {
+				cfg.permanentRedirect.URL = "https://a.example.com"
+				cfg.temporalRedirect = Redirect{URL: "https://b.example.com", Code: http.StatusTemporaryRedirect}
+				cfg.Redirect = &cfg.temporalRedirect
+			},
+		},
+		{
+			name:        "invalid redirect code",
+			annotations: map[string]string{PermanentRedirect: "https://a.example.com", PermanentRedirectCode: "200"},
+			errs:        1,
+			want: func(cfg *Config) {
+				cfg.permanentRedirect.URL = "https://a.example.com"
+				cfg.Redirect = &cfg.permanentRedirect
+			},
+		},
+		{
+			name:        "whitelist",
+			annotations: map[string]string{WhitelistSourceRange: "10.0.0.0/8, 192.168.1.1,"},
+			want: func(cfg *Config) {
+				cfg.WhitelistSourceRange = []string{"10.0.0.0/8", "192.168.1.1"}
+			},
+		},
+		{
+			name:        "rewrite target",
+			annotations: map[string]string{RewriteTarget: "/$2", UseRegex: "true"},
+			want: func(cfg *Config) {
+				cfg.RewriteTarget = "/$2"
+				cfg.UseRegex = true
+			},
+		},
+		{
+			name:        "control character",
+			annotations: map[string]string{RewriteTarget: "/\n"},
+			errs:        1,
+			want:        func(*Config) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, errs := Parse(newIngress(tt.annotations))
+
+			if len(errs) != tt.errs {
+				t.Errorf("got errors %v, want %d", errs, tt.errs)
+			}
+
+			want := defaults()
+			tt.want(want)
+
+			if !reflect.DeepEqual(cfg, want) {
+				t.Errorf("got %+v, want %+v", cfg, want)
+			}
+		})
+	}
+}
+
+func TestCheckDenylist(t *testing.T) {
+	tests := []struct {
+		value string
+		err   bool
+	}{
+		{value: "/$2"},
+		{value: "https://example.com/include/root"},
+		{value: "/server-status"},
+		{value: "/locations"},
+		{value: "Restricted area"},
+		{value: "x\ty", err: true},
+		{value: `/a"b`, err: true},
+		{value: "/a'b", err: true},
+		{value: "/a;b", err: true},
+		{value: "/a{b", err: true},
+		{value: "/a}b", err: true},
+		{value: "Realm include", err: true},
+		{value: "x ROOT y", err: true},
+		{value: "load_module x", err: true},
+		{value: "x access_by_lua_block", err: true},
+		{value: "lua_package_path x", err: true},
+	}
+
+	for _, tt := range tests {
+		if err := checkDenylist(tt.value); (err != nil) != tt.err {
+			t.Errorf("checkDenylist(%q) = %v, want error %v", tt.value, err, tt.err)
+		}
+	}
+}
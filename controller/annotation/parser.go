@@ -0,0 +1,142 @@
+package annotation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// unsafeChars can not appear in values written into the nginx config.
+const unsafeChars = "\"'; {}\r\n\t\\"
+
+var (
+	// nameRe matches the names of Kubernetes objects, DNS-1123 subdomains.
+	nameRe = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+)
+
+// parser parses the annotation key into the Config.
+type parser struct {
+	key   string
+	parse func(v string, cfg *Config) error
+	// fatal parsers restrict access to or replace the backend of the
+	// locations, the ingress is not served when their value is invalid
+	fatal bool
+}
+
+// fatal marks p fatal.
+func fatal(p parser) parser {
+	p.fatal = true
+	return p
+}
+
+// field returns the parser of a typed annotation, parse validates the value
+// and set stores it in the Config.
+func field[T any](key string, parse func(string) (T, error), set func(*Config, T)) parser {
+	return parser{
+		key: key,
+		parse: func(v string, cfg *Config) error {
+			t, err := parse(v)
+
+			if err != nil {
+				return err
+			}
+
+			set(cfg, t)
+			return nil
+		},
+	}
+}
+
+func parseBool(v string) (bool, error) {
+	switch v {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+
+	return false, fmt.Errorf("%q is not true or false", v)
+}
+
+// parseCIDRList parses comma separated CIDRs or addresses.
+func parseCIDRList(v string) ([]string, error) {
+	var cidrs []string
+
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+
+		if s == "" {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+			return nil, fmt.Errorf("%q is not a CIDR or an address", s)
+		}
+
+		cidrs = append(cidrs, s)
+	}
+
+	if len(cidrs) == 0 {
+		return nil, errors.New("no CIDRs")
+	}
+
+	return cidrs, nil
+}
+
+// enum returns a parser of one of values.
+func enum(values ...string) func(string) (string, error) {
+	return func(v string) (string, error) {
+		for _, value := range values {
+			if v == value {
+				return v, nil
+			}
+		}
+
+		return "", fmt.Errorf("%q is not one of %s", v, strings.Join(values, ", "))
+	}
+}
+
+// intRange returns a parser of integers from min to max.
+func intRange(min, max int) func(string) (int, error) {
+	return func(v string) (int, error) {
+		n, err := strconv.Atoi(v)
+
+		if err != nil || n < min || n > max {
+			return 0, fmt.Errorf("%q is not between %d and %d", v, min, max)
+		}
+
+		return n, nil
+	}
+}
+
+// parseURL parses an absolute http or https URL.
+func parseURL(v string) (string, error) {
+	u, err := url.Parse(v)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.ContainsAny(v, unsafeChars) {
+		return "", fmt.Errorf("%q is not an http or https url", v)
+	}
+
+	return v, nil
+}
+
+func parseName(v string) (string, error) {
+	if len(v) > 253 || !nameRe.MatchString(v) {
+		return "", fmt.Errorf("%q is not a name", v)
+	}
+
+	return v, nil
+}
+
+// parseRewriteTarget parses a URI that may refer to capture groups, e.g. /$2.
+func parseRewriteTarget(v string) (string, error) {
+	if !strings.HasPrefix(v, "/") || strings.ContainsAny(v, unsafeChars) {
+		return "", fmt.Errorf("%q is not a URI", v)
+	}
+
+	return v, nil
+}
@@ -0,0 +1,269 @@
+package controller
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"ingress-controller/kube"
+	"ingress-controller/kube/configmap"
+	"ingress-controller/kube/event"
+	"ingress-controller/nginx"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+var configMapName = flag.String("configmap", "", "namespace/name of a ConfigMap with global nginx settings, it overrides the ngx.* flags")
+
+var (
+	logLevels    = []string{"debug", "info", "notice", "warn", "error", "crit", "alert", "emerg"}
+	sslProtocols = []string{"SSLv2", "SSLv3", "TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+	// ciphersRe matches OpenSSL cipher lists, e.g. HIGH:!aNULL:!MD5.
+	ciphersRe = regexp.MustCompile(`^[A-Za-z0-9_.:+!@=-]+$`)
+	// resolverRe matches an address, [address]:port or parameter of the
+	// resolver directive, e.g. 10.0.0.10, [::1]:53 or ipv6=off.
+	resolverRe = regexp.MustCompile(`^[A-Za-z0-9_.:=\[\]-]+$`)
+)
+
+type configSetter func(v string, main *nginx.Main, http *nginx.HttpSettings) error
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parsePositive(v string) (int, error) {
+	i, err := strconv.Atoi(v)
+
+	if err != nil || i <= 0 {
+		return 0, fmt.Errorf("%q is not a positive number", v)
+	}
+
+	return i, nil
+}
+
+// configSetters maps the keys of the ConfigMap onto the nginx settings.
+var configSetters = map[string]configSetter{
+	"worker-processes": func(v string, main *nginx.Main, _ *nginx.HttpSettings) (err error) {
+		if v == "auto" {
+			main.WorkerProcesses = -1
+			return nil
+		}
+
+		main.WorkerProcesses, err = parsePositive(v)
+		return
+	},
+	"worker-connections": func(v string, main *nginx.Main, _ *nginx.HttpSettings) (err error) {
+		main.WorkerConnections, err = parsePositive(v)
+		return
+	},
+	"error-log-level": func(v string, main *nginx.Main, _ *nginx.HttpSettings) error {
+		if !contains(logLevels, v) {
+			return fmt.Errorf("%q is not one of %s", v, strings.Join(logLevels, ", "))
+		}
+
+		main.LogLevel = v
+		return nil
+	},
+	// log-format is a single format string, it is quoted unlike the
+	// -ngx.log-format flag
+	"log-format": func(v string, _ *nginx.Main, http *nginx.HttpSettings) error {
+		if v == "" {
+			return errors.New("no format")
+		}
+
+		http.LogFormat = nginx.Quote(v)
+		return nil
+	},
+	"access-log-path": func(v string, _ *nginx.Main, http *nginx.HttpSettings) error {
+		if !path.IsAbs(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return fmt.Errorf("%q is not an absolute path", v)
+		}
+
+		http.AccessLog = v
+		return nil
+	},
+	"use-http2": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.Http2, err = strconv.ParseBool(v)
+		return
+	},
+	"resolver": func(v string, _ *nginx.Main, http *nginx.HttpSettings) error {
+		servers := strings.Fields(v)
+
+		if len(servers) == 0 {
+			return errors.New("no address")
+		}
+
+		for _, server := range servers {
+			if !resolverRe.MatchString(server) {
+				return fmt.Errorf("%q is not an address", server)
+			}
+		}
+
+		http.Resolver = strings.Join(servers, " ")
+		return nil
+	},
+	"proxy-body-size": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.ClientMaxBodySize, err = nginx.ParseSize(v)
+		return
+	},
+	"proxy-connect-timeout": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.ProxyConnectTimeout, err = nginx.ParseTime(v)
+		return
+	},
+	"proxy-read-timeout": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.ProxyReadTimeout, err = nginx.ParseTime(v)
+		return
+	},
+	"proxy-send-timeout": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.ProxySendTimeout, err = nginx.ParseTime(v)
+		return
+	},
+	"ssl-protocols": func(v string, _ *nginx.Main, http *nginx.HttpSettings) error {
+		protocols := strings.Fields(v)
+
+		if len(protocols) == 0 {
+			return errors.New("no protocol")
+		}
+
+		for _, p := range protocols {
+			if !contains(sslProtocols, p) {
+				return fmt.Errorf("%q is not one of %s", p, strings.Join(sslProtocols, ", "))
+			}
+		}
+
+		http.SSLProtocols = strings.Join(protocols, " ")
+		return nil
+	},
+	"ssl-ciphers": func(v string, _ *nginx.Main, http *nginx.HttpSettings) error {
+		if !ciphersRe.MatchString(v) {
+			return fmt.Errorf("%q is not a cipher list, e.g. HIGH:!aNULL:!MD5", v)
+		}
+
+		http.SSLCiphers = v
+		return nil
+	},
+	"hsts": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.HSTS, err = strconv.ParseBool(v)
+		return
+	},
+	"hsts-max-age": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.HSTSMaxAge, err = parsePositive(v)
+		return
+	},
+	"hsts-include-subdomains": func(v string, _ *nginx.Main, http *nginx.HttpSettings) (err error) {
+		http.HSTSIncludeSubdomains, err = strconv.ParseBool(v)
+		return
+	},
+}
+
+// applyConfig sets the keys of a ConfigMap on main and http, keys that are
+// unknown or invalid are skipped and returned as errors.
+func applyConfig(data map[string]string, main *nginx.Main, http *nginx.HttpSettings) []error {
+	keys := make([]string, 0, len(data))
+
+	for key := range data {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	var errs []error
+
+	for _, key := range keys {
+		set, ok := configSetters[key]
+
+		if !ok {
+			errs = append(errs, fmt.Errorf("unknown key %s", key))
+			continue
+		}
+
+		// a failed setter may have changed the value, it is reverted
+		prevMain, prevHttp := *main, *http
+
+		if err := set(strings.TrimSpace(data[key]), main, http); err != nil {
+			*main, *http = prevMain, prevHttp
+			errs = append(errs, fmt.Errorf("key %s: %s", key, err))
+		}
+	}
+
+	return errs
+}
+
+// syncConfig applies the ConfigMap on top of the settings from flags, the
+// flag value of a key is restored when it is removed from the ConfigMap.
+func (c *Controller) syncConfig() error {
+	main, settings := c.ngx.Defaults()
+
+	cm, ok := c.configMaps.Get(*configMapName)
+
+	if ok {
+		for _, err := range applyConfig(cm.Data, &main, &settings) {
+			c.warnConfigMap(cm, reasonInvalidConfig, "%s", err)
+		}
+	}
+
+	err := c.ngx.Configure(&main, settings)
+
+	var cfgErr *nginx.ConfigError
+
+	if errors.As(err, &cfgErr) && ok {
+		c.warnConfigMap(cm, reasonRejected, "%s", err)
+
+		// a rejected ConfigMap is not retried until it changes
+		return nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("Configure: %w", err)
+	}
+
+	log.Printf("controller: global config applied")
+	return nil
+}
+
+// warnConfigMap logs a configuration error of a ConfigMap and reports it in
+// a Warning event.
+func (c *Controller) warnConfigMap(cm *configmap.ConfigMap, reason, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	log.Printf("controller: %s: %s, configmap=%s", reason, msg, cm.Name())
+	c.recorder.Eventf(cm.Reference(), event.TypeWarning, reason, "%s", msg)
+}
+
+// newConfigMapStore watches the ConfigMap named by the flag flagName, it
+// returns nil when the flag is not set. Changes queue an item of kind.
+func (c *Controller) newConfigMapStore(flagName, fullname, kind string) *kube.Store[*configmap.ConfigMap] {
+	if fullname == "" {
+		return nil
+	}
+
+	namespace, name, ok := strings.Cut(fullname, "/")
+
+	if !ok {
+		panic(fmt.Sprintf("controller: -%s %s is not namespace/name", flagName, fullname))
+	}
+
+	store := &kube.Store[*configmap.ConfigMap]{
+		Client:        c.kc,
+		Namespaces:    []string{namespace},
+		FieldSelector: "metadata.name=" + name,
+		ListFunc:      configmap.ListFunc,
+		WatchFunc:     configmap.WatchFunc,
+		OnChange: func(*configmap.ConfigMap) {
+			c.queue.Add(workItem{kind: kind})
+		},
+	}
+
+	store.Init()
+	return store
+}
@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"ingress-controller/nginx"
+	"testing"
+)
+
+func TestApplyConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		errs     int
+		wantMain nginx.Main
+		wantHttp nginx.HttpSettings
+	}{
+		{
+			name:     "empty",
+			wantMain: nginx.Main{WorkerProcesses: 2},
+			wantHttp: nginx.HttpSettings{ProxyReadTimeout: "60s"},
+		},
+		{
+			name: "valid",
+			data: map[string]string{
+				"worker-processes":   "auto",
+				"worker-connections": " 1024 ",
+				"error-log-level":    "warn",
+				"proxy-read-timeout": "120",
+				"proxy-body-size":    "0",
+				"ssl-protocols":      "TLSv1.2  TLSv1.3",
+				"hsts":               "true",
+				"hsts-max-age":       "300",
+			},
+			wantMain: nginx.Main{WorkerProcesses: -1, WorkerConnections: 1024, LogLevel: "warn"},
+			wantHttp: nginx.HttpSettings{
+				ProxyReadTimeout:  "120s",
+				ClientMaxBodySize: "0",
+				SSLProtocols:      "TLSv1.2 TLSv1.3",
+				HSTS:              true,
+				HSTSMaxAge:        300,
+			},
+		},
+		{
+			name: "invalid values keep the defaults",
+			data: map[string]string{
+				"worker-processes":   "0",
+				"error-log-level":    "verbose",
+				"proxy-read-timeout": "0s",
+				"proxy-body-size":    "8mb",
+				"ssl-protocols":      "TLSv1.2 TLSv9",
+				"hsts":               "yes",
+			},
+			errs:     6,
+			wantMain: nginx.Main{WorkerProcesses: 2},
+			wantHttp: nginx.HttpSettings{ProxyReadTimeout: "60s"},
+		},
+		{
+			name: "raw values",
+			data: map[string]string{
+				"log-format":      `$remote_addr "$request"; include /etc/passwd`,
+				"access-log-path": "/var/log/nginx/access.log",
+				"ssl-ciphers":     "HIGH:!aNULL:!MD5:@SECLEVEL=1",
+				"resolver":        "10.0.0.10  [::1]:53 ipv6=off",
+			},
+			wantMain: nginx.Main{WorkerProcesses: 2},
+			wantHttp: nginx.HttpSettings{
+				ProxyReadTimeout: "60s",
+				LogFormat:        `"$remote_addr \"$request\"; include /etc/passwd"`,
+				AccessLog:        "/var/log/nginx/access.log",
+				SSLCiphers:       "HIGH:!aNULL:!MD5:@SECLEVEL=1",
+				Resolver:         "10.0.0.10 [::1]:53 ipv6=off",
+			},
+		},
+		{
+			name: "invalid raw values",
+			data: map[string]string{
+				"log-format":      " ",
+				"access-log-path": "logs/access.log",
+				"ssl-ciphers":     "HIGH; include /etc/passwd",
+				"resolver":        "10.0.0.10; include /etc/passwd;",
+			},
+			errs:     4,
+			wantMain: nginx.Main{WorkerProcesses: 2},
+			wantHttp: nginx.HttpSettings{ProxyReadTimeout: "60s"},
+		},
+		{
+			name:     "unknown key",
+			data:     map[string]string{"proxy-buffering": "off", "use-http2": "true"},
+			errs:     1,
+			wantMain: nginx.Main{WorkerProcesses: 2},
+			wantHttp: nginx.HttpSettings{ProxyReadTimeout: "60s", Http2: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			main := nginx.Main{WorkerProcesses: 2}
+			http := nginx.HttpSettings{ProxyReadTimeout: "60s"}
+
+			errs := applyConfig(tt.data, &main, &http)
+
+			if len(errs) != tt.errs {
+				t.Errorf("got errors %v, want %d", errs, tt.errs)
+			}
+
+			if main != tt.wantMain {
+				t.Errorf("main = %+v, want %+v", main, tt.wantMain)
+			}
+
+			if http != tt.wantHttp {
+				t.Errorf("http = %+v, want %+v", http, tt.wantHttp)
+			}
+		})
+	}
+}
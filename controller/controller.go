@@ -3,17 +3,30 @@ package controller
 import (
 	"context"
 	"errors"
+	"flag"
 	"fmt"
 	"ingress-controller/controller/annotation"
 	"ingress-controller/kube"
+	"ingress-controller/kube/configmap"
+	"ingress-controller/kube/endpointslice"
+	"ingress-controller/kube/event"
+	"ingress-controller/kube/gateway"
 	"ingress-controller/kube/ingress"
 	"ingress-controller/kube/secret"
+	"ingress-controller/kube/service"
 	"ingress-controller/nginx"
 	"log"
 	"os"
 	"path"
-	"strconv"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	watchNamespaces = flag.String("watch-namespaces", "", "comma separated namespaces to watch ingresses, services and endpoints in, all namespaces when empty")
+	ingressSelector = flag.String("ingress-selector", "", "label selector of the handled ingresses, e.g. tier=public")
 )
 
 const (
@@ -21,11 +34,94 @@ const (
 	ngxTlsDir      = "tls/"
 )
 
+const eventComponent = "mini-ingress-controller"
+
+// reasons of the events about ingresses
+const (
+	reasonAddedOrUpdated = "AddedOrUpdated"
+	reasonRejected       = "Rejected"
+	reasonSecretMissing  = "SecretMissing"
+	reasonServiceMissing = "ServiceMissing"
+	reasonInvalidConfig  = "InvalidConfig"
+	// reasonInvalidAnnotation reports annotations that are ignored because
+	// of invalid values
+	reasonInvalidAnnotation = "InvalidAnnotation"
+)
+
+const (
+	kindIngress   = "ingress"
+	kindSecret    = "secret"
+	kindService   = "service"
+	kindEndpoints = "endpoints"
+	kindClass     = "ingressclass"
+	kindConfig    = "configmap"
+	kindStream    = "stream"
+	kindGateway   = "gateway"
+	// kindDefaultBackend is the Service of -default-backend-service
+	kindDefaultBackend = "defaultbackend"
+)
+
+// workItem is a key of the work queue, name is the namespaced name of the
+// object of kind that changed.
+type workItem struct {
+	kind string
+	name string
+}
+
+// Controller reconciles nginx config from watched objects. Watch handlers
+// only record the latest objects and queue their names, everything else,
+// including issCache and the nginx config, is owned by a single worker.
+// Admission reviews dry-run ingresses on the same state, mu serializes them
+// with the worker.
 type Controller struct {
+	mu             sync.Mutex
+	synced         int32
+	review         *review
+	ingresses      *kube.Store[*ingress.Ingress]
+	ingressClasses *kube.Store[*ingress.IngressClass]
+	classes        *ingress.Classes
+	services       *kube.Store[*service.Service]
+	endpointSlices *kube.Store[*endpointslice.EndpointSlice]
+	configMaps     *kube.Store[*configmap.ConfigMap]
+	tcpServices    *kube.Store[*configmap.ConfigMap]
+	udpServices    *kube.Store[*configmap.ConfigMap]
+	streamRefs     []string
+	gatewayClasses *kube.Store[*gateway.GatewayClass]
+	gateways       *kube.Store[*gateway.Gateway]
+	httpRoutes     *kube.Store[*gateway.HTTPRoute]
+	// gatewayLocations, gatewaySplits and gatewayRefs record what the last
+	// syncGateways added, it is rebuilt as a whole
+	gatewayLocations []hostLocation
+	gatewaySplits    []string
+	gatewayRefs      []string
+	// rejectedRoutes are the routes held back by rejectGateways
+	rejectedRoutes map[string]rejectedRoute
+	queue          *queue[workItem]
 	issCache       map[string]*ingress.Ingress
+	secretRefs     map[string][]string
+	serviceRefs    map[string]map[string]struct{}
+	backends       map[string]*backend
+	status         *statusUpdater
+	recorder       *event.Recorder
+	leader         int32
 	ngx            *nginx.Nginx
 	kc             kube.Client
 	secretInformer *kube.Informer[*secret.Secret]
+	// gauges is the *gauges snapshot read by the metrics collectors
+	gauges atomic.Value
+}
+
+// namespaces returns the namespaces of -watch-namespaces.
+func namespaces() []string {
+	var nss []string
+
+	for _, ns := range strings.Split(*watchNamespaces, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			nss = append(nss, ns)
+		}
+	}
+
+	return nss
 }
 
 func getSecretFilename(mt *kube.Metadata) string {
@@ -36,9 +132,59 @@ func withoutNgxPrefix(p string) string {
 	return strings.TrimPrefix(p, *nginx.Prefix+"/")
 }
 
+// getSecret returns a secret and takes a reference on it. A review neither
+// fetches nor references secrets: a dry-run uses the secrets fetched before
+// mu was locked, the restore of the applied ingress its cached secrets.
+func (c *Controller) getSecret(namespace, name string) (*secret.Secret, error) {
+	fullname := namespace + "/" + name
+
+	if c.review == nil {
+		sec := new(secret.Secret)
+		err := c.secretInformer.Get(namespace, name, secret.ReadFunc(namespace, name), &sec)
+		return sec, err
+	}
+
+	if c.review.secrets != nil {
+		if err := c.review.secretErrs[fullname]; err != nil {
+			return nil, err
+		}
+
+		if sec, ok := c.review.secrets[fullname]; ok {
+			return sec, nil
+		}
+	} else if sec, ok := c.secretInformer.Lookup(fullname); ok {
+		return sec, nil
+	}
+
+	return nil, fmt.Errorf("secret %s not found", fullname)
+}
+
+// releaseSecret releases the reference of getSecret.
+func (c *Controller) releaseSecret(namespace, name string) {
+	if c.review == nil {
+		c.secretInformer.Release(namespace, name)
+	}
+}
+
+// refSecret records that ref uses a secret, it is released along with ref.
+func (c *Controller) refSecret(ref, namespace, name string) {
+	if c.review == nil {
+		c.secretRefs[ref] = append(c.secretRefs[ref], namespace+"/"+name)
+	}
+}
+
+// secretDir returns the directory of the files of secrets, the scratch
+// directory during a dry-run.
+func (c *Controller) secretDir() string {
+	if c.review != nil && c.review.scratch != "" {
+		return c.review.scratch
+	}
+
+	return *nginx.Prefix
+}
+
 func (c *Controller) setupAuthSecret(namespace, name string, remake bool) (userfile string, err error) {
-	sec := new(secret.Secret)
-	err = c.secretInformer.Get(namespace, name, secret.ReadFunc(namespace, name), &sec)
+	sec, err := c.getSecret(namespace, name)
 
 	if err != nil {
 		return
@@ -46,13 +192,12 @@ func (c *Controller) setupAuthSecret(namespace, name string, remake bool) (userf
 
 	defer func() {
 		if remake || err != nil {
-			c.secretInformer.Release(namespace, name)
+			c.releaseSecret(namespace, name)
 		}
 	}()
 
-	userfile = path.Join(ngxAuthFileDir, getSecretFilename(sec.Metadata))
-
-	filepath := path.Join(*nginx.Prefix, userfile)
+	filepath := path.Join(c.secretDir(), ngxAuthFileDir, getSecretFilename(sec.Metadata))
+	userfile = withoutNgxPrefix(filepath)
 
 	if !remake {
 		if _, err = os.Stat(filepath); err == nil {
@@ -67,6 +212,10 @@ func (c *Controller) setupAuthSecret(namespace, name string, remake bool) (userf
 		return
 	}
 
+	if err = os.MkdirAll(path.Dir(filepath), 0777); err != nil {
+		return
+	}
+
 	if err = os.WriteFile(filepath, auth, 0777); err != nil {
 		return
 	}
@@ -75,8 +224,7 @@ func (c *Controller) setupAuthSecret(namespace, name string, remake bool) (userf
 }
 
 func (c *Controller) setupTlsSecret(namespace, name string, remake bool) (crt string, key string, err error) {
-	sec := new(secret.Secret)
-	err = c.secretInformer.Get(namespace, name, secret.ReadFunc(namespace, name), &sec)
+	sec, err := c.getSecret(namespace, name)
 
 	if err != nil {
 		return
@@ -84,7 +232,7 @@ func (c *Controller) setupTlsSecret(namespace, name string, remake bool) (crt st
 
 	defer func() {
 		if remake || err != nil {
-			c.secretInformer.Release(namespace, name)
+			c.releaseSecret(namespace, name)
 		}
 	}()
 
@@ -96,7 +244,7 @@ func (c *Controller) setupTlsSecret(namespace, name string, remake bool) (crt st
 		}
 
 		filepath := path.Join(
-			*nginx.Prefix,
+			c.secretDir(),
 			ngxTlsDir,
 			getSecretFilename(sec.Metadata),
 		)
@@ -133,17 +281,62 @@ func (c *Controller) setupTlsSecret(namespace, name string, remake bool) (crt st
 	return
 }
 
+// warn logs a configuration error of an ingress and reports it in a
+// Warning event.
+func (c *Controller) warn(is *ingress.Ingress, reason, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+
+	if c.review != nil {
+		if reason == reasonRejected || reason == reasonInvalidAnnotation {
+			c.review.rejected = append(c.review.rejected, msg)
+		} else {
+			c.review.warnings = append(c.review.warnings, msg)
+		}
+
+		return
+	}
+
+	log.Printf("controller: %s: %s, ingress=%s", reason, msg, is.Name())
+	countRejection(is.Name(), reason)
+	c.recorder.Eventf(is.Reference(), event.TypeWarning, reason, "%s", msg)
+}
+
 func (c *Controller) addIngress(is *ingress.Ingress) error {
 	log.Printf("controller: add ingress %s", is.Name())
 
 	c.issCache[is.Name()] = is
 
+	cfg, errs := annotation.Parse(is)
+
+	fatal := false
+
+	for _, err := range errs {
+		var annErr *annotation.Error
+
+		if errors.As(err, &annErr) && annErr.Fatal {
+			fatal = true
+			c.warn(is, reasonRejected, "%s, the ingress is not served", err)
+		} else {
+			c.warn(is, reasonInvalidAnnotation, "%s", err)
+		}
+	}
+
+	// the locations are not served without the restriction or redirect of
+	// an invalid annotation, a new version of the ingress is waited for
+	if fatal {
+		return nil
+	}
+
 	var basicAuthConf *nginx.BasicAuthConf
 
-	if ns, name, ok := annotation.ParseAuthSecret(is); ok {
+	if cfg.AuthSecret != "" {
+		ns, name := cfg.AuthSecretNamespace, cfg.AuthSecret
+
 		if userfile, err := c.setupAuthSecret(ns, name, false); err != nil {
+			c.warn(is, reasonSecretMissing, "auth secret %s/%s: %s", ns, name, err)
 			return fmt.Errorf("setupAuthSecret: %s", err)
 		} else {
+			c.refSecret(is.Name(), ns, name)
 			basicAuthConf = &nginx.BasicAuthConf{
 				Realm:    "Authentication required",
 				UserFile: userfile,
@@ -151,22 +344,7 @@ func (c *Controller) addIngress(is *ingress.Ingress) error {
 		}
 	}
 
-	var directives []nginx.Directive
-
-	setProxyTimeout := func(key string) {
-		if v, ok := is.Metadata.Annotations[fmt.Sprintf(annotation.Prefix+"proxy-%s-timeout", key)]; ok {
-			if iv, _ := strconv.Atoi(v); iv > 0 {
-				directives = append(directives, nginx.Directive{
-					fmt.Sprintf("proxy_%s_timeout", key),
-					v + "s",
-				})
-			}
-		}
-	}
-
-	setProxyTimeout("read")
-	setProxyTimeout("connect")
-	setProxyTimeout("send")
+	directives := cfg.Directives()
 
 	tlsConfs := map[string]*nginx.TLSConf{}
 
@@ -199,15 +377,30 @@ func (c *Controller) addIngress(is *ingress.Ingress) error {
 			return nil, err
 		}
 
+		c.refSecret(is.Name(), is.Metadata.Namespace, secretName)
 		tlsConfs[secretName] = tlsConfig
 		return tlsConfig, nil
 	}
 
+	var defaultBackend *nginx.ProxyPassConf
+
+	// defaulted are the hosts whose root is served by defaultBackend, or
+	// for the default server "" by a rule
+	defaulted := map[string]bool{}
+
+	if is.Spec.DefaultBackend != nil {
+		var err error
+
+		if defaultBackend, err = c.resolveBackend(is, is.Spec.DefaultBackend.Service); err != nil {
+			c.warn(is, reasonServiceMissing, "default backend: %s", err)
+		}
+	}
+
 	for _, rule := range is.Spec.Rules {
 		tlsConfig, err := getTlsConf(rule.Host)
 
 		if err != nil {
-			log.Printf("controller: getTlsConf error: %s, host=%s", err, rule.Host)
+			c.warn(is, reasonSecretMissing, "tls secret of host %s: %s", rule.Host, err)
 			continue
 		}
 
@@ -219,33 +412,61 @@ func (c *Controller) addIngress(is *ingress.Ingress) error {
 				},
 				Directives:       directives,
 				IngressRef:       is.Name(),
-				DisableAccessLog: is.Metadata.Annotations[annotation.EnableAccessLog] == "false",
+				DisableAccessLog: !cfg.EnableAccessLog,
 				BasicAuth:        basicAuthConf,
 			}
 
-			if v, ok := is.Metadata.Annotations[annotation.UseRegex]; ok {
-				loc.Path.Regex = v == "true"
-			}
+			loc.Path.Regex = cfg.UseRegex
 
-			if rewrite, ok := is.Metadata.Annotations[annotation.RewriteTarget]; ok {
-				loc.Return = &nginx.ReturnConf{Code: 301, Text: rewrite}
-			} else {
-				loc.ProxyPass = &nginx.ProxyPassConf{
-					Upstream: fmt.Sprintf(
-						"http://%s.%s:%d",
-						isPath.Backend.Service.Name,
-						is.Metadata.Namespace,
-						isPath.Backend.Service.Port.Number,
-					),
+			// the capture groups of rewrite-target refer to the path as a
+			// regex, it is anchored like the prefix or exact path it replaces
+			if cfg.RewriteTarget != "" {
+				if !cfg.UseRegex {
+					loc.Path.Path = anchorPath(isPath)
 				}
+
+				loc.Path.Regex = true
+				loc.Directives = append(append([]nginx.Directive(nil), directives...), nginx.Directive{
+					"rewrite", "(?i)" + loc.Path.Path, cfg.RewriteTarget, "break",
+				})
+			}
+
+			if cfg.Redirect != nil {
+				loc.Return = &nginx.ReturnConf{Code: cfg.Redirect.Code, Text: cfg.Redirect.URL}
+			} else if loc.ProxyPass, err = c.resolveBackend(is, isPath.Backend.Service); err != nil {
+				c.warn(is, reasonServiceMissing, "path %s: %s", loc.Path.String(), err)
+				continue
 			}
 
 			if err = c.ngx.AddLocation(rule.Host, loc, tlsConfig); err != nil {
-				log.Printf("addIngress: %s, ingress=%s, path=%s", err, is.Name(), loc.Path.String())
+				c.warn(is, reasonRejected, "path %s: %s", loc.Path.String(), err)
+			}
+		}
+
+		if defaultBackend != nil && rule.Host != "" && !defaulted[rule.Host] && !hasRootPath(rule) {
+			defaulted[rule.Host] = true
+
+			err := c.ngx.AddLocation(rule.Host, &nginx.Location{
+				Path: nginx.Path{
+					Path:     "/",
+					PathType: ingress.PathTypePrefix,
+				},
+				ProxyPass:  defaultBackend,
+				Directives: directives,
+				IngressRef: is.Name(),
+				BasicAuth:  basicAuthConf,
+			}, tlsConfig)
+
+			if err != nil {
+				c.warn(is, reasonRejected, "default backend of host %s: %s", rule.Host, err)
 			}
 		}
 
-		if tlsConfig != nil && is.Metadata.Annotations[annotation.ForceSSLRedirect] == "true" {
+		if rule.Host == "" && hasRootPath(rule) {
+			defaulted[""] = true
+		}
+
+		if tlsConfig != nil && cfg.ForceSSLRedirect {
 			err := c.ngx.AddLocation(rule.Host, &nginx.Location{
 				Path: nginx.Path{
 					Path:     "/",
@@ -259,125 +480,363 @@ func (c *Controller) addIngress(is *ingress.Ingress) error {
 			}, nil)
 
 			if err != nil {
-				log.Printf("controller: add ssl redirect rule error: %s, ingress=%s, host=%s", err, is.Name(), rule.Host)
+				c.warn(is, reasonRejected, "ssl redirect of host %s: %s", rule.Host, err)
 			}
 		}
 	}
 
+	// unmatched hosts are served by the default backend, it wins over
+	// -default-backend-service
+	if defaultBackend != nil && !defaulted[""] {
+		err := c.ngx.AddLocation("", &nginx.Location{
+			Path: nginx.Path{
+				Path:     "/",
+				PathType: ingress.PathTypePrefix,
+			},
+			ProxyPass:        defaultBackend,
+			Directives:       directives,
+			IngressRef:       is.Name(),
+			DisableAccessLog: !cfg.EnableAccessLog,
+			BasicAuth:        basicAuthConf,
+		}, nil)
+
+		if err != nil {
+			c.warn(is, reasonRejected, "default backend: %s", err)
+		}
+	}
+
 	return nil
 }
 
+// anchorPath returns the regex of a path matched by its type, ^/api for the
+// prefix /api and ^/api$ for the exact path /api.
+func anchorPath(p *ingress.Path) string {
+	re := p.Path
+
+	if !strings.HasPrefix(re, "^") {
+		re = "^" + re
+	}
+
+	if p.PathType == ingress.PathTypeExact && !strings.HasSuffix(re, "$") {
+		re += "$"
+	}
+
+	return re
+}
+
+// hasRootPath reports whether a rule serves every path of its host itself.
+func hasRootPath(rule *ingress.Rule) bool {
+	for _, p := range rule.Http.Paths {
+		if p.Path == "/" && p.PathType != ingress.PathTypeExact {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (c *Controller) deleteIngress(is *ingress.Ingress) {
+	c.releaseSecrets(c.removeIngress(is))
+}
+
+// removeIngress removes an ingress from the config and returns the secrets
+// it referenced, they are released by releaseSecrets.
+func (c *Controller) removeIngress(is *ingress.Ingress) []string {
 	log.Printf("controller: delete ingress %s", is.Name())
 
+	c.detachIngress(is)
+
+	refs := c.secretRefs[is.Name()]
+
+	delete(c.secretRefs, is.Name())
+	delete(c.issCache, is.Name())
+
+	return refs
+}
+
+// detachIngress removes the locations and backends of an ingress from the
+// config, it keeps its secrets.
+func (c *Controller) detachIngress(is *ingress.Ingress) {
 	for _, rule := range is.Spec.Rules {
 		c.ngx.DeleteLocation(rule.Host, is.Name())
 	}
 
-	if ns, name, ok := annotation.ParseAuthSecret(is); ok {
-		c.secretInformer.Release(ns, name)
+	// the default backend is served on the default server
+	if is.Spec.DefaultBackend != nil {
+		c.ngx.DeleteLocation("", is.Name())
 	}
 
-	isRelease := map[string]struct{}{}
+	c.releaseBackends(is.Name())
+}
+
+// buildAndReload reloads nginx when http.conf changed, or always with
+// force, e.g. after certificate files were rewritten.
+func (c *Controller) buildAndReload(force bool) (changed bool, err error) {
+	changed, err = c.ngx.BuildHttpConfig()
 
-	for _, tls := range is.Spec.TLS {
-		if _, ok := isRelease[tls.SecretName]; !ok {
-			c.secretInformer.Release(is.Metadata.Namespace, tls.SecretName)
-			isRelease[tls.SecretName] = struct{}{}
+	if err != nil {
+		return false, fmt.Errorf("BuildHttpConfig: %w", err)
+	}
+
+	if changed || force {
+		c.ngx.Reload()
+	}
+
+	return changed, nil
+}
+
+// syncIngress replaces the applied state of an ingress with its latest
+// observed object, removing it when it was deleted or filtered out.
+func (c *Controller) syncIngress(name string) error {
+	is, ok := c.ingresses.Get(name)
+
+	// the secrets of the applied version are released after the new one
+	// referenced them, e.g. a status update must not drop their files and
+	// watches and read them again
+	if applied, ok := c.issCache[name]; ok {
+		defer c.releaseSecrets(c.removeIngress(applied))
+	}
+
+	if !ok || !ingress.FilterIngress(is, c.classes) {
+		c.status.Set(name, false)
+		forgetRejections(name)
+		return nil
+	}
+
+	c.status.Set(name, true)
+
+	return c.addIngress(is)
+}
+
+// syncClasses recomputes the IngressClasses of this controller and queues
+// every ingress, as any of them may be claimed or released.
+func (c *Controller) syncClasses() error {
+	c.classes = ingress.NewClasses(c.ingressClasses.List())
+
+	for _, is := range c.ingresses.List() {
+		c.enqueueIngress(is.Name())
+	}
+
+	for name := range c.issCache {
+		c.enqueueIngress(name)
+	}
+
+	return nil
+}
+
+// syncSecret rewrites the files of a referenced secret after it changed.
+func (c *Controller) syncSecret(fullname string) error {
+	sec, ok := c.secretInformer.Lookup(fullname)
+
+	if !ok {
+		return nil
+	}
+
+	mt := sec.Metadata
+
+	switch sec.Type {
+	case secret.TypeOpaque:
+		userfile, err := c.setupAuthSecret(mt.Namespace, mt.Name, true)
+
+		if err != nil {
+			return fmt.Errorf("setupAuthSecret: %s", err)
 		}
+
+		log.Printf("controller: userfile %s updated", userfile)
+	case secret.TypeTLS:
+		crt, _, err := c.setupTlsSecret(mt.Namespace, mt.Name, true)
+
+		if err != nil {
+			return fmt.Errorf("setupTlsSecret: %s", err)
+		}
+
+		log.Printf("controller: tls %s updated", crt)
 	}
 
-	delete(c.issCache, is.Name())
+	return nil
 }
 
-func (c *Controller) watch(ctx context.Context) {
-	buildAndReload := func() {
-		if err := c.ngx.BuildHttpConfig(); err != nil {
-			log.Printf("controller: BuildHttpConfig: %s", err)
-		} else {
-			c.ngx.Reload()
+func (c *Controller) sync(item workItem) error {
+	var err error
+
+	switch item.kind {
+	case kindIngress:
+		err = c.syncIngress(item.name)
+	case kindSecret:
+		err = c.syncSecret(item.name)
+	case kindService:
+		err = c.syncService(item.name)
+	case kindEndpoints:
+		err = c.syncEndpoints(item.name)
+	case kindClass:
+		err = c.syncClasses()
+	case kindConfig:
+		err = c.syncConfig()
+	case kindStream:
+		err = c.syncStream()
+	case kindGateway:
+		err = c.syncGateways()
+	case kindDefaultBackend:
+		err = c.syncDefaultBackend()
+	}
+
+	changed, buildErr := c.buildAndReload(item.kind == kindSecret || item.kind == kindConfig)
+
+	var cfgErr *nginx.ConfigError
+
+	if errors.As(buildErr, &cfgErr) && item.kind == kindIngress {
+		if is, ok := c.issCache[item.name]; ok {
+			c.rejectIngress(is, cfgErr)
+
+			// a rejected ingress is not retried until it changes
+			err = nil
+			_, buildErr = c.buildAndReload(false)
 		}
 	}
 
-	handler := kube.WatchHandler[*ingress.Ingress]{
-		Added: func(is *ingress.Ingress) {
-			if !ingress.FilterIngress(is) {
-				return
-			}
+	if errors.As(buildErr, &cfgErr) && item.kind == kindStream {
+		c.rejectStream(cfgErr)
 
-			if _, ok := c.issCache[is.Name()]; !ok {
-				if err := c.addIngress(is); err != nil {
-					log.Printf("controller: %s, ingress=%s", err, is.Name())
-				} else {
-					log.Printf("controller: add ingress %s", is.Name())
-					buildAndReload()
-				}
-			}
-		},
-		Deleted: func(is *ingress.Ingress) {
-			if !ingress.FilterIngress(is) {
-				return
-			}
+		// rejected stream servers are not retried until a ConfigMap changes
+		err = nil
+		_, buildErr = c.buildAndReload(false)
+	}
 
-			if _, ok := c.issCache[is.Name()]; ok {
-				log.Printf("controller: delete ingress %s", is.Name())
-				c.deleteIngress(is)
-				buildAndReload()
-			}
-		},
-		Modified: func(is *ingress.Ingress) {
-			if !ingress.FilterIngress(is) {
-				return
-			}
+	if errors.As(buildErr, &cfgErr) && item.kind == kindGateway {
+		c.rejectGateways(cfgErr)
 
-			log.Printf("controller: modify ingress %s", is.Name())
+		// a rejected route is not retried until it changes
+		err = nil
+		_, buildErr = c.buildAndReload(false)
+	}
 
-			if is, ok := c.issCache[is.Name()]; !ok {
-				return
-			} else {
-				c.deleteIngress(is)
-			}
+	if errors.As(buildErr, &cfgErr) {
+		if refs := c.referrers(item); len(refs) > 0 {
+			c.rejectRefs(refs, cfgErr)
 
-			if err := c.addIngress(is); err != nil {
-				log.Printf("controller: %s, ingress=%s", err, is.Name())
-				return
-			}
+			// the referrers are not retried until they change
+			err = nil
+			_, buildErr = c.buildAndReload(false)
+		}
+	}
 
-			buildAndReload()
-		},
+	if buildErr != nil {
+		return buildErr
 	}
 
-	go kube.Watch(ctx, c.kc, ingress.WatchFunc, handler)
+	// syncs that leave the config as it was, e.g. after a status update of
+	// the ingress, are not reported
+	if item.kind == kindIngress && err == nil && changed {
+		if is, ok := c.issCache[item.name]; ok {
+			c.recorder.Eventf(is.Reference(), event.TypeNormal, reasonAddedOrUpdated, "Configuration for %s was added or updated", item.name)
+		}
+	}
+
+	return err
 }
 
-func (c *Controller) setupSecretInformer() {
-	onModify := func(sec *secret.Secret) {
-		mt := sec.Metadata
+// rejectIngress removes an ingress whose config nginx refused, so the rest
+// of the config keeps being served.
+func (c *Controller) rejectIngress(is *ingress.Ingress, err error) {
+	c.warn(is, reasonRejected, "%s", err)
+	c.deleteIngress(is)
+}
 
-		switch sec.Type {
-		case secret.TypeOpaque:
-			userfile, err := c.setupAuthSecret(mt.Namespace, mt.Name, true)
+// referrers returns the refs whose config is rendered from the Service,
+// endpoints or secret of item, a config nginx refuses after the object
+// changed is attributed to them.
+func (c *Controller) referrers(item workItem) []string {
+	var refs []string
 
-			if err != nil {
-				log.Printf("controller: setupAuthSecret: %s", err)
-				return
+	switch item.kind {
+	case kindService, kindEndpoints:
+		for ref := range c.serviceRefs[item.name] {
+			refs = append(refs, ref)
+		}
+	case kindSecret:
+		for ref, secrets := range c.secretRefs {
+			if contains(secrets, item.name) {
+				refs = append(refs, ref)
 			}
+		}
+	case kindDefaultBackend:
+		refs = append(refs, defaultBackendRef)
+	}
 
-			log.Printf("controller: userfile %s updated", userfile)
-		case secret.TypeTLS:
-			crt, _, err := c.setupTlsSecret(mt.Namespace, mt.Name, true)
-
-			if err != nil {
-				log.Printf("controller: setupTlsSecret: %s", err)
-				return
-			}
+	sort.Strings(refs)
+	return refs
+}
 
-			log.Printf("controller: tls %s updated", crt)
+// rejectRefs removes the config of refs after nginx refused it, like the
+// config of an ingress, stream server or route that was refused itself.
+func (c *Controller) rejectRefs(refs []string, err error) {
+	var stream, gateways bool
+
+	for _, ref := range refs {
+		switch {
+		case isStreamRef(ref):
+			stream = true
+		case isRouteRef(ref):
+			gateways = true
+		case ref == defaultBackendRef:
+			log.Printf("controller: %s: %s, default backend", reasonRejected, err)
+			c.releaseBackends(defaultBackendRef)
+			c.ngx.SetDefaultBackend(nil)
 		default:
-			return
+			if is, ok := c.issCache[ref]; ok {
+				c.rejectIngress(is, err)
+			}
 		}
+	}
 
-		c.ngx.Reload()
+	if stream {
+		c.rejectStream(err)
+	}
+
+	if gateways {
+		c.rejectGateways(err)
+	}
+}
+
+func (c *Controller) processNextItem() bool {
+	item, ok := c.queue.Get()
+
+	if !ok {
+		return false
+	}
+
+	defer c.queue.Done(item)
+
+	c.mu.Lock()
+	err := c.sync(item)
+	c.snapshotGauges()
+	c.mu.Unlock()
+
+	if err != nil {
+		log.Printf("controller: sync %s %s: %s, retrying", item.kind, item.name, err)
+		c.queue.AddRateLimited(item)
+		return true
+	}
+
+	c.queue.Forget(item)
+	return true
+}
+
+func (c *Controller) worker() {
+	for c.processNextItem() {
+	}
+}
+
+func (c *Controller) enqueueIngress(name string) {
+	c.queue.Add(workItem{kind: kindIngress, name: name})
+}
+
+func (c *Controller) setupSecretInformer() {
+	onModify := func(sec *secret.Secret) {
+		switch sec.Type {
+		case secret.TypeOpaque, secret.TypeTLS:
+			c.queue.Add(workItem{kind: kindSecret, name: sec.Name()})
+		}
 	}
 
 	onRelease := func(sec *secret.Secret) {
@@ -407,13 +866,140 @@ func (c *Controller) setupSecretInformer() {
 	c.secretInformer.Init()
 }
 
+func (c *Controller) setupStores() {
+	nss := namespaces()
+
+	c.ingresses = &kube.Store[*ingress.Ingress]{
+		Client:        c.kc,
+		Namespaces:    nss,
+		LabelSelector: *ingressSelector,
+		ListFunc:      ingress.ListFunc,
+		WatchFunc:     ingress.WatchFunc,
+		OnChange: func(is *ingress.Ingress) {
+			c.enqueueIngress(is.Name())
+		},
+	}
+
+	c.endpointSlices = &kube.Store[*endpointslice.EndpointSlice]{
+		Client:     c.kc,
+		Namespaces: nss,
+		ListFunc:   endpointslice.ListFunc,
+		WatchFunc:  endpointslice.WatchFunc,
+		OnChange: func(slice *endpointslice.EndpointSlice) {
+			c.queue.Add(workItem{kind: kindEndpoints, name: slice.ServiceName()})
+		},
+	}
+
+	c.services = &kube.Store[*service.Service]{
+		Client:     c.kc,
+		Namespaces: nss,
+		ListFunc:   service.ListFunc,
+		WatchFunc:  service.WatchFunc,
+		OnChange: func(svc *service.Service) {
+			c.queue.Add(workItem{kind: kindService, name: svc.Name()})
+		},
+	}
+
+	c.ingressClasses = &kube.Store[*ingress.IngressClass]{
+		Client:    c.kc,
+		ListFunc:  kube.ClusterScoped(ingress.ClassListFunc),
+		WatchFunc: kube.ClusterScoped(ingress.ClassWatchFunc),
+		OnChange: func(*ingress.IngressClass) {
+			c.queue.Add(workItem{kind: kindClass})
+		},
+	}
+
+	c.status = newStatusUpdater(c.kc, c.ingresses, c.services, c.isLeader)
+	c.configMaps = c.newConfigMapStore("configmap", *configMapName, kindConfig)
+	c.tcpServices = c.newConfigMapStore("tcp-services-configmap", *tcpServicesConfigMap, kindStream)
+	c.udpServices = c.newConfigMapStore("udp-services-configmap", *udpServicesConfigMap, kindStream)
+
+	c.ingresses.Init()
+	c.ingressClasses.Init()
+	c.services.Init()
+	c.endpointSlices.Init()
+
+	c.setupGatewayStores()
+}
+
+// SetLeader switches whether this replica writes to the cluster, every
+// replica serves traffic but only the leader writes.
+func (c *Controller) SetLeader(leader bool) {
+	var v int32
+
+	if leader {
+		v = 1
+	}
+
+	if atomic.SwapInt32(&c.leader, v) != v && leader {
+		c.status.Resync()
+
+		// route statuses are only written by the leader
+		if c.httpRoutes != nil {
+			c.queue.Add(workItem{kind: kindGateway})
+		}
+	}
+}
+
+func (c *Controller) isLeader() bool {
+	return atomic.LoadInt32(&c.leader) == 1
+}
+
 func (c *Controller) Run(ctx context.Context) error {
-	var iss []*ingress.Ingress
+	if err := c.ingressClasses.Sync(); err != nil {
+		return err
+	}
+
+	c.classes = ingress.NewClasses(c.ingressClasses.List())
+
+	if err := c.services.Sync(); err != nil {
+		return err
+	}
 
-	if err := kube.List(c.kc, ingress.ListFunc, &iss); err != nil {
+	if err := c.endpointSlices.Sync(); err != nil {
 		return err
 	}
 
+	if err := c.syncDefaultBackend(); err != nil {
+		return err
+	}
+
+	if err := c.ingresses.Sync(); err != nil {
+		return err
+	}
+
+	if c.configMaps != nil {
+		if err := c.configMaps.Sync(); err != nil {
+			return err
+		}
+
+		if err := c.syncConfig(); err != nil {
+			return err
+		}
+	}
+
+	for _, store := range []*kube.Store[*configmap.ConfigMap]{c.tcpServices, c.udpServices} {
+		if store == nil {
+			continue
+		}
+
+		if err := store.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if err := c.syncStream(); err != nil {
+		return err
+	}
+
+	if c.httpRoutes != nil {
+		for _, sync := range []func() error{c.gatewayClasses.Sync, c.gateways.Sync, c.httpRoutes.Sync} {
+			if err := sync(); err != nil {
+				return err
+			}
+		}
+	}
+
 	authfileDir := path.Join(*nginx.Prefix, ngxAuthFileDir)
 
 	if _, err := os.Stat(authfileDir); os.IsNotExist(err) {
@@ -424,32 +1010,132 @@ func (c *Controller) Run(ctx context.Context) error {
 
 	c.setupSecretInformer()
 
+	iss := c.ingresses.List()
+
+	// older ingresses win conflicting locations
+	sort.Slice(iss, func(i, j int) bool {
+		a, b := iss[i].Metadata, iss[j].Metadata
+
+		if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(b.CreationTimestamp)
+		}
+
+		return iss[i].Name() < iss[j].Name()
+	})
+
 	for _, is := range iss {
-		if ingress.FilterIngress(is) {
-			if err := c.addIngress(is); err != nil {
-				log.Printf("controller: %s, ingrsss=%s", err, is.Name())
+		if err := c.syncIngress(is.Name()); err != nil {
+			log.Printf("controller: %s, ingress=%s", err, is.Name())
+			c.queue.AddRateLimited(workItem{kind: kindIngress, name: is.Name()})
+		}
+	}
+
+	// ingresses win locations over routes
+	if c.httpRoutes != nil {
+		if err := c.syncGateways(); err != nil {
+			log.Printf("controller: %s, gateways", err)
+			c.queue.AddRateLimited(workItem{kind: kindGateway})
+		}
+	}
+
+	if _, err := c.ngx.BuildHttpConfig(); err != nil {
+		var cfgErr *nginx.ConfigError
+
+		if !errors.As(err, &cfgErr) {
+			return err
+		}
+
+		// find the offending ingresses by validating them one by one
+		log.Printf("controller: %s, validating ingresses separately", err)
+
+		for _, is := range c.issCache {
+			c.deleteIngress(is)
+		}
+
+		// the stream servers are validated first, they are rejected as a whole
+		if err := c.sync(workItem{kind: kindStream}); err != nil {
+			log.Printf("controller: %s, stream", err)
+		}
+
+		if c.httpRoutes != nil {
+			c.releaseSecrets(c.teardownGateways())
+		}
+
+		for _, is := range iss {
+			if err := c.sync(workItem{kind: kindIngress, name: is.Name()}); err != nil {
+				log.Printf("controller: %s, ingress=%s", err, is.Name())
+			}
+		}
+
+		if c.httpRoutes != nil {
+			if err := c.sync(workItem{kind: kindGateway}); err != nil {
+				log.Printf("controller: %s, gateways", err)
 			}
 		}
 	}
 
-	if err := c.ngx.BuildHttpConfig(); err != nil {
-		return err
+	go c.ingresses.Run(ctx)
+	go c.ingressClasses.Run(ctx)
+	go c.services.Run(ctx)
+	go c.endpointSlices.Run(ctx)
+
+	for _, store := range []*kube.Store[*configmap.ConfigMap]{c.configMaps, c.tcpServices, c.udpServices} {
+		if store != nil {
+			go store.Run(ctx)
+		}
+	}
+	if c.httpRoutes != nil {
+		go c.gatewayClasses.Run(ctx)
+		go c.gateways.Run(ctx)
+		go c.httpRoutes.Run(ctx)
 	}
 
-	go c.watch(ctx)
+	c.snapshotGauges()
+	atomic.StoreInt32(&c.synced, 1)
+
 	go c.secretInformer.Run(ctx)
+	go c.worker()
+	go c.status.Run(ctx)
+	go c.recorder.Run(ctx)
 
 	return c.ngx.Run()
 }
 
 func (c *Controller) Shutdown() {
+	c.queue.ShutDown()
 	c.ngx.Shutdown()
 }
 
 func New(ngx *nginx.Nginx, kc kube.Client) *Controller {
-	return &Controller{
-		issCache: map[string]*ingress.Ingress{},
-		ngx:      ngx,
-		kc:       kc,
+	c := newController(ngx, kc)
+	c.registerMetrics()
+	return c
+}
+
+// newController is New without the metrics, they are registered once per
+// process.
+func newController(ngx *nginx.Nginx, kc kube.Client) *Controller {
+	c := &Controller{
+		queue:          newQueue[workItem](),
+		issCache:       map[string]*ingress.Ingress{},
+		secretRefs:     map[string][]string{},
+		serviceRefs:    map[string]map[string]struct{}{},
+		backends:       map[string]*backend{},
+		rejectedRoutes: map[string]rejectedRoute{},
+		ngx:            ngx,
+		kc:             kc,
+		leader:         1,
+	}
+
+	c.recorder = &event.Recorder{
+		Client:    kc,
+		Component: eventComponent,
+		IsEnabled: c.isLeader,
 	}
+
+	c.recorder.Host, _ = os.Hostname()
+	c.recorder.Init()
+
+	c.setupStores()
+	return c
 }
@@ -0,0 +1,496 @@
+package controller
+
+import (
+	"fmt"
+	"ingress-controller/controller/annotation"
+	"ingress-controller/kube"
+	"ingress-controller/kube/endpointslice"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/kube/secret"
+	"ingress-controller/kube/service"
+	"ingress-controller/metrics"
+	"ingress-controller/nginx"
+	"ingress-controller/nginx/nginxtest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newTestServices returns the lists of the Services of names in the
+// namespace default, with the port 80 named http and an endpoint each, for
+// the lists of a fakeSecretClient.
+func newTestServices(names ...string) map[string][]interface{} {
+	lists := map[string][]interface{}{}
+
+	for i, name := range names {
+		svc := &service.Service{Metadata: &kube.Metadata{Namespace: "default", Name: name}}
+		svc.Spec.Type = service.TypeClusterIP
+		svc.Spec.Ports = []*service.Port{{Name: "http", Port: 80, TargetPort: kube.IntOrString{IntVal: 8080}}}
+
+		slice := &endpointslice.EndpointSlice{
+			Metadata: &kube.Metadata{
+				Namespace: "default",
+				Name:      name + "-abc",
+				Labels:    map[string]string{endpointslice.LabelServiceName: name},
+			},
+			AddressType: "IPv4",
+			Endpoints:   []*endpointslice.Endpoint{{Addresses: []string{fmt.Sprintf("10.0.0.%d", i+1)}}},
+			Ports:       []*endpointslice.Port{{Name: "http", Port: 8080}},
+		}
+
+		lists["/api/v1/services"] = append(lists["/api/v1/services"], svc)
+		lists["/apis/discovery.k8s.io/v1/endpointslices"] = append(lists["/apis/discovery.k8s.io/v1/endpointslices"], slice)
+	}
+
+	return lists
+}
+
+// stubNginx points the nginx prefix to a temporary directory and puts an
+// nginx first in $PATH that refuses the http.conf containing refuse, or
+// accepts every config when refuse is empty.
+func stubNginx(tb testing.TB, refuse string) {
+	prefix := *nginx.Prefix
+	tb.Cleanup(func() { *nginx.Prefix = prefix })
+	*nginx.Prefix = tb.TempDir()
+
+	bin := tb.TempDir()
+
+	// nginx -t -q -p prefix -c nginx.conf.staged
+	script := "#!/bin/sh\n"
+
+	if refuse != "" {
+		script += `if [ "$1" = -t ] && grep -qF '` + refuse + `' "$4/http.conf.staged"; then echo refused >&2; exit 1; fi` + "\n"
+	}
+
+	if err := os.WriteFile(filepath.Join(bin, "nginx"), []byte(script+"exit 0\n"), 0755); err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// renderHttp builds the config of c with stubNginx and returns http.conf.
+func renderHttp(t *testing.T, c *Controller) string {
+	if _, err := c.ngx.BuildHttpConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	conf, err := os.ReadFile(filepath.Join(*nginx.Prefix, "http.conf"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(conf)
+}
+
+func TestFatalAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		locations   int
+	}{
+		{
+			name:        "valid",
+			annotations: map[string]string{annotation.WhitelistSourceRange: "10.0.0.0/8"},
+			locations:   1,
+		},
+		{
+			name:        "invalid proxy setting",
+			annotations: map[string]string{annotation.ProxyReadTimeout: "1w"},
+			locations:   1,
+		},
+		{
+			name:        "invalid whitelist",
+			annotations: map[string]string{annotation.WhitelistSourceRange: "10.0.0.0/33"},
+		},
+		{
+			name:        "invalid auth secret",
+			annotations: map[string]string{annotation.AuthSecret: "Users"},
+		},
+		{
+			name:        "invalid auth secret namespace",
+			annotations: map[string]string{annotation.AuthSecret: "users", annotation.AuthSecretNamespace: "auth\n"},
+		},
+		{
+			name:        "invalid temporal redirect",
+			annotations: map[string]string{annotation.TemporalRedirect: "ftp://example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), &fakeSecretClient{})
+			_, builtin := c.ngx.Counts()
+
+			// a redirect serves the path without a Service
+			if tt.annotations[annotation.TemporalRedirect] == "" {
+				tt.annotations[annotation.PermanentRedirect] = "https://example.org"
+			}
+
+			is := &ingress.Ingress{Metadata: &kube.Metadata{Namespace: "default", Name: "web", Annotations: tt.annotations}}
+			is.Spec.Rules = append(is.Spec.Rules, &ingress.Rule{Host: "example.com"})
+			is.Spec.Rules[0].Http.Paths = append(is.Spec.Rules[0].Http.Paths, &ingress.Path{Path: "/", PathType: ingress.PathTypePrefix})
+
+			if err := c.addIngress(is); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, locations := c.ngx.Counts(); locations-builtin != tt.locations {
+				t.Errorf("%d locations served, want %d", locations-builtin, tt.locations)
+			}
+		})
+	}
+}
+
+// TestGaugesSnapshot checks that the gauges are read without mu, a scrape
+// must not wait for a sync.
+func TestGaugesSnapshot(t *testing.T) {
+	c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), &fakeSecretClient{})
+	c.setupSecretInformer()
+
+	ingresses := c.collect(func(g *gauges) []metrics.Sample {
+		return []metrics.Sample{{Value: float64(g.ingresses)}}
+	})
+
+	if samples := ingresses(); samples != nil {
+		t.Errorf("got %v before the initial build", samples)
+	}
+
+	c.issCache["default/web"] = &ingress.Ingress{}
+	c.snapshotGauges()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if samples := ingresses(); len(samples) != 1 || samples[0].Value != 1 {
+		t.Errorf("got %v, want 1 ingress", samples)
+	}
+}
+
+func TestRewriteTarget(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		pathType    string
+		annotations map[string]string
+		location    string
+		rewrite     string
+	}{
+		{
+			name:        "prefix",
+			path:        "/api",
+			pathType:    ingress.PathTypePrefix,
+			annotations: map[string]string{annotation.RewriteTarget: "/"},
+			location:    `location ~* "^/api" {`,
+			rewrite:     `rewrite "(?i)^/api" "/" "break";`,
+		},
+		{
+			name:        "exact",
+			path:        "/api",
+			pathType:    ingress.PathTypeExact,
+			annotations: map[string]string{annotation.RewriteTarget: "/"},
+			location:    `location ~* "^/api$" {`,
+			rewrite:     `rewrite "(?i)^/api$" "/" "break";`,
+		},
+		{
+			name:        "regex",
+			path:        "/api(/|$)(.*)",
+			pathType:    ingress.PathTypeImplementationSpecific,
+			annotations: map[string]string{annotation.RewriteTarget: "/$2", annotation.UseRegex: "true"},
+			location:    `location ~* "/api(/|$)(.*)" {`,
+			rewrite:     `rewrite "(?i)/api(/|$)(.*)" "/$2" "break";`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSecretClient{lists: newTestServices("web")}
+			c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), client)
+
+			if err := c.services.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.endpointSlices.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			is := &ingress.Ingress{Metadata: &kube.Metadata{Namespace: "default", Name: "web", Annotations: tt.annotations}}
+			is.Spec.Rules = append(is.Spec.Rules, &ingress.Rule{Host: "example.com"})
+			is.Spec.Rules[0].Http.Paths = append(is.Spec.Rules[0].Http.Paths, &ingress.Path{Path: tt.path, PathType: tt.pathType})
+			is.Spec.Rules[0].Http.Paths[0].Backend.Service.Name = "web"
+			is.Spec.Rules[0].Http.Paths[0].Backend.Service.Port.Number = 80
+
+			if err := c.addIngress(is); err != nil {
+				t.Fatal(err)
+			}
+
+			stubNginx(t, "")
+
+			conf := renderHttp(t, c)
+			start := strings.Index(conf, tt.location)
+
+			if start < 0 {
+				t.Fatalf("http.conf has no %s\n%s", tt.location, conf)
+			}
+
+			loc := conf[start : start+strings.Index(conf[start:], "\n  }")]
+
+			for _, want := range []string{tt.rewrite, `proxy_pass "http://default_web_80";`} {
+				if !strings.Contains(loc, "\n    "+want) {
+					t.Errorf("location has no %s\n%s", want, loc)
+				}
+			}
+		})
+	}
+}
+
+// ingressDirectives are the directives the annotations and paths of an
+// ingress add to its locations, by their number of arguments.
+var ingressDirectives = map[string]int{
+	"access_log":              1,
+	"add_header":              3,
+	"allow":                   1,
+	"auth_basic":              1,
+	"auth_basic_user_file":    1,
+	"client_max_body_size":    1,
+	"deny":                    1,
+	"include":                 1,
+	"proxy_connect_timeout":   1,
+	"proxy_pass":              1,
+	"proxy_read_timeout":      1,
+	"proxy_request_buffering": 1,
+	"proxy_send_timeout":      1,
+	"return":                  2,
+	"rewrite":                 3,
+	"set":                     2,
+}
+
+// checkStructure checks that conf only has the blocks and directives of
+// base, the config without the ingress, and the locations, upstreams and a
+// server an ingress adds.
+func checkStructure(base, conf string) error {
+	baseDirectives, err := nginxtest.Parse(base)
+
+	if err != nil {
+		return err
+	}
+
+	directives, err := nginxtest.Parse(conf)
+
+	if err != nil {
+		return err
+	}
+
+	known := map[string]bool{
+		"server/0{}": true, "server_name/1": true, "listen/1": true,
+		"upstream/1{}": true, "server/1": true, "location/1{}": true, "location/2{}": true,
+	}
+
+	// key names a directive in its parent block by its number of
+	// arguments, the directives of a location are checked on their own
+	var key func(parent string, d *nginxtest.Directive) string
+
+	key = func(parent string, d *nginxtest.Directive) string {
+		k := parent + d.Name + "/" + strconv.Itoa(len(d.Args))
+
+		if d.Block {
+			k += "{}"
+		}
+
+		return k
+	}
+
+	var walk func(parent string, directives []*nginxtest.Directive, visit func(string, *nginxtest.Directive) error) error
+
+	walk = func(parent string, directives []*nginxtest.Directive, visit func(string, *nginxtest.Directive) error) error {
+		for _, d := range directives {
+			if err := visit(parent, d); err != nil {
+				return err
+			}
+
+			if d.Block && d.Name != "location" {
+				if err := walk(parent+d.Name+"/", d.Children, visit); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	walk("", baseDirectives, func(parent string, d *nginxtest.Directive) error {
+		known[key(parent, d)] = true
+		return nil
+	})
+
+	// the path of the ingress and the 404 location of its server
+	locations := len(nginxtest.Find(baseDirectives, "location")) + 2
+
+	if n := len(nginxtest.Find(directives, "location")); n > locations {
+		return fmt.Errorf("%d locations, want at most %d", n, locations)
+	}
+
+	return walk("", directives, func(parent string, d *nginxtest.Directive) error {
+		k := key(parent, d)
+
+		if !known[k] && !known[key("", d)] {
+			return fmt.Errorf("unexpected %s", k)
+		}
+
+		if d.Name != "location" {
+			return nil
+		}
+
+		for _, child := range d.Children {
+			if n, ok := ingressDirectives[child.Name]; child.Block || !ok || len(child.Args) != n {
+				return fmt.Errorf("unexpected %s in location %s", key("", child), strings.Join(d.Args, " "))
+			}
+
+			switch {
+			case child.Name == "include" && child.Args[0] != "proxy_params",
+				child.Name == "rewrite" && child.Args[2] != "break":
+				return fmt.Errorf("unexpected %s %s", child.Name, strings.Join(child.Args, " "))
+			case child.Name == "return":
+				if _, err := strconv.Atoi(child.Args[0]); err != nil {
+					return fmt.Errorf("unexpected return %s", strings.Join(child.Args, " "))
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// FuzzIngress adds an ingress with arbitrary hosts, paths and annotation
+// values and checks that they do not change the structure of http.conf, they
+// are either rejected by annotation.Parse and addIngress or only end up
+// quoted in the directives of a location.
+func FuzzIngress(f *testing.F) {
+	f.Add("example.com", "/api", "/$1", "https://example.org", "10.0.0.0/8", "60s", false, false)
+	f.Add("", "/", "/", `https://example.com/"; include /etc/passwd; #`, "", "1m", false, true)
+	f.Add("_", "^/(.*)", "/$1 } location / { return 200", "", "10.0.0.1", "off", true, false)
+	f.Add("a b;", "/a'b\\", "/x\n}\nserver {\n  listen 81;", "https://a.b/${x}", "::1", "x;", false, false)
+	f.Add("#", "/\\\"", "/${a} '\\", "http://x/ include", "0.0.0.0/0;", "1k load_module", true, true)
+
+	stubNginx(f, "")
+
+	f.Fuzz(func(t *testing.T, host, path, rewriteTarget, redirect, whitelist, value string, regex, exact bool) {
+		client := &fakeSecretClient{lists: newTestServices("web")}
+		c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), client)
+
+		if err := c.services.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := c.endpointSlices.Sync(); err != nil {
+			t.Fatal(err)
+		}
+
+		base := renderHttp(t, c)
+
+		annotations := map[string]string{
+			annotation.RewriteTarget:         rewriteTarget,
+			annotation.UseRegex:              strconv.FormatBool(regex),
+			annotation.ProxyReadTimeout:      value,
+			annotation.ProxyBodySize:         value,
+			annotation.ProxyRequestBuffering: value,
+		}
+
+		if redirect != "" {
+			annotations[annotation.TemporalRedirect] = redirect
+		}
+
+		if whitelist != "" {
+			annotations[annotation.WhitelistSourceRange] = whitelist
+		}
+
+		pathType := ingress.PathTypePrefix
+
+		if exact {
+			pathType = ingress.PathTypeExact
+		}
+
+		is := &ingress.Ingress{Metadata: &kube.Metadata{Namespace: "default", Name: "web", Annotations: annotations}}
+		is.Spec.Rules = append(is.Spec.Rules, &ingress.Rule{Host: host})
+		is.Spec.Rules[0].Http.Paths = append(is.Spec.Rules[0].Http.Paths, &ingress.Path{Path: path, PathType: pathType})
+		is.Spec.Rules[0].Http.Paths[0].Backend.Service.Name = "web"
+		is.Spec.Rules[0].Http.Paths[0].Backend.Service.Port.Number = 80
+
+		// an ingress nginx can not serve is rejected, the config stays
+		// as it was
+		c.addIngress(is)
+
+		conf := renderHttp(t, c)
+
+		if err := checkStructure(base, conf); err != nil {
+			t.Fatalf("%s:\n%s", err, conf)
+		}
+	})
+}
+
+// TestSyncIngressKeepsSecrets syncs an ingress again without a change, like
+// after a status update, its secrets must be neither read again nor their
+// files removed.
+func TestSyncIngressKeepsSecrets(t *testing.T) {
+	stubNginx(t, "")
+
+	is := &ingress.Ingress{Metadata: &kube.Metadata{
+		Namespace:   "default",
+		Name:        "web",
+		Annotations: map[string]string{annotation.AuthSecret: "users"},
+	}}
+	is.Spec.TLS = append(is.Spec.TLS, &ingress.TLS{Host: []string{"example.com"}, SecretName: "tls"})
+	is.Spec.Rules = append(is.Spec.Rules, &ingress.Rule{Host: "example.com"})
+	is.Spec.Rules[0].Http.Paths = append(is.Spec.Rules[0].Http.Paths, &ingress.Path{Path: "/", PathType: ingress.PathTypePrefix})
+	is.Spec.Rules[0].Http.Paths[0].Backend.Service.Name = "web"
+	is.Spec.Rules[0].Http.Paths[0].Backend.Service.Port.Number = 80
+
+	lists := newTestServices("web")
+	lists["/apis/networking.k8s.io/v1/ingresses"] = []interface{}{is}
+
+	client := &fakeSecretClient{lists: lists, secrets: map[string]*secret.Secret{
+		"default/tls":   newTestSecret("default", "tls", secret.TypeTLS, map[string][]byte{"tls.crt": []byte("crt"), "tls.key": []byte("key")}),
+		"default/users": newTestSecret("default", "users", secret.TypeOpaque, map[string][]byte{"auth": []byte("user:pass")}),
+	}}
+
+	c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), client)
+	c.classes = ingress.NewClasses(nil)
+	c.setupSecretInformer()
+
+	for _, store := range []interface{ Sync() error }{c.ingresses, c.services, c.endpointSlices} {
+		if err := store.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.syncIngress("default/web"); err != nil {
+		t.Fatal(err)
+	}
+
+	files := prefixFiles(t)
+	client.requests = nil
+
+	if err := c.syncIngress("default/web"); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(client.requests) > 0 {
+		t.Errorf("requests %v, want none", client.requests)
+	}
+
+	if got := prefixFiles(t); strings.Join(got, ",") != strings.Join(files, ",") {
+		t.Errorf("files %v, want %v", got, files)
+	}
+
+	if refs := c.secretInformer.Refs(); len(refs) != 2 || refs["default/tls"] != 1 || refs["default/users"] != 1 {
+		t.Errorf("secret references %v, want one of tls and users", refs)
+	}
+
+	if _, ok := c.issCache["default/web"]; !ok {
+		t.Error("the ingress is not served")
+	}
+}
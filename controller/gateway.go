@@ -0,0 +1,1047 @@
+package controller
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"ingress-controller/kube"
+	"ingress-controller/kube/event"
+	"ingress-controller/kube/gateway"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/nginx"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var gatewayAPI = flag.Bool("gateway-api", false, "handle Gateways and HTTPRoutes of the GatewayClasses of this controller")
+
+const gatewayGroup = "gateway.networking.k8s.io"
+
+var (
+	headerNameRe = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+	queryNameRe  = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	hostnameRe   = regexp.MustCompile(`^(\*\.)?[a-z0-9]([a-z0-9.-]*[a-z0-9])?$`)
+	// routePathRe matches paths that can be written unquoted into a location
+	routePathRe = regexp.MustCompile(`^/[^\s"';{}]*$`)
+)
+
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// gatewayListener is a listener of a Gateway of this controller that routes
+// attach to.
+type gatewayListener struct {
+	gateway  *gateway.Gateway
+	listener *gateway.Listener
+	tls      *nginx.TLSConf
+}
+
+// routeHost is a host a route is served on.
+type routeHost struct {
+	host string
+	tls  *nginx.TLSConf
+}
+
+// routeEntry is a match of an HTTPRoute rule on a host.
+type routeEntry struct {
+	routeHost
+	path  nginx.Path
+	route *nginx.Route
+	owner *gateway.HTTPRoute
+	// rank orders entries of a location by the precedence of the Gateway
+	// API: method matches, then the number of header matches, then the
+	// number of query matches
+	rank [3]int
+	// order is the position of the route, rule and match
+	order int
+}
+
+// rejectedRoute is an HTTPRoute whose config nginx refused, it is held
+// back until its generation changes.
+type rejectedRoute struct {
+	generation int
+	err        string
+}
+
+// routeWarning is a problem of a route reported in an event.
+type routeWarning struct {
+	route   *gateway.HTTPRoute
+	message string
+}
+
+// hostLocation is a location added to nginx by syncGateways.
+type hostLocation struct {
+	host string
+	ref  string
+}
+
+// gatewayRef and routeRef name Gateways and HTTPRoutes as referrers of
+// secrets and Services.
+func gatewayRef(gw *gateway.Gateway) string {
+	return "gateway:" + gw.Name()
+}
+
+func routeRef(route *gateway.HTTPRoute) string {
+	return "httproute:" + route.Name()
+}
+
+func isRouteRef(ref string) bool {
+	return strings.HasPrefix(ref, "httproute:") || strings.HasPrefix(ref, "gateway:")
+}
+
+// intersectHostname returns the more specific of a listener and a route
+// hostname, or false when they do not match. Empty hostnames match all.
+func intersectHostname(listener, route string) (string, bool) {
+	switch {
+	case listener == "" || listener == route:
+		return route, true
+	case route == "":
+		return listener, true
+	case strings.HasPrefix(listener, "*.") && strings.HasSuffix(route, listener[1:]):
+		return route, true
+	case strings.HasPrefix(route, "*.") && strings.HasSuffix(listener, route[1:]):
+		return listener, true
+	}
+
+	return "", false
+}
+
+// checkValue rejects values that can not be written into a quoted string of
+// the nginx config. Exact values are interpolated by nginx, so they must not
+// contain variables either.
+func checkValue(v string, regex bool) error {
+	if strings.ContainsAny(v, "\"\r\n\x00") || (!regex && strings.ContainsAny(v, "$\\")) {
+		return fmt.Errorf("unsupported value %q", v)
+	}
+
+	if regex {
+		return checkRegex(v)
+	}
+
+	return nil
+}
+
+// checkRegex rejects regexes that do not compile, so a route with a regex
+// nginx would refuse is rejected alone. The syntax of Go is mostly a
+// subset of the PCRE of nginx.
+func checkRegex(v string) error {
+	if _, err := regexp.Compile(v); err != nil {
+		return fmt.Errorf("unsupported regex %q", v)
+	}
+
+	return nil
+}
+
+// routeMatch translates an HTTPRoute match into the path of a location and
+// the matches of a route.
+func routeMatch(m gateway.HTTPRouteMatch) (path nginx.Path, matches []nginx.Match, err error) {
+	path = nginx.Path{Path: "/", PathType: ingress.PathTypePrefix}
+
+	if m.Path != nil {
+		if !routePathRe.MatchString(m.Path.Value) {
+			return path, nil, fmt.Errorf("unsupported path %q", m.Path.Value)
+		}
+
+		path.Path = m.Path.Value
+
+		switch m.Path.Type {
+		case gateway.PathMatchExact:
+			path.PathType = ingress.PathTypeExact
+		case gateway.PathMatchRegularExpression:
+			if err := checkRegex(m.Path.Value); err != nil {
+				return path, nil, err
+			}
+
+			path.Regex = true
+		case "", gateway.PathMatchPathPrefix:
+		default:
+			return path, nil, fmt.Errorf("unsupported path match %s", m.Path.Type)
+		}
+	}
+
+	for _, h := range m.Headers {
+		if !headerNameRe.MatchString(h.Name) {
+			return path, nil, fmt.Errorf("unsupported header %q", h.Name)
+		}
+
+		regex := h.Type == gateway.PathMatchRegularExpression
+
+		if err := checkValue(h.Value, regex); err != nil {
+			return path, nil, err
+		}
+
+		matches = append(matches, nginx.Match{
+			Variable: "$http_" + strings.ReplaceAll(strings.ToLower(h.Name), "-", "_"),
+			Value:    h.Value,
+			Regex:    regex,
+		})
+	}
+
+	for _, q := range m.QueryParams {
+		if !queryNameRe.MatchString(q.Name) {
+			return path, nil, fmt.Errorf("unsupported query parameter %q", q.Name)
+		}
+
+		regex := q.Type == gateway.PathMatchRegularExpression
+
+		if err := checkValue(q.Value, regex); err != nil {
+			return path, nil, err
+		}
+
+		matches = append(matches, nginx.Match{
+			Variable: "$arg_" + q.Name,
+			Value:    q.Value,
+			Regex:    regex,
+		})
+	}
+
+	if m.Method != "" {
+		if !contains(httpMethods, m.Method) {
+			return path, nil, fmt.Errorf("unsupported method %s", m.Method)
+		}
+
+		matches = append(matches, nginx.Match{Variable: "$request_method", Value: m.Method})
+	}
+
+	return path, matches, nil
+}
+
+// routeRedirect translates a RequestRedirect filter into a return.
+func routeRedirect(f *gateway.HTTPRouteFilter) (*nginx.ReturnConf, error) {
+	redirect := f.RequestRedirect
+
+	if redirect == nil {
+		return nil, errors.New("RequestRedirect filter without requestRedirect")
+	}
+
+	scheme, host, path := "$scheme", "$host", "$request_uri"
+
+	if redirect.Scheme != "" {
+		if redirect.Scheme != "http" && redirect.Scheme != "https" {
+			return nil, fmt.Errorf("unsupported redirect scheme %s", redirect.Scheme)
+		}
+
+		scheme = redirect.Scheme
+	}
+
+	if redirect.Hostname != "" {
+		if !hostnameRe.MatchString(redirect.Hostname) || strings.HasPrefix(redirect.Hostname, "*") {
+			return nil, fmt.Errorf("unsupported redirect hostname %q", redirect.Hostname)
+		}
+
+		host = redirect.Hostname
+	}
+
+	if redirect.Port != 0 {
+		host += ":" + strconv.Itoa(redirect.Port)
+	}
+
+	if redirect.Path != nil {
+		if redirect.Path.Type != "ReplaceFullPath" || !routePathRe.MatchString(redirect.Path.ReplaceFullPath) {
+			return nil, errors.New("unsupported redirect path, only ReplaceFullPath is supported")
+		}
+
+		path = redirect.Path.ReplaceFullPath + "$is_args$args"
+	}
+
+	code := redirect.StatusCode
+
+	if code == 0 {
+		code = http.StatusFound
+	}
+
+	if code != http.StatusMovedPermanently && code != http.StatusFound {
+		return nil, fmt.Errorf("unsupported redirect status code %d", code)
+	}
+
+	return &nginx.ReturnConf{Code: code, Text: scheme + "://" + host + path}, nil
+}
+
+// routeHeaders translates a RequestHeaderModifier filter into headers.
+func routeHeaders(f *gateway.HTTPRouteFilter) ([]nginx.Header, error) {
+	modifier := f.RequestHeaderModifier
+
+	if modifier == nil {
+		return nil, errors.New("RequestHeaderModifier filter without requestHeaderModifier")
+	}
+
+	var headers []nginx.Header
+
+	add := func(name, value string, appendValue bool) error {
+		if !headerNameRe.MatchString(name) {
+			return fmt.Errorf("unsupported header %q", name)
+		}
+
+		if err := checkValue(value, false); err != nil {
+			return err
+		}
+
+		headers = append(headers, nginx.Header{Name: name, Value: value, Append: appendValue})
+		return nil
+	}
+
+	for _, h := range modifier.Set {
+		if err := add(h.Name, h.Value, false); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, h := range modifier.Add {
+		if err := add(h.Name, h.Value, true); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range modifier.Remove {
+		if err := add(name, "", false); err != nil {
+			return nil, err
+		}
+	}
+
+	return headers, nil
+}
+
+// splitName names the split of the n-th weighted rule.
+func splitName(n int) string {
+	return fmt.Sprintf("route_split_%d", n)
+}
+
+// routeBackends resolves the backendRefs of a rule. Weighted backends are
+// spread by a split, a rule without usable backends answers 500. The reason
+// of the first unresolved backend is returned with the problems.
+func (c *Controller) routeBackends(route *gateway.HTTPRoute, rule *gateway.HTTPRouteRule) (action *nginx.Route, reason string, problems []string) {
+	var (
+		targets []*nginx.ProxyPassConf
+		weights []int
+		total   int
+	)
+
+	problem := func(r, format string, args ...interface{}) {
+		if reason == "" {
+			reason = r
+		}
+
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, ref := range rule.BackendRefs {
+		if (ref.Group != "" && ref.Group != "core") || (ref.Kind != "" && ref.Kind != "Service") {
+			problem(gateway.ReasonInvalidKind, "unsupported backend kind %s", ref.Kind)
+			continue
+		}
+
+		// ReferenceGrants are not supported
+		if ref.Namespace != "" && ref.Namespace != route.Metadata.Namespace {
+			problem(gateway.ReasonRefNotPermitted, "service %s/%s of another namespace", ref.Namespace, ref.Name)
+			continue
+		}
+
+		if ref.EffectiveWeight() <= 0 {
+			continue
+		}
+
+		proxyPass, err := c.resolveService(routeRef(route), route.Metadata.Namespace+"/"+ref.Name, "", ref.Port)
+
+		if err != nil {
+			problem(gateway.ReasonBackendNotFound, "%s", err)
+			continue
+		}
+
+		targets = append(targets, proxyPass)
+		weights = append(weights, ref.EffectiveWeight())
+		total += ref.EffectiveWeight()
+	}
+
+	switch len(targets) {
+	case 0:
+		return &nginx.Route{Return: &nginx.ReturnConf{Code: http.StatusInternalServerError}}, reason, problems
+	case 1:
+		return &nginx.Route{ProxyPass: targets[0]}, reason, problems
+	}
+
+	split := &nginx.Split{Name: splitName(len(c.gatewaySplits))}
+
+	for i, target := range targets {
+		upstream := strings.TrimPrefix(target.Target(), "http://")
+
+		if i == len(targets)-1 {
+			split.Targets = append(split.Targets, nginx.SplitTarget{Percent: "*", Upstream: upstream})
+		} else {
+			percent := float64(weights[i]) * 100 / float64(total)
+			split.Targets = append(split.Targets, nginx.SplitTarget{Percent: fmt.Sprintf("%.2f%%", percent), Upstream: upstream})
+		}
+	}
+
+	c.ngx.SetSplit(split)
+	c.gatewaySplits = append(c.gatewaySplits, split.Name)
+
+	return &nginx.Route{ProxyPass: &nginx.ProxyPassConf{Upstream: "http://$" + split.Name}}, reason, problems
+}
+
+// gatewayListeners returns the listeners of the Gateways of this
+// controller, keyed by Gateway.
+func (c *Controller) gatewayListeners() map[string][]*gatewayListener {
+	classes := map[string]struct{}{}
+
+	for _, class := range c.gatewayClasses.List() {
+		if class.Spec.ControllerName == ingress.ControllerName() {
+			classes[class.Name()] = struct{}{}
+		}
+	}
+
+	_, settings := c.ngx.Defaults()
+	listeners := map[string][]*gatewayListener{}
+
+	for _, gw := range c.gateways.List() {
+		if _, ok := classes[gw.Spec.GatewayClassName]; !ok {
+			continue
+		}
+
+		listeners[gw.Name()] = []*gatewayListener{}
+
+		for i := range gw.Spec.Listeners {
+			l := &gw.Spec.Listeners[i]
+			gl := &gatewayListener{gateway: gw, listener: l}
+
+			switch {
+			case l.Protocol == gateway.ProtocolHTTP && l.Port == settings.Listen:
+			case l.Protocol == gateway.ProtocolHTTPS && l.Port == settings.TLSListen:
+				if l.TLS == nil || len(l.TLS.CertificateRefs) == 0 || (l.TLS.Mode != "" && l.TLS.Mode != "Terminate") {
+					log.Printf("controller: gateway %s listener %s: no certificate to terminate TLS", gw.Name(), l.Name)
+					continue
+				}
+
+				ref := l.TLS.CertificateRefs[0]
+
+				if ref.Namespace != "" && ref.Namespace != gw.Metadata.Namespace {
+					log.Printf("controller: gateway %s listener %s: certificate of another namespace", gw.Name(), l.Name)
+					continue
+				}
+
+				crt, key, err := c.setupTlsSecret(gw.Metadata.Namespace, ref.Name, false)
+
+				if err != nil {
+					log.Printf("controller: gateway %s listener %s: %s", gw.Name(), l.Name, err)
+					continue
+				}
+
+				c.secretRefs[gatewayRef(gw)] = append(c.secretRefs[gatewayRef(gw)], gw.Metadata.Namespace+"/"+ref.Name)
+				gl.tls = &nginx.TLSConf{Cert: crt, Key: key}
+			default:
+				log.Printf("controller: gateway %s listener %s: unsupported protocol %s or port %d", gw.Name(), l.Name, l.Protocol, l.Port)
+				continue
+			}
+
+			listeners[gw.Name()] = append(listeners[gw.Name()], gl)
+		}
+	}
+
+	return listeners
+}
+
+// attachRoute returns the hosts a route is served on through a parent
+// Gateway, along with the Accepted condition of that parent.
+func attachRoute(route *gateway.HTTPRoute, parent gateway.ParentReference, listeners []*gatewayListener) ([]routeHost, gateway.Condition) {
+	cond := gateway.Condition{Type: gateway.ConditionAccepted, Status: "False"}
+
+	var candidates []*gatewayListener
+
+	for _, gl := range listeners {
+		if parent.SectionName != "" && parent.SectionName != gl.listener.Name {
+			continue
+		}
+
+		if parent.Port != 0 && parent.Port != gl.listener.Port {
+			continue
+		}
+
+		candidates = append(candidates, gl)
+	}
+
+	if len(candidates) == 0 {
+		cond.Reason, cond.Message = gateway.ReasonNoMatchingParent, "no supported listener matches the parentRef"
+		return nil, cond
+	}
+
+	var allowed []*gatewayListener
+
+	for _, gl := range candidates {
+		switch gl.listener.NamespacesFrom() {
+		case gateway.NamespacesFromAll:
+			allowed = append(allowed, gl)
+		case gateway.NamespacesFromSame:
+			if gl.gateway.Metadata.Namespace == route.Metadata.Namespace {
+				allowed = append(allowed, gl)
+			}
+		}
+	}
+
+	if len(allowed) == 0 {
+		cond.Reason, cond.Message = gateway.ReasonNotAllowedByListeners, "no listener allows routes of this namespace"
+		return nil, cond
+	}
+
+	var hosts []routeHost
+
+	for _, gl := range allowed {
+		hostnames := route.Spec.Hostnames
+
+		if len(hostnames) == 0 {
+			hostnames = []string{""}
+		}
+
+		for _, hostname := range hostnames {
+			if host, ok := intersectHostname(gl.listener.Hostname, hostname); ok {
+				hosts = append(hosts, routeHost{host: host, tls: gl.tls})
+			}
+		}
+	}
+
+	if len(hosts) == 0 {
+		cond.Reason, cond.Message = gateway.ReasonNoMatchingHostname, "no hostname matches the listeners"
+		return nil, cond
+	}
+
+	cond.Status, cond.Reason, cond.Message = "True", gateway.ReasonAccepted, "Route is accepted"
+	return hosts, cond
+}
+
+// routeEntries translates the rules of a route into entries on hosts. The
+// problems of unsupported rules and of unresolved backends are returned
+// apart, they are reported by different conditions.
+func (c *Controller) routeEntries(route *gateway.HTTPRoute, hosts []routeHost, order *int) (entries []*routeEntry, problems []string, refReason string, refProblems []string) {
+	for ri := range route.Spec.Rules {
+		rule := &route.Spec.Rules[ri]
+
+		var (
+			redirect *nginx.ReturnConf
+			headers  []nginx.Header
+			err      error
+		)
+
+		for fi := range rule.Filters {
+			f := &rule.Filters[fi]
+
+			switch f.Type {
+			case gateway.FilterRequestRedirect:
+				redirect, err = routeRedirect(f)
+			case gateway.FilterRequestHeaderModifier:
+				var hs []nginx.Header
+
+				if hs, err = routeHeaders(f); err == nil {
+					headers = append(headers, hs...)
+				}
+			default:
+				err = fmt.Errorf("unsupported filter %s", f.Type)
+			}
+
+			if err != nil {
+				break
+			}
+		}
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("rule %d: %s", ri, err))
+			continue
+		}
+
+		action := &nginx.Route{Return: redirect}
+
+		if redirect == nil {
+			var (
+				reason string
+				ps     []string
+			)
+
+			action, reason, ps = c.routeBackends(route, rule)
+
+			if refReason == "" {
+				refReason = reason
+			}
+
+			for _, p := range ps {
+				refProblems = append(refProblems, fmt.Sprintf("rule %d: %s", ri, p))
+			}
+		}
+
+		action.Headers = headers
+
+		matches := rule.Matches
+
+		if len(matches) == 0 {
+			matches = []gateway.HTTPRouteMatch{{}}
+		}
+
+		for mi, m := range matches {
+			path, conds, err := routeMatch(m)
+
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("rule %d match %d: %s", ri, mi, err))
+				continue
+			}
+
+			var method int
+
+			if m.Method != "" {
+				method = 1
+			}
+
+			for _, host := range hosts {
+				entries = append(entries, &routeEntry{
+					routeHost: host,
+					path:      path,
+					route: &nginx.Route{
+						Matches:   conds,
+						ProxyPass: action.ProxyPass,
+						Return:    action.Return,
+						Headers:   action.Headers,
+					},
+					owner: route,
+					rank:  [3]int{method, len(m.Headers), len(m.QueryParams)},
+					order: *order,
+				})
+			}
+
+			*order++
+		}
+	}
+
+	return
+}
+
+// teardownGateways removes everything syncGateways added. The secrets held
+// for listeners are returned, they are released by releaseSecrets once the
+// new config holds them again, so their files are not rewritten.
+func (c *Controller) teardownGateways() (secrets []string) {
+	for _, hl := range c.gatewayLocations {
+		c.ngx.DeleteLocation(hl.host, hl.ref)
+	}
+
+	for _, name := range c.gatewaySplits {
+		c.ngx.DeleteSplit(name)
+	}
+
+	for _, ref := range c.gatewayRefs {
+		c.releaseBackends(ref)
+
+		secrets = append(secrets, c.secretRefs[ref]...)
+		delete(c.secretRefs, ref)
+	}
+
+	c.gatewayLocations = nil
+	c.gatewaySplits = nil
+	c.gatewayRefs = nil
+	return
+}
+
+func (c *Controller) releaseSecrets(secrets []string) {
+	for _, fullname := range secrets {
+		ns, name, _ := strings.Cut(fullname, "/")
+		c.secretInformer.Release(ns, name)
+	}
+}
+
+// sortedRoutes returns the HTTPRoutes, older routes first as they win
+// conflicting matches.
+func (c *Controller) sortedRoutes() []*gateway.HTTPRoute {
+	routes := c.httpRoutes.List()
+
+	sort.Slice(routes, func(i, j int) bool {
+		a, b := routes[i].Metadata, routes[j].Metadata
+
+		if !a.CreationTimestamp.Equal(b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(b.CreationTimestamp)
+		}
+
+		return routes[i].Name() < routes[j].Name()
+	})
+
+	return routes
+}
+
+// syncGateways rebuilds the locations of all HTTPRoutes attached to the
+// Gateways of this controller and writes back the route statuses.
+func (c *Controller) syncGateways() error {
+	routes := c.sortedRoutes()
+	statuses, warnings := c.buildGateways(routes)
+
+	for _, w := range warnings {
+		c.recorder.Eventf(w.route.Reference(), event.TypeWarning, reasonRejected, "%s", w.message)
+	}
+
+	return c.updateRouteStatuses(routes, statuses)
+}
+
+// buildGateways replaces the locations of the routes, apart from the
+// rejected ones, and returns their parent statuses by route.
+func (c *Controller) buildGateways(routes []*gateway.HTTPRoute) (map[string][]gateway.RouteParentStatus, []routeWarning) {
+	held := c.teardownGateways()
+	listeners := c.gatewayListeners()
+	c.releaseSecrets(held)
+
+	for name := range listeners {
+		if gw, ok := c.gateways.Get(name); ok {
+			c.gatewayRefs = append(c.gatewayRefs, gatewayRef(gw))
+		}
+	}
+
+	var (
+		entries  []*routeEntry
+		order    int
+		statuses = map[string][]gateway.RouteParentStatus{}
+		warnings []routeWarning
+		exists   = map[string]bool{}
+	)
+
+	for _, route := range routes {
+		var parents []gateway.RouteParentStatus
+
+		exists[route.Name()] = true
+
+		// a rejected route is tried again once it changed
+		rejected, isRejected := c.rejectedRoutes[route.Name()]
+
+		if isRejected && rejected.generation != route.Metadata.Generation {
+			delete(c.rejectedRoutes, route.Name())
+			isRejected = false
+		}
+
+		for _, parent := range route.Spec.ParentRefs {
+			if (parent.Group != "" && parent.Group != gatewayGroup) || (parent.Kind != "" && parent.Kind != "Gateway") {
+				continue
+			}
+
+			ns := parent.Namespace
+
+			if ns == "" {
+				ns = route.Metadata.Namespace
+			}
+
+			gwListeners, ok := listeners[ns+"/"+parent.Name]
+
+			// parents of other controllers are left alone
+			if !ok {
+				continue
+			}
+
+			hosts, accepted := attachRoute(route, parent, gwListeners)
+			resolved := gateway.Condition{Type: gateway.ConditionResolvedRefs, Status: "True", Reason: gateway.ReasonResolvedRefs}
+
+			if len(hosts) > 0 && isRejected {
+				accepted.Status, accepted.Reason, accepted.Message = "False", gateway.ReasonUnsupportedValue, rejected.err
+			} else if len(hosts) > 0 {
+				c.gatewayRefs = append(c.gatewayRefs, routeRef(route))
+
+				es, problems, refReason, refProblems := c.routeEntries(route, hosts, &order)
+				entries = append(entries, es...)
+
+				if len(problems) > 0 {
+					accepted.Message = strings.Join(problems, "; ")
+
+					if len(es) == 0 {
+						accepted.Status, accepted.Reason = "False", gateway.ReasonUnsupportedValue
+					}
+				}
+
+				if len(refProblems) > 0 {
+					resolved.Status, resolved.Reason, resolved.Message = "False", refReason, strings.Join(refProblems, "; ")
+				}
+
+				for _, p := range append(problems, refProblems...) {
+					warnings = append(warnings, routeWarning{route, p})
+				}
+			}
+
+			parent.Namespace = ns
+			parents = append(parents, gateway.RouteParentStatus{
+				ParentRef:      parent,
+				ControllerName: ingress.ControllerName(),
+				Conditions:     []gateway.Condition{accepted, resolved},
+			})
+		}
+
+		if len(parents) > 0 {
+			statuses[route.Name()] = parents
+		}
+	}
+
+	for name := range c.rejectedRoutes {
+		if !exists[name] {
+			delete(c.rejectedRoutes, name)
+		}
+	}
+
+	c.addRouteEntries(entries)
+
+	return statuses, warnings
+}
+
+// updateRouteStatuses writes back the statuses of buildGateways.
+func (c *Controller) updateRouteStatuses(routes []*gateway.HTTPRoute, statuses map[string][]gateway.RouteParentStatus) error {
+	if !c.isLeader() {
+		return nil
+	}
+
+	var errs []string
+
+	for _, route := range routes {
+		if err := c.updateRouteStatus(route, statuses[route.Name()]); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", route.Name(), err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("update route status: %s", strings.Join(errs, ", "))
+	}
+
+	return nil
+}
+
+// addRouteEntries merges the entries of the same host and path into a
+// location, with the routes ordered by precedence.
+func (c *Controller) addRouteEntries(entries []*routeEntry) {
+	type locationKey struct {
+		host string
+		tls  bool
+		path string
+	}
+
+	byLocation := map[locationKey][]*routeEntry{}
+	var keys []locationKey
+
+	for _, e := range entries {
+		// hostless routes are served by the default server, which has no tls
+		key := locationKey{e.host, e.tls != nil && e.host != "", e.path.String()}
+
+		if _, ok := byLocation[key]; !ok {
+			keys = append(keys, key)
+		}
+
+		byLocation[key] = append(byLocation[key], e)
+	}
+
+	for _, key := range keys {
+		es := byLocation[key]
+
+		sort.SliceStable(es, func(i, j int) bool {
+			if es[i].rank != es[j].rank {
+				a, b := es[i].rank, es[j].rank
+
+				for k := range a {
+					if a[k] != b[k] {
+						return a[k] > b[k]
+					}
+				}
+			}
+
+			return es[i].order < es[j].order
+		})
+
+		owners := map[string]struct{}{}
+		var names []string
+
+		loc := &nginx.Location{Path: es[0].path}
+
+		for _, e := range es {
+			loc.Routes = append(loc.Routes, e.route)
+
+			if _, ok := owners[e.owner.Name()]; !ok {
+				owners[e.owner.Name()] = struct{}{}
+				names = append(names, e.owner.Name())
+			}
+		}
+
+		loc.IngressRef = "httproute:" + strings.Join(names, ",")
+
+		if err := c.ngx.AddLocation(key.host, loc, es[0].tls); err != nil {
+			for _, e := range es {
+				c.recorder.Eventf(e.owner.Reference(), event.TypeWarning, reasonRejected, "path %s: %s", key.path, err)
+			}
+
+			log.Printf("controller: %s: path %s: %s, httproutes=%s", reasonRejected, key.path, err, strings.Join(names, ","))
+			continue
+		}
+
+		c.gatewayLocations = append(c.gatewayLocations, hostLocation{host: key.host, ref: loc.IngressRef})
+	}
+}
+
+// sameConditions compares conditions apart from their transition time.
+func sameConditions(a, b []gateway.Condition) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		x, y := a[i], b[i]
+
+		if x.Type != y.Type || x.Status != y.Status || x.Reason != y.Reason || x.Message != y.Message || x.ObservedGeneration != y.ObservedGeneration {
+			return false
+		}
+	}
+
+	return true
+}
+
+// updateRouteStatus writes the parent statuses of this controller into a
+// route, keeping those of other controllers.
+func (c *Controller) updateRouteStatus(route *gateway.HTTPRoute, ours []gateway.RouteParentStatus) error {
+	var (
+		parents []gateway.RouteParentStatus
+		current []gateway.RouteParentStatus
+	)
+
+	for _, p := range route.Status.Parents {
+		if p.ControllerName == ingress.ControllerName() {
+			current = append(current, p)
+		} else {
+			parents = append(parents, p)
+		}
+	}
+
+	now := time.Now().UTC().Truncate(time.Second)
+	changed := len(current) != len(ours)
+
+	for i := range ours {
+		for j := range ours[i].Conditions {
+			cond := &ours[i].Conditions[j]
+			cond.ObservedGeneration = route.Metadata.Generation
+			cond.LastTransitionTime = now
+
+			// the transition time is kept while the status stays the same
+			for _, p := range current {
+				if p.ParentRef != ours[i].ParentRef {
+					continue
+				}
+
+				for _, prev := range p.Conditions {
+					if prev.Type == cond.Type && prev.Status == cond.Status {
+						cond.LastTransitionTime = prev.LastTransitionTime
+					}
+				}
+			}
+		}
+
+		if i >= len(current) || current[i].ParentRef != ours[i].ParentRef || !sameConditions(current[i].Conditions, ours[i].Conditions) {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": route.Metadata.ResourceVersion,
+		},
+		"status": map[string]interface{}{
+			"parents": append(parents, ours...),
+		},
+	}
+
+	err := kube.Patch(c.kc, gateway.RouteStatusFunc(route.Metadata.Namespace, route.Metadata.Name), patch)
+
+	// the route changed meanwhile, it is synced again with its new version
+	if kube.IsConflict(err) {
+		return nil
+	}
+
+	if err == nil {
+		log.Printf("controller: status of httproute %s updated", route.Name())
+	}
+
+	return err
+}
+
+func (c *Controller) setupGatewayStores() {
+	if !*gatewayAPI {
+		return
+	}
+
+	enqueue := func(kube.Object) {
+		c.queue.Add(workItem{kind: kindGateway})
+	}
+
+	c.gatewayClasses = &kube.Store[*gateway.GatewayClass]{
+		Client:    c.kc,
+		ListFunc:  kube.ClusterScoped(gateway.ClassListFunc),
+		WatchFunc: kube.ClusterScoped(gateway.ClassWatchFunc),
+		OnChange:  func(o *gateway.GatewayClass) { enqueue(o) },
+	}
+
+	c.gateways = &kube.Store[*gateway.Gateway]{
+		Client:     c.kc,
+		Namespaces: namespaces(),
+		ListFunc:   gateway.ListFunc,
+		WatchFunc:  gateway.WatchFunc,
+		OnChange:   func(o *gateway.Gateway) { enqueue(o) },
+	}
+
+	c.httpRoutes = &kube.Store[*gateway.HTTPRoute]{
+		Client:     c.kc,
+		Namespaces: namespaces(),
+		ListFunc:   gateway.RouteListFunc,
+		WatchFunc:  gateway.RouteWatchFunc,
+		OnChange:   func(o *gateway.HTTPRoute) { enqueue(o) },
+	}
+
+	c.gatewayClasses.Init()
+	c.gateways.Init()
+	c.httpRoutes.Init()
+}
+
+// rejectGateways finds the routes whose config nginx refused by adding
+// them back one by one, like Run does with ingresses. Only the offending
+// routes are held back, with Accepted=False, so the others keep being
+// served.
+func (c *Controller) rejectGateways(err error) {
+	routes := c.sortedRoutes()
+
+	for _, route := range routes {
+		c.rejectedRoutes[route.Name()] = rejectedRoute{generation: route.Metadata.Generation, err: err.Error()}
+	}
+
+	statuses, _ := c.buildGateways(routes)
+
+	var cfgErr *nginx.ConfigError
+
+	// the listeners are refused without any route, e.g. for a certificate,
+	// they are not retried until a Gateway or route changes
+	if _, buildErr := c.buildAndReload(false); errors.As(buildErr, &cfgErr) {
+		log.Printf("controller: %s: %s, gateways", reasonRejected, cfgErr)
+		c.releaseSecrets(c.teardownGateways())
+
+		for _, route := range routes {
+			delete(c.rejectedRoutes, route.Name())
+		}
+
+		routes = nil
+	}
+
+	for _, route := range routes {
+		delete(c.rejectedRoutes, route.Name())
+		statuses, _ = c.buildGateways(routes)
+
+		if _, buildErr := c.buildAndReload(false); !errors.As(buildErr, &cfgErr) {
+			continue
+		}
+
+		log.Printf("controller: %s: %s, httproute=%s", reasonRejected, cfgErr, route.Name())
+		c.recorder.Eventf(route.Reference(), event.TypeWarning, reasonRejected, "%s", cfgErr)
+
+		c.rejectedRoutes[route.Name()] = rejectedRoute{generation: route.Metadata.Generation, err: cfgErr.Error()}
+		statuses, _ = c.buildGateways(routes)
+	}
+
+	if err := c.updateRouteStatuses(c.sortedRoutes(), statuses); err != nil {
+		log.Printf("controller: %s, gateways", err)
+	}
+}
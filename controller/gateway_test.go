@@ -0,0 +1,595 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"ingress-controller/kube"
+	"ingress-controller/kube/gateway"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/nginx"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRouteMatch(t *testing.T) {
+	tests := []struct {
+		name  string
+		match string
+		valid bool
+	}{
+		{"empty", `{}`, true},
+		{"prefix", `{"path":{"type":"PathPrefix","value":"/api"}}`, true},
+		{"regex path", `{"path":{"type":"RegularExpression","value":"/v[0-9]+/.*"}}`, true},
+		{"invalid regex path", `{"path":{"type":"RegularExpression","value":"/(a"}}`, false},
+		{"exact header", `{"headers":[{"type":"Exact","name":"X-Version","value":"2"}]}`, true},
+		{"exact header with variable", `{"headers":[{"type":"Exact","name":"X-Version","value":"$host"}]}`, false},
+		{"regex header", `{"headers":[{"type":"RegularExpression","name":"X-Version","value":"^v[12]$"}]}`, true},
+		{"invalid regex header", `{"headers":[{"type":"RegularExpression","name":"X-Version","value":"("}]}`, false},
+		{"invalid regex query", `{"queryParams":[{"type":"RegularExpression","name":"v","value":"[a-"}]}`, false},
+		{"quote in header", `{"headers":[{"type":"Exact","name":"X-Version","value":"\""}]}`, false},
+		{"method", `{"method":"GET"}`, true},
+		{"unknown method", `{"method":"FETCH"}`, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m gateway.HTTPRouteMatch
+
+			if err := json.Unmarshal([]byte(tt.match), &m); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, _, err := routeMatch(m); (err == nil) != tt.valid {
+				t.Errorf("routeMatch(%s) = %v, want valid=%v", tt.match, err, tt.valid)
+			}
+		})
+	}
+}
+
+// fromJSON decodes the test object v from s, the Gateway API types have
+// anonymous structs that are easier written as JSON.
+func fromJSON(t *testing.T, s string, v interface{}) {
+	t.Helper()
+
+	if err := json.Unmarshal([]byte(s), v); err != nil {
+		t.Fatalf("%s: %s", s, err)
+	}
+}
+
+// newGatewayController returns a controller with the Gateway API stores and
+// the Services synced from lists, a resource without a list has no objects.
+func newGatewayController(t *testing.T, lists map[string][]interface{}) (*Controller, *fakeSecretClient) {
+	defer func(enabled bool) { *gatewayAPI = enabled }(*gatewayAPI)
+	*gatewayAPI = true
+
+	class := &gateway.GatewayClass{Metadata: &kube.Metadata{Name: "nginx"}}
+	class.Spec.ControllerName = ingress.ControllerName()
+	lists["/apis/gateway.networking.k8s.io/v1/gatewayclasses"] = []interface{}{class}
+
+	for _, path := range []string{
+		"/apis/gateway.networking.k8s.io/v1/gateways",
+		"/apis/gateway.networking.k8s.io/v1/httproutes",
+		"/api/v1/services",
+		"/apis/discovery.k8s.io/v1/endpointslices",
+	} {
+		if _, ok := lists[path]; !ok {
+			lists[path] = nil
+		}
+	}
+
+	client := &fakeSecretClient{lists: lists}
+	c := newController(nginx.New(&nginx.Main{}, &nginx.Http{HttpSettings: nginx.HttpSettings{Listen: 80, TLSListen: 443}}), client)
+	c.setupSecretInformer()
+
+	for _, store := range []interface{ Sync() error }{c.gatewayClasses, c.gateways, c.httpRoutes, c.services, c.endpointSlices} {
+		if err := store.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return c, client
+}
+
+func TestIntersectHostname(t *testing.T) {
+	tests := []struct {
+		listener, route string
+		want            string
+		ok              bool
+	}{
+		{"", "", "", true},
+		{"", "example.com", "example.com", true},
+		{"example.com", "", "example.com", true},
+		{"example.com", "example.com", "example.com", true},
+		{"example.com", "example.org", "", false},
+		{"*.example.com", "a.example.com", "a.example.com", true},
+		{"*.example.com", "a.b.example.com", "a.b.example.com", true},
+		{"*.example.com", "example.com", "", false},
+		{"*.example.com", "aexample.com", "", false},
+		{"a.example.com", "*.example.com", "a.example.com", true},
+		{"example.com", "*.example.com", "", false},
+		{"*.example.com", "*.example.com", "*.example.com", true},
+	}
+
+	for _, tt := range tests {
+		if got, ok := intersectHostname(tt.listener, tt.route); got != tt.want || ok != tt.ok {
+			t.Errorf("intersectHostname(%q, %q) = %q, %v, want %q, %v", tt.listener, tt.route, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestAttachRoute(t *testing.T) {
+	var gw gateway.Gateway
+
+	fromJSON(t, `{
+		"metadata": {"namespace": "infra", "name": "public"},
+		"spec": {"listeners": [
+			{"name": "http", "port": 80, "protocol": "HTTP", "hostname": "*.example.com", "allowedRoutes": {"namespaces": {"from": "All"}}},
+			{"name": "https", "port": 443, "protocol": "HTTPS", "hostname": "secure.example.com", "allowedRoutes": {"namespaces": {"from": "All"}}},
+			{"name": "infra", "port": 80, "protocol": "HTTP"}
+		]}
+	}`, &gw)
+
+	var listeners []*gatewayListener
+
+	for i := range gw.Spec.Listeners {
+		gl := &gatewayListener{gateway: &gw, listener: &gw.Spec.Listeners[i]}
+
+		if gl.listener.Port == 443 {
+			gl.tls = &nginx.TLSConf{Cert: "tls/crt", Key: "tls/key"}
+		}
+
+		listeners = append(listeners, gl)
+	}
+
+	tests := []struct {
+		name      string
+		namespace string
+		hostnames []string
+		parent    string
+		hosts     []string
+		reason    string
+	}{
+		{
+			name:      "all listeners",
+			namespace: "default",
+			hostnames: []string{"a.example.com", "secure.example.com"},
+			parent:    `{"name": "public"}`,
+			hosts:     []string{"a.example.com", "secure.example.com", "secure.example.com tls"},
+			reason:    gateway.ReasonAccepted,
+		},
+		{
+			name:      "section name",
+			namespace: "default",
+			hostnames: []string{"a.example.com", "secure.example.com"},
+			parent:    `{"name": "public", "sectionName": "https"}`,
+			hosts:     []string{"secure.example.com tls"},
+			reason:    gateway.ReasonAccepted,
+		},
+		{
+			name:      "port",
+			namespace: "default",
+			parent:    `{"name": "public", "port": 443}`,
+			hosts:     []string{"secure.example.com tls"},
+			reason:    gateway.ReasonAccepted,
+		},
+		{
+			name:      "unknown section name",
+			namespace: "default",
+			parent:    `{"name": "public", "sectionName": "grpc"}`,
+			reason:    gateway.ReasonNoMatchingParent,
+		},
+		{
+			name:      "section name and other port",
+			namespace: "default",
+			parent:    `{"name": "public", "sectionName": "https", "port": 80}`,
+			reason:    gateway.ReasonNoMatchingParent,
+		},
+		{
+			name:      "routes of the same namespace only",
+			namespace: "default",
+			parent:    `{"name": "public", "sectionName": "infra"}`,
+			reason:    gateway.ReasonNotAllowedByListeners,
+		},
+		{
+			name:      "route of the same namespace",
+			namespace: "infra",
+			parent:    `{"name": "public", "sectionName": "infra"}`,
+			hosts:     []string{""},
+			reason:    gateway.ReasonAccepted,
+		},
+		{
+			name:      "no matching hostname",
+			namespace: "default",
+			hostnames: []string{"example.org"},
+			parent:    `{"name": "public"}`,
+			reason:    gateway.ReasonNoMatchingHostname,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			route := &gateway.HTTPRoute{Metadata: &kube.Metadata{Namespace: tt.namespace, Name: "web"}}
+			route.Spec.Hostnames = tt.hostnames
+
+			var parent gateway.ParentReference
+			fromJSON(t, tt.parent, &parent)
+
+			hosts, cond := attachRoute(route, parent, listeners)
+
+			var got []string
+
+			for _, h := range hosts {
+				if h.tls != nil {
+					got = append(got, h.host+" tls")
+				} else {
+					got = append(got, h.host)
+				}
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.hosts, ",") || cond.Reason != tt.reason {
+				t.Errorf("got hosts %v, %s, want %v, %s", got, cond.Reason, tt.hosts, tt.reason)
+			}
+
+			if want := map[bool]string{true: "True", false: "False"}[tt.reason == gateway.ReasonAccepted]; cond.Status != want {
+				t.Errorf("Accepted=%s, want %s", cond.Status, want)
+			}
+		})
+	}
+}
+
+func TestRouteBackends(t *testing.T) {
+	tests := []struct {
+		name        string
+		backendRefs string
+		// split are the targets of the split, or the upstream proxied to
+		split  []string
+		code   int
+		reason string
+	}{
+		{
+			name:        "single",
+			backendRefs: `[{"name": "web", "port": 80}]`,
+			split:       []string{"default_web_80"},
+		},
+		{
+			name:        "equal weights",
+			backendRefs: `[{"name": "web", "port": 80}, {"name": "api", "port": 80}]`,
+			split:       []string{`50.00% "default_web_80";`, `* "default_api_80";`},
+		},
+		{
+			name:        "weights",
+			backendRefs: `[{"name": "web", "port": 80, "weight": 1}, {"name": "api", "port": 80, "weight": 2}, {"name": "admin", "port": 80, "weight": 1}]`,
+			split:       []string{`25.00% "default_web_80";`, `50.00% "default_api_80";`, `* "default_admin_80";`},
+		},
+		{
+			name:        "thirds",
+			backendRefs: `[{"name": "web", "port": 80}, {"name": "api", "port": 80}, {"name": "admin", "port": 80}]`,
+			split:       []string{`33.33% "default_web_80";`, `33.33% "default_api_80";`, `* "default_admin_80";`},
+		},
+		{
+			name:        "zero weight",
+			backendRefs: `[{"name": "web", "port": 80, "weight": 0}, {"name": "api", "port": 80}]`,
+			split:       []string{"default_api_80"},
+		},
+		{
+			name:        "missing service",
+			backendRefs: `[{"name": "missing", "port": 80}]`,
+			code:        500,
+			reason:      gateway.ReasonBackendNotFound,
+		},
+		{
+			name:        "missing port",
+			backendRefs: `[{"name": "web", "port": 8080}, {"name": "api", "port": 80}]`,
+			split:       []string{"default_api_80"},
+			reason:      gateway.ReasonBackendNotFound,
+		},
+		{
+			name:        "service of another namespace",
+			backendRefs: `[{"name": "web", "namespace": "other", "port": 80}, {"name": "api", "port": 80}]`,
+			split:       []string{"default_api_80"},
+			reason:      gateway.ReasonRefNotPermitted,
+		},
+		{
+			name:        "unsupported kind",
+			backendRefs: `[{"kind": "Pod", "name": "web", "port": 80}]`,
+			code:        500,
+			reason:      gateway.ReasonInvalidKind,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubNginx(t, "")
+
+			c, _ := newGatewayController(t, newTestServices("web", "api", "admin"))
+			route := &gateway.HTTPRoute{Metadata: &kube.Metadata{Namespace: "default", Name: "web"}}
+
+			var rule gateway.HTTPRouteRule
+			fromJSON(t, `{"backendRefs": `+tt.backendRefs+`}`, &rule)
+
+			action, reason, problems := c.routeBackends(route, &rule)
+
+			if reason != tt.reason || (reason == "") != (len(problems) == 0) {
+				t.Errorf("got reason %q, problems %v, want %q", reason, problems, tt.reason)
+			}
+
+			switch {
+			case tt.code != 0:
+				if action.Return == nil || action.Return.Code != tt.code {
+					t.Errorf("got %+v, want return %d", action, tt.code)
+				}
+			case len(tt.split) == 1:
+				if action.ProxyPass == nil || action.ProxyPass.UpstreamName != tt.split[0] {
+					t.Errorf("got %+v, want proxy_pass to %s", action.ProxyPass, tt.split[0])
+				}
+			default:
+				if action.ProxyPass == nil || action.ProxyPass.Upstream != "http://$route_split_0" {
+					t.Fatalf("got %+v, want proxy_pass to the split", action.ProxyPass)
+				}
+
+				conf := renderHttp(t, c)
+				start := strings.Index(conf, `split_clients "${request_id}" $route_split_0 {`)
+
+				if start < 0 {
+					t.Fatalf("http.conf has no split:\n%s", conf)
+				}
+
+				lines := strings.Split(conf[start:start+strings.Index(conf[start:], "\n}")], "\n")
+
+				var got []string
+
+				for _, line := range lines[1:] {
+					got = append(got, strings.TrimSpace(line))
+				}
+
+				if strings.Join(got, "\n") != strings.Join(tt.split, "\n") {
+					t.Errorf("got split %q, want %q", got, tt.split)
+				}
+			}
+		})
+	}
+}
+
+func TestRouteHeaders(t *testing.T) {
+	tests := []struct {
+		name     string
+		modifier string
+		want     []nginx.Header
+		err      bool
+	}{
+		{
+			name:     "set, add and remove",
+			modifier: `{"set": [{"name": "X-Env", "value": "prod"}], "add": [{"name": "X-Tag", "value": "a"}, {"name": "X-Tag", "value": "b"}], "remove": ["X-Debug"]}`,
+			want: []nginx.Header{
+				{Name: "X-Env", Value: "prod"},
+				{Name: "X-Tag", Value: "a", Append: true},
+				{Name: "X-Tag", Value: "b", Append: true},
+				{Name: "X-Debug"},
+			},
+		},
+		{
+			name:     "remove only",
+			modifier: `{"remove": ["X-Debug", "Cookie"]}`,
+			want:     []nginx.Header{{Name: "X-Debug"}, {Name: "Cookie"}},
+		},
+		{
+			name:     "invalid name",
+			modifier: `{"add": [{"name": "X Tag", "value": "a"}]}`,
+			err:      true,
+		},
+		{
+			name:     "invalid removed name",
+			modifier: `{"remove": ["X-Debug;"]}`,
+			err:      true,
+		},
+		{
+			name:     "variable",
+			modifier: `{"set": [{"name": "X-Host", "value": "$host"}]}`,
+			err:      true,
+		},
+		{
+			name:     "quote",
+			modifier: `{"set": [{"name": "X-Env", "value": "\""}]}`,
+			err:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f gateway.HTTPRouteFilter
+			fromJSON(t, `{"type": "RequestHeaderModifier", "requestHeaderModifier": `+tt.modifier+`}`, &f)
+
+			headers, err := routeHeaders(&f)
+
+			if (err != nil) != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			if !reflect.DeepEqual(headers, tt.want) {
+				t.Errorf("got %+v, want %+v", headers, tt.want)
+			}
+		})
+	}
+
+	if _, err := routeHeaders(&gateway.HTTPRouteFilter{Type: gateway.FilterRequestHeaderModifier}); err == nil {
+		t.Error("a filter without requestHeaderModifier was accepted")
+	}
+}
+
+func TestUpdateRouteStatus(t *testing.T) {
+	since := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	parent := gateway.ParentReference{Namespace: "infra", Name: "public"}
+
+	status := func(controller, accepted, message string) gateway.RouteParentStatus {
+		return gateway.RouteParentStatus{
+			ParentRef:      parent,
+			ControllerName: controller,
+			Conditions: []gateway.Condition{
+				{Type: gateway.ConditionAccepted, Status: accepted, Reason: gateway.ReasonAccepted, Message: message, ObservedGeneration: 1, LastTransitionTime: since},
+				{Type: gateway.ConditionResolvedRefs, Status: "True", Reason: gateway.ReasonResolvedRefs, ObservedGeneration: 1, LastTransitionTime: since},
+			},
+		}
+	}
+
+	tests := []struct {
+		name     string
+		accepted string
+		message  string
+		// patched is whether a patch is sent, accepted keeps its
+		// transition time when kept
+		patched, kept bool
+	}{
+		{name: "unchanged", accepted: "True", message: "Route is accepted"},
+		{name: "new message", accepted: "True", message: "rule 1: unsupported filter", patched: true, kept: true},
+		{name: "new status", accepted: "False", message: "Route is accepted", patched: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client := newGatewayController(t, map[string][]interface{}{})
+
+			route := &gateway.HTTPRoute{Metadata: &kube.Metadata{Namespace: "default", Name: "web", Generation: 1}}
+			route.Status.Parents = []gateway.RouteParentStatus{
+				status("example.com/other", "True", "Accepted by other"),
+				status(ingress.ControllerName(), "True", "Route is accepted"),
+			}
+
+			ours := status(ingress.ControllerName(), tt.accepted, tt.message)
+
+			// the conditions are built without transition times
+			for i := range ours.Conditions {
+				ours.Conditions[i].LastTransitionTime = time.Time{}
+			}
+
+			if err := c.updateRouteStatus(route, []gateway.RouteParentStatus{ours}); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(client.patches) != map[bool]int{true: 1}[tt.patched] {
+				t.Fatalf("got patches %v, want %v", client.patches, tt.patched)
+			}
+
+			if !tt.patched {
+				return
+			}
+
+			var patch struct {
+				Status struct {
+					Parents []gateway.RouteParentStatus `json:"parents"`
+				} `json:"status"`
+			}
+
+			fromJSON(t, client.patches[0], &patch)
+			parents := patch.Status.Parents
+
+			if len(parents) != 2 || parents[0].ControllerName != "example.com/other" || parents[1].ControllerName != ingress.ControllerName() {
+				t.Fatalf("got parents %+v, want the other controller's and ours", parents)
+			}
+
+			accepted, resolved := parents[1].Conditions[0], parents[1].Conditions[1]
+
+			if accepted.Status != tt.accepted || accepted.Message != tt.message {
+				t.Errorf("got Accepted=%s %q, want %s %q", accepted.Status, accepted.Message, tt.accepted, tt.message)
+			}
+
+			if accepted.LastTransitionTime.Equal(since) != tt.kept {
+				t.Errorf("Accepted changed at %s, want kept=%v", accepted.LastTransitionTime, tt.kept)
+			}
+
+			if !resolved.LastTransitionTime.Equal(since) {
+				t.Errorf("ResolvedRefs changed at %s, want %s", resolved.LastTransitionTime, since)
+			}
+		})
+	}
+}
+
+func TestRejectGateways(t *testing.T) {
+	if os.Getenv("NO_NGINX") == "1" {
+		t.Skip("configs are not tested with NO_NGINX=1")
+	}
+
+	tests := []struct {
+		name     string
+		paths    []string
+		rejected []string
+	}{
+		{name: "one route", paths: []string{"/a", "/refused-b", "/c"}, rejected: []string{"default/b"}},
+		{name: "two routes", paths: []string{"/refused-a", "/b", "/refused-c"}, rejected: []string{"default/a", "default/c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stubNginx(t, "/refused")
+
+			var gw gateway.Gateway
+
+			fromJSON(t, `{
+				"metadata": {"namespace": "infra", "name": "public"},
+				"spec": {"gatewayClassName": "nginx", "listeners": [{"name": "http", "port": 80, "protocol": "HTTP", "allowedRoutes": {"namespaces": {"from": "All"}}}]}
+			}`, &gw)
+
+			lists := newTestServices("web")
+			lists["/apis/gateway.networking.k8s.io/v1/gateways"] = []interface{}{&gw}
+
+			for i, path := range tt.paths {
+				route := new(gateway.HTTPRoute)
+
+				fromJSON(t, `{
+					"spec": {
+						"parentRefs": [{"namespace": "infra", "name": "public"}],
+						"rules": [{"matches": [{"path": {"value": "`+path+`"}}], "backendRefs": [{"name": "web", "port": 80}]}]
+					}
+				}`, route)
+
+				route.Metadata = &kube.Metadata{
+					Namespace:         "default",
+					Name:              string(rune('a' + i)),
+					Generation:        1,
+					CreationTimestamp: time.Date(2024, 1, 1, 0, i, 0, 0, time.UTC),
+				}
+
+				lists["/apis/gateway.networking.k8s.io/v1/httproutes"] = append(lists["/apis/gateway.networking.k8s.io/v1/httproutes"], route)
+			}
+
+			c, _ := newGatewayController(t, lists)
+
+			if err := c.syncGateways(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := c.buildAndReload(false)
+
+			var cfgErr *nginx.ConfigError
+
+			if !errors.As(err, &cfgErr) {
+				t.Fatalf("got %v, want the config refused", err)
+			}
+
+			c.rejectGateways(err)
+
+			var rejected []string
+
+			for name := range c.rejectedRoutes {
+				rejected = append(rejected, name)
+			}
+
+			sort.Strings(rejected)
+
+			if strings.Join(rejected, ",") != strings.Join(tt.rejected, ",") {
+				t.Errorf("rejected %v, want %v", rejected, tt.rejected)
+			}
+
+			conf := renderHttp(t, c)
+
+			for _, path := range tt.paths {
+				if served := strings.Contains(conf, `location "`+path+`"`); served == strings.HasPrefix(path, "/refused") {
+					t.Errorf("path %s served=%v", path, served)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package controller
+
+import (
+	"ingress-controller/metrics"
+)
+
+var rejections = metrics.NewCounter(
+	"ingress_rejections_total",
+	"Ingresses or parts of them that were not applied, by ingress and reason.",
+	"ingress", "reason",
+)
+
+// countRejection counts a warning that drops an ingress or a part of it, the
+// other warnings only degrade it.
+func countRejection(name, reason string) {
+	if reason == reasonRejected || reason == reasonInvalidAnnotation {
+		rejections.Inc(name, reason)
+	}
+}
+
+// forgetRejections removes the rejection counts of an ingress that is no
+// longer handled, the series of deleted ingresses would pile up otherwise.
+func forgetRejections(name string) {
+	for _, reason := range []string{reasonRejected, reasonInvalidAnnotation} {
+		rejections.Delete(name, reason)
+	}
+}
+
+// gauges is a snapshot of the size of the applied config.
+type gauges struct {
+	ingresses  int
+	servers    int
+	locations  int
+	secretRefs map[string]int
+}
+
+// snapshotGauges records the gauges of the applied config, it is called with
+// mu held once a sync is done so that scrapes never wait for the worker.
+func (c *Controller) snapshotGauges() {
+	g := &gauges{ingresses: len(c.issCache), secretRefs: c.secretInformer.Refs()}
+	g.servers, g.locations = c.ngx.Counts()
+	c.gauges.Store(g)
+}
+
+// collect returns a metrics collector reading the last snapshot of the
+// gauges. There are no samples until the initial build is done.
+func (c *Controller) collect(f func(g *gauges) []metrics.Sample) func() []metrics.Sample {
+	return func() []metrics.Sample {
+		if g, ok := c.gauges.Load().(*gauges); ok {
+			return f(g)
+		}
+
+		return nil
+	}
+}
+
+// registerMetrics exposes the size of the applied config, there is a single
+// Controller per process.
+func (c *Controller) registerMetrics() {
+	metrics.NewGaugeFunc("ingresses", "Ingresses applied to the config.", c.collect(func(g *gauges) []metrics.Sample {
+		return []metrics.Sample{{Value: float64(g.ingresses)}}
+	}))
+
+	metrics.NewGaugeFunc("servers", "Servers of http.conf.", c.collect(func(g *gauges) []metrics.Sample {
+		return []metrics.Sample{{Value: float64(g.servers)}}
+	}))
+
+	metrics.NewGaugeFunc("locations", "Locations of http.conf.", c.collect(func(g *gauges) []metrics.Sample {
+		return []metrics.Sample{{Value: float64(g.locations)}}
+	}))
+
+	metrics.NewGaugeFunc("secret_references", "References to the secrets cached by the secret informer, by secret.", c.collect(func(g *gauges) []metrics.Sample {
+		var samples []metrics.Sample
+
+		for fullname, refs := range g.secretRefs {
+			samples = append(samples, metrics.Sample{LabelValues: []string{fullname}, Value: float64(refs)})
+		}
+
+		return samples
+	}), "secret")
+}
@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	queueBaseDelay = time.Second
+	queueMaxDelay  = time.Minute * 5
+)
+
+// queue is a deduplicating work queue. A key added while it is already
+// waiting is only processed once, and a key added while it is being
+// processed is queued again after Done. Failed keys are requeued with
+// exponential backoff through AddRateLimited.
+type queue[K comparable] struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	items      []K
+	dirty      map[K]struct{}
+	processing map[K]struct{}
+	failures   map[K]int
+	shutdown   bool
+	baseDelay  time.Duration
+	maxDelay   time.Duration
+}
+
+func newQueue[K comparable]() *queue[K] {
+	q := &queue[K]{
+		dirty:      map[K]struct{}{},
+		processing: map[K]struct{}{},
+		failures:   map[K]int{},
+		baseDelay:  queueBaseDelay,
+		maxDelay:   queueMaxDelay,
+	}
+
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+func (q *queue[K]) Add(key K) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.shutdown {
+		return
+	}
+
+	if _, ok := q.dirty[key]; ok {
+		return
+	}
+
+	q.dirty[key] = struct{}{}
+
+	if _, ok := q.processing[key]; ok {
+		return
+	}
+
+	q.items = append(q.items, key)
+	q.cond.Signal()
+}
+
+// AddRateLimited adds key after a delay that doubles with every failure
+// since the last Forget.
+func (q *queue[K]) AddRateLimited(key K) {
+	time.AfterFunc(q.when(key), func() {
+		q.Add(key)
+	})
+}
+
+// when records a failure of key and returns the delay before it is retried.
+func (q *queue[K]) when(key K) time.Duration {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	failures := q.failures[key]
+	q.failures[key] = failures + 1
+
+	delay := q.baseDelay
+
+	for i := 0; i < failures && delay < q.maxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > q.maxDelay {
+		delay = q.maxDelay
+	}
+
+	return delay
+}
+
+// Forget resets the backoff of key.
+func (q *queue[K]) Forget(key K) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.failures, key)
+}
+
+// Get blocks until a key is available, ok is false once the queue is shut
+// down. Every key returned must be passed to Done.
+func (q *queue[K]) Get() (key K, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for len(q.items) == 0 && !q.shutdown {
+		q.cond.Wait()
+	}
+
+	if len(q.items) == 0 {
+		return
+	}
+
+	key, q.items = q.items[0], q.items[1:]
+
+	q.processing[key] = struct{}{}
+	delete(q.dirty, key)
+
+	return key, true
+}
+
+func (q *queue[K]) Done(key K) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.processing, key)
+
+	if _, ok := q.dirty[key]; ok {
+		q.items = append(q.items, key)
+		q.cond.Signal()
+	}
+}
+
+func (q *queue[K]) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.items)
+}
+
+func (q *queue[K]) ShutDown() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.shutdown = true
+	q.cond.Broadcast()
+}
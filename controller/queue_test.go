@@ -0,0 +1,192 @@
+package controller
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// drain returns the keys waiting in q without blocking.
+func drain(q *queue[string]) []string {
+	var keys []string
+
+	for q.Len() > 0 {
+		key, _ := q.Get()
+		keys = append(keys, key)
+		q.Done(key)
+	}
+
+	return keys
+}
+
+func equalKeys(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func TestQueueDedup(t *testing.T) {
+	tests := []struct {
+		name string
+		adds []string
+		want []string
+	}{
+		{"single", []string{"a"}, []string{"a"}},
+		{"duplicates", []string{"a", "a", "a"}, []string{"a"}},
+		{"order", []string{"b", "a", "b", "c", "a"}, []string{"b", "a", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueue[string]()
+
+			for _, key := range tt.adds {
+				q.Add(key)
+			}
+
+			if got := drain(q); !equalKeys(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQueueDone(t *testing.T) {
+	tests := []struct {
+		name string
+		// adds are added between Get and Done of "a"
+		adds []string
+		// waiting are the keys handed out before Done of "a"
+		waiting []string
+		// requeued are the keys handed out after Done of "a"
+		requeued []string
+	}{
+		{"clean", nil, nil, nil},
+		{"dirty", []string{"a"}, nil, []string{"a"}},
+		{"dirty twice", []string{"a", "a"}, nil, []string{"a"}},
+		{"other key", []string{"b"}, []string{"b"}, nil},
+		{"dirty and other key", []string{"a", "b"}, []string{"b"}, []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueue[string]()
+			q.Add("a")
+
+			if key, ok := q.Get(); !ok || key != "a" {
+				t.Fatalf("Get() = %q, %v", key, ok)
+			}
+
+			for _, key := range tt.adds {
+				q.Add(key)
+			}
+
+			if got := drain(q); !equalKeys(got, tt.waiting) {
+				t.Errorf("before Done: got %v, want %v", got, tt.waiting)
+			}
+
+			q.Done("a")
+
+			if got := drain(q); !equalKeys(got, tt.requeued) {
+				t.Errorf("after Done: got %v, want %v", got, tt.requeued)
+			}
+		})
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		forget   bool
+		want     time.Duration
+	}{
+		{"first", 0, false, time.Second},
+		{"second", 1, false, time.Second * 2},
+		{"fifth", 4, false, time.Second * 16},
+		{"capped", 9, false, time.Minute * 5},
+		{"overflow", 100, false, time.Minute * 5},
+		{"forget", 4, true, time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQueue[string]()
+
+			for i := 0; i < tt.failures; i++ {
+				q.when("a")
+			}
+
+			if tt.forget {
+				q.Forget("a")
+			}
+
+			if got := q.when("a"); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+
+			// the backoff of other keys is independent
+			if got := q.when("b"); got != time.Second {
+				t.Errorf("other key: got %s, want %s", got, time.Second)
+			}
+		})
+	}
+}
+
+func TestQueueAddRateLimited(t *testing.T) {
+	q := newQueue[string]()
+	q.baseDelay = time.Millisecond
+	q.maxDelay = time.Millisecond * 10
+
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 3; i++ {
+			key, ok := q.Get()
+
+			if !ok || key != "a" {
+				t.Errorf("Get() = %q, %v", key, ok)
+				return
+			}
+
+			q.Done(key)
+
+			if i < 2 {
+				q.AddRateLimited(key)
+			}
+		}
+	}()
+
+	q.AddRateLimited("a")
+
+	done := make(chan struct{})
+
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("rate limited key was not added again")
+	}
+
+	q.ShutDown()
+
+	if _, ok := q.Get(); ok {
+		t.Error("Get() returned a key after ShutDown")
+	}
+}
@@ -0,0 +1,287 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"ingress-controller/kube"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/kube/node"
+	"ingress-controller/kube/service"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	updateStatus         = flag.Bool("update-status", true, "publish the load balancer address in the status of handled ingresses")
+	publishService       = flag.String("publish-service", "", "namespace/name of the Service whose address is published")
+	publishStatusAddress = flag.String("publish-status-address", "", "comma separated addresses to publish, overrides -publish-service")
+)
+
+const statusResyncPeriod = time.Minute
+
+// statusUpdater publishes the load balancer address in the status of the
+// ingresses handled by the controller, and clears it from the ingresses the
+// controller stops handling. A nil *statusUpdater does nothing.
+type statusUpdater struct {
+	kc        kube.Client
+	ingresses *kube.Store[*ingress.Ingress]
+	services  *kube.Store[*service.Service]
+	queue     *queue[string]
+	mu        sync.Mutex
+	owned     map[string]bool
+	nodeAddr  string
+	isLeader  func() bool
+}
+
+func newStatusUpdater(
+	kc kube.Client,
+	ingresses *kube.Store[*ingress.Ingress],
+	services *kube.Store[*service.Service],
+	isLeader func() bool,
+) *statusUpdater {
+	if !*updateStatus {
+		return nil
+	}
+
+	return &statusUpdater{
+		kc:        kc,
+		ingresses: ingresses,
+		services:  services,
+		queue:     newQueue[string](),
+		owned:     map[string]bool{},
+		isLeader:  isLeader,
+	}
+}
+
+// Resync queues every handled ingress.
+func (u *statusUpdater) Resync() {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	for name := range u.owned {
+		u.queue.Add(name)
+	}
+}
+
+// Set records whether the controller handles an ingress. Ingresses that
+// were never handled are left alone.
+func (u *statusUpdater) Set(name string, owned bool) {
+	if u == nil {
+		return
+	}
+
+	u.mu.Lock()
+
+	if _, ok := u.owned[name]; !ok && !owned {
+		u.mu.Unlock()
+		return
+	}
+
+	u.owned[name] = owned
+	u.mu.Unlock()
+
+	u.queue.Add(name)
+}
+
+func toLoadBalancerIngress(addr string) kube.LoadBalancerIngress {
+	if net.ParseIP(addr) != nil {
+		return kube.LoadBalancerIngress{IP: addr}
+	}
+
+	return kube.LoadBalancerIngress{Hostname: addr}
+}
+
+// nodeAddress returns the address of the node the controller runs on, it
+// is named by the NODE_NAME env.
+func (u *statusUpdater) nodeAddress() (string, error) {
+	if u.nodeAddr != "" {
+		return u.nodeAddr, nil
+	}
+
+	nodeName := os.Getenv("NODE_NAME")
+
+	if nodeName == "" {
+		return "", errors.New("NODE_NAME is not set")
+	}
+
+	n := new(node.Node)
+
+	if err := kube.Get(u.kc, node.ReadFunc(nodeName), n); err != nil {
+		return "", err
+	}
+
+	if u.nodeAddr = n.Address(node.AddressExternalIP); u.nodeAddr == "" {
+		u.nodeAddr = n.Address(node.AddressInternalIP)
+	}
+
+	if u.nodeAddr == "" {
+		return "", fmt.Errorf("node %s has no address", nodeName)
+	}
+
+	return u.nodeAddr, nil
+}
+
+// addresses returns the published address from -publish-status-address,
+// the -publish-service Service, or the node.
+func (u *statusUpdater) addresses() ([]kube.LoadBalancerIngress, error) {
+	var lbs []kube.LoadBalancerIngress
+
+	switch {
+	case *publishStatusAddress != "":
+		for _, addr := range strings.Split(*publishStatusAddress, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				lbs = append(lbs, toLoadBalancerIngress(addr))
+			}
+		}
+	case *publishService != "":
+		svc, ok := u.services.Get(*publishService)
+
+		if !ok {
+			return nil, fmt.Errorf("publish service %s not found", *publishService)
+		}
+
+		if lbs = svc.Status.LoadBalancer.Ingress; len(lbs) == 0 {
+			for _, ip := range svc.Spec.ExternalIPs {
+				lbs = append(lbs, kube.LoadBalancerIngress{IP: ip})
+			}
+		}
+	default:
+		addr, err := u.nodeAddress()
+
+		if err != nil {
+			return nil, err
+		}
+
+		lbs = append(lbs, toLoadBalancerIngress(addr))
+	}
+
+	return lbs, nil
+}
+
+func equalLoadBalancers(a, b []kube.LoadBalancerIngress) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (u *statusUpdater) sync(name string) error {
+	u.mu.Lock()
+	owned, ok := u.owned[name]
+	u.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	is, found := u.ingresses.Get(name)
+
+	forget := func() {
+		u.mu.Lock()
+
+		if owned, ok := u.owned[name]; ok && !owned {
+			delete(u.owned, name)
+		}
+
+		u.mu.Unlock()
+	}
+
+	if !found {
+		forget()
+		return nil
+	}
+
+	var lbs []kube.LoadBalancerIngress
+
+	if owned {
+		var err error
+
+		if lbs, err = u.addresses(); err != nil {
+			return err
+		}
+	}
+
+	if !equalLoadBalancers(is.Status.LoadBalancer.Ingress, lbs) {
+		patch := map[string]interface{}{
+			"status": map[string]interface{}{
+				"loadBalancer": map[string]interface{}{
+					"ingress": lbs,
+				},
+			},
+		}
+
+		if err := kube.Patch(u.kc, ingress.StatusFunc(is.Metadata.Namespace, is.Metadata.Name), patch); err != nil {
+			return err
+		}
+
+		log.Printf("controller: status of ingress %s updated, loadBalancer=%v", name, lbs)
+	}
+
+	if !owned {
+		forget()
+	}
+
+	return nil
+}
+
+// Run updates statuses while this replica is the leader until ctx is
+// done, all handled ingresses are checked again every statusResyncPeriod as
+// the published address may change.
+func (u *statusUpdater) Run(ctx context.Context) {
+	if u == nil {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(statusResyncPeriod)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				u.queue.ShutDown()
+				return
+			case <-ticker.C:
+				u.Resync()
+			}
+		}
+	}()
+
+	for {
+		name, ok := u.queue.Get()
+
+		if !ok {
+			return
+		}
+
+		// statuses are written by the leader only, they are all queued again
+		// when this replica becomes the leader
+		if !u.isLeader() {
+			u.queue.Forget(name)
+		} else if err := u.sync(name); err != nil {
+			log.Printf("controller: update status of ingress %s: %s, retrying", name, err)
+			u.queue.AddRateLimited(name)
+		} else {
+			u.queue.Forget(name)
+		}
+
+		u.queue.Done(name)
+	}
+}
@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"ingress-controller/kube"
+	"ingress-controller/kube/configmap"
+	"ingress-controller/kube/service"
+	"ingress-controller/nginx"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	tcpServicesConfigMap = flag.String("tcp-services-configmap", "", `namespace/name of a ConfigMap of TCP services, e.g. "5432": "default/postgres:5432"`)
+	udpServicesConfigMap = flag.String("udp-services-configmap", "", `namespace/name of a ConfigMap of UDP services, e.g. "53": "kube-system/kube-dns:53"`)
+)
+
+const proxyProtocol = "PROXY"
+
+// streamService is a value of the TCP and UDP services ConfigMaps:
+// <namespace/service>:<port>[:PROXY[:PROXY]]. The first PROXY accepts the
+// PROXY protocol from clients, the second sends it to the Service.
+type streamService struct {
+	service             string
+	port                string
+	acceptProxyProtocol bool
+	sendProxyProtocol   bool
+}
+
+func parseStreamService(v string) (*streamService, error) {
+	fields := strings.Split(strings.TrimSpace(v), ":")
+
+	if len(fields) < 2 || len(fields) > 4 {
+		return nil, fmt.Errorf("%q is not <namespace/service>:<port>[:PROXY[:PROXY]]", v)
+	}
+
+	if ns, name, ok := strings.Cut(fields[0], "/"); !ok || ns == "" || name == "" {
+		return nil, fmt.Errorf("%q is not namespace/service", fields[0])
+	}
+
+	if fields[1] == "" {
+		return nil, errors.New("no port")
+	}
+
+	s := &streamService{service: fields[0], port: fields[1]}
+
+	for i, field := range fields[2:] {
+		if field != "" && field != proxyProtocol {
+			return nil, fmt.Errorf("%q is not %s", field, proxyProtocol)
+		}
+
+		if i == 0 {
+			s.acceptProxyProtocol = field == proxyProtocol
+		} else {
+			s.sendProxyProtocol = field == proxyProtocol
+		}
+	}
+
+	return s, nil
+}
+
+func isStreamRef(ref string) bool {
+	return strings.HasPrefix(ref, "tcp:") || strings.HasPrefix(ref, "udp:")
+}
+
+// resolveStreamBackend returns the upstream of a stream server, ref names
+// the server, e.g. tcp:5432.
+func (c *Controller) resolveStreamBackend(ref, protocol string, s *streamService) (string, error) {
+	c.refService(ref, s.service)
+
+	svc, ok := c.services.Get(s.service)
+
+	if !ok {
+		return "", fmt.Errorf("service %s not found", s.service)
+	}
+
+	if svc.Spec.Type == service.TypeExternalName {
+		return "", fmt.Errorf("service %s is an ExternalName service", s.service)
+	}
+
+	var port *service.Port
+
+	if number, err := strconv.Atoi(s.port); err == nil {
+		port = svc.FindProtocolPort(protocol, "", number)
+	} else {
+		port = svc.FindProtocolPort(protocol, s.port, 0)
+	}
+
+	if port == nil {
+		return "", fmt.Errorf("service %s has no %s port %s", s.service, protocol, s.port)
+	}
+
+	return c.acquireBackend(ref, s.service, port, true), nil
+}
+
+// streamServers builds the servers of a TCP or UDP services ConfigMap.
+func (c *Controller) streamServers(cm *configmap.ConfigMap, protocol string) []*nginx.StreamServer {
+	_, settings := c.ngx.Defaults()
+
+	ports := make([]string, 0, len(cm.Data))
+
+	for port := range cm.Data {
+		ports = append(ports, port)
+	}
+
+	sort.Strings(ports)
+
+	var servers []*nginx.StreamServer
+
+	for _, key := range ports {
+		port, err := strconv.Atoi(key)
+
+		if err != nil || port <= 0 || port > 65535 {
+			c.warnConfigMap(cm, reasonInvalidConfig, "%q is not a port", key)
+			continue
+		}
+
+		if protocol == service.ProtocolTCP && (port == settings.Listen || port == settings.TLSListen) {
+			c.warnConfigMap(cm, reasonInvalidConfig, "port %d is used by http", port)
+			continue
+		}
+
+		s, err := parseStreamService(cm.Data[key])
+
+		if err != nil {
+			c.warnConfigMap(cm, reasonInvalidConfig, "port %d: %s", port, err)
+			continue
+		}
+
+		if protocol == service.ProtocolUDP && s.acceptProxyProtocol {
+			c.warnConfigMap(cm, reasonInvalidConfig, "port %d: UDP does not accept the PROXY protocol", port)
+			continue
+		}
+
+		ref := strings.ToLower(protocol) + ":" + key
+		c.streamRefs = append(c.streamRefs, ref)
+
+		upstream, err := c.resolveStreamBackend(ref, protocol, s)
+
+		if err != nil {
+			c.warnConfigMap(cm, reasonServiceMissing, "port %d: %s", port, err)
+			continue
+		}
+
+		servers = append(servers, &nginx.StreamServer{
+			Listen:              port,
+			UDP:                 protocol == service.ProtocolUDP,
+			Upstream:            upstream,
+			AcceptProxyProtocol: s.acceptProxyProtocol,
+			SendProxyProtocol:   s.sendProxyProtocol,
+		})
+	}
+
+	return servers
+}
+
+// syncStream rebuilds the TCP and UDP servers from their ConfigMaps.
+func (c *Controller) syncStream() error {
+	for _, ref := range c.streamRefs {
+		c.releaseBackends(ref)
+	}
+
+	c.streamRefs = nil
+
+	var servers []*nginx.StreamServer
+
+	sources := []struct {
+		store    *kube.Store[*configmap.ConfigMap]
+		name     string
+		protocol string
+	}{
+		{c.tcpServices, *tcpServicesConfigMap, service.ProtocolTCP},
+		{c.udpServices, *udpServicesConfigMap, service.ProtocolUDP},
+	}
+
+	for _, src := range sources {
+		if src.store == nil {
+			continue
+		}
+
+		if cm, ok := src.store.Get(src.name); ok {
+			servers = append(servers, c.streamServers(cm, src.protocol)...)
+		}
+	}
+
+	c.ngx.SetStreamServers(servers)
+	return nil
+}
+
+// rejectStream removes the stream servers after nginx refused them, so the
+// rest of the config keeps being served.
+func (c *Controller) rejectStream(err error) {
+	for _, ref := range c.streamRefs {
+		c.releaseBackends(ref)
+	}
+
+	c.streamRefs = nil
+	c.ngx.SetStreamServers(nil)
+
+	for _, store := range []*kube.Store[*configmap.ConfigMap]{c.tcpServices, c.udpServices} {
+		if store == nil {
+			continue
+		}
+
+		for _, cm := range store.List() {
+			c.warnConfigMap(cm, reasonRejected, "%s", err)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package controller
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"ingress-controller/kube/configmap"
+	"ingress-controller/kube/service"
+	"ingress-controller/nginx"
+	"strings"
+	"testing"
+)
+
+func TestParseStreamService(t *testing.T) {
+	tests := []struct {
+		value string
+		want  streamService
+		err   bool
+	}{
+		{value: "default/postgres:5432", want: streamService{service: "default/postgres", port: "5432"}},
+		{value: " default/postgres:pg ", want: streamService{service: "default/postgres", port: "pg"}},
+		{value: "default/web:80:PROXY", want: streamService{service: "default/web", port: "80", acceptProxyProtocol: true}},
+		{value: "default/web:80::PROXY", want: streamService{service: "default/web", port: "80", sendProxyProtocol: true}},
+		{value: "default/web:80:PROXY:PROXY", want: streamService{service: "default/web", port: "80", acceptProxyProtocol: true, sendProxyProtocol: true}},
+		{value: "default/web", err: true},
+		{value: "default/web:", err: true},
+		{value: "web:80", err: true},
+		{value: "/web:80", err: true},
+		{value: "default/:80", err: true},
+		{value: "default/web:80:proxy", err: true},
+		{value: "default/web:80:PROXY:PROXY:PROXY", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			s, err := parseStreamService(tt.value)
+
+			if tt.err {
+				if err == nil {
+					t.Errorf("got %+v, want an error", *s)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *s != tt.want {
+				t.Errorf("got %+v, want %+v", *s, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamServers(t *testing.T) {
+	services := []interface{}{
+		newTestService("postgres", service.TypeClusterIP, "", &service.Port{Name: "pg", Port: 5432}),
+		newTestService("dns", service.TypeClusterIP, "",
+			&service.Port{Name: "dns-tcp", Protocol: service.ProtocolTCP, Port: 53},
+			&service.Port{Name: "dns", Protocol: service.ProtocolUDP, Port: 53},
+		),
+		newTestService("ext", service.TypeExternalName, "db.example.com", &service.Port{Port: 5432}),
+	}
+
+	tests := []struct {
+		name     string
+		protocol string
+		data     map[string]string
+		// servers are the accepted ports and their upstreams
+		servers []string
+	}{
+		{
+			name:     "tcp",
+			protocol: service.ProtocolTCP,
+			data: map[string]string{
+				"5432": "default/postgres:5432",
+				"5433": "default/postgres:pg:PROXY:PROXY",
+				"53":   "default/dns:53",
+			},
+			servers: []string{
+				"53 default_dns_53",
+				"5432 default_postgres_5432",
+				"5433 default_postgres_5432 accept send",
+			},
+		},
+		{
+			name:     "tcp ports of http",
+			protocol: service.ProtocolTCP,
+			data: map[string]string{
+				"80":   "default/postgres:5432",
+				"443":  "default/postgres:5432",
+				"8080": "default/postgres:5432",
+			},
+			servers: []string{"8080 default_postgres_5432"},
+		},
+		{
+			name:     "udp",
+			protocol: service.ProtocolUDP,
+			data: map[string]string{
+				// 80 is an http port of TCP only
+				"80": "default/dns:53",
+				"53": "default/dns:dns::PROXY",
+			},
+			servers: []string{
+				"53 udp default_dns_53_udp send",
+				"80 udp default_dns_53_udp",
+			},
+		},
+		{
+			name:     "udp accepting the PROXY protocol",
+			protocol: service.ProtocolUDP,
+			data:     map[string]string{"53": "default/dns:53:PROXY"},
+		},
+		{
+			name:     "invalid entries",
+			protocol: service.ProtocolTCP,
+			data: map[string]string{
+				"dns":   "default/dns:53",
+				"0":     "default/dns:53",
+				"65536": "default/dns:53",
+				"1000":  "default/dns",
+				"1001":  "default/missing:53",
+				"1002":  "default/dns:54",
+				"1003":  "default/dns:dns",
+				"1004":  "default/ext:5432",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSecretClient{lists: map[string][]interface{}{"/api/v1/services": services}}
+			c := newController(nginx.New(&nginx.Main{}, &nginx.Http{HttpSettings: nginx.HttpSettings{Listen: 80, TLSListen: 443}}), client)
+
+			if err := c.services.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			cm := &configmap.ConfigMap{Metadata: &kube.Metadata{Namespace: "default", Name: "services"}, Data: tt.data}
+
+			var servers []string
+
+			for _, s := range c.streamServers(cm, tt.protocol) {
+				server := fmt.Sprint(s.Listen)
+
+				if s.UDP {
+					server += " udp"
+				}
+
+				server += " " + s.Upstream
+
+				if s.AcceptProxyProtocol {
+					server += " accept"
+				}
+
+				if s.SendProxyProtocol {
+					server += " send"
+				}
+
+				servers = append(servers, server)
+			}
+
+			if strings.Join(servers, ",") != strings.Join(tt.servers, ",") {
+				t.Errorf("got servers %q, want %q", servers, tt.servers)
+			}
+		})
+	}
+}
@@ -0,0 +1,314 @@
+package controller
+
+import (
+	"flag"
+	"fmt"
+	"ingress-controller/kube/endpointslice"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/kube/service"
+	"ingress-controller/nginx"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var defaultBackendService = flag.String("default-backend-service", "", "namespace/name[:port] of the Service serving unmatched hosts and paths instead of 404, its namespace must be watched")
+
+// defaultBackendRef references the Service of -default-backend-service.
+const defaultBackendRef = "default-backend"
+
+// backend is a Service port referenced by ingress paths or stream servers,
+// it is rendered as an upstream of the ready endpoints of the Service.
+type backend struct {
+	name    string
+	stream  bool
+	service string
+	port    *service.Port
+	refs    map[string]struct{}
+}
+
+// backendKey keys the backends, stream upstreams live in their own context
+// and may have the same name as http upstreams.
+func backendKey(name string, stream bool) string {
+	if stream {
+		return "stream/" + name
+	}
+
+	return name
+}
+
+// upstreamName names the upstream of a Service port, "_" can not appear
+// in namespace or Service names.
+func upstreamName(service string, port int) string {
+	return strings.Replace(service, "/", "_", 1) + "_" + strconv.Itoa(port)
+}
+
+// slicePort returns the endpoint port of a Service port, slice ports carry
+// the name of the Service port they resolve.
+func slicePort(slice *endpointslice.EndpointSlice, port *service.Port) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Name == port.Name {
+			return p.Port, true
+		}
+	}
+
+	return 0, false
+}
+
+func (c *Controller) buildUpstream(b *backend) *nginx.Upstream {
+	up := &nginx.Upstream{Name: b.name}
+	seen := map[string]struct{}{}
+
+	for _, slice := range c.endpointSlices.List() {
+		if slice.ServiceName() != b.service || slice.AddressType == "FQDN" {
+			continue
+		}
+
+		port, ok := slicePort(slice, b.port)
+
+		if !ok {
+			continue
+		}
+
+		for _, ep := range slice.Endpoints {
+			if !ep.Ready() {
+				continue
+			}
+
+			for _, addr := range ep.Addresses {
+				server := net.JoinHostPort(addr, strconv.Itoa(port))
+
+				if _, ok := seen[server]; !ok {
+					seen[server] = struct{}{}
+					up.Servers = append(up.Servers, server)
+				}
+			}
+		}
+	}
+
+	sort.Strings(up.Servers)
+	return up
+}
+
+func (c *Controller) setUpstream(b *backend) {
+	if b.stream {
+		c.ngx.SetStreamUpstream(c.buildUpstream(b))
+	} else {
+		c.ngx.SetUpstream(c.buildUpstream(b))
+	}
+}
+
+// acquireBackend references the upstream of a Service port from an
+// ingress or a stream server and returns its name.
+func (c *Controller) acquireBackend(ref, svcName string, port *service.Port, stream bool) string {
+	name := upstreamName(svcName, port.Port)
+
+	// a Service may use a port number for TCP and UDP
+	if port.Protocol == service.ProtocolUDP {
+		name += "_udp"
+	}
+
+	key := backendKey(name, stream)
+
+	b, ok := c.backends[key]
+
+	if !ok {
+		b = &backend{
+			name:    name,
+			stream:  stream,
+			service: svcName,
+			port:    port,
+			refs:    map[string]struct{}{},
+		}
+
+		c.backends[key] = b
+		c.setUpstream(b)
+	} else if b.port.Name != port.Name {
+		b.port = port
+		c.setUpstream(b)
+	}
+
+	b.refs[ref] = struct{}{}
+	return name
+}
+
+// refService records that ref proxies to a Service, ref is synced again
+// when the Service changes.
+func (c *Controller) refService(ref, svcName string) {
+	refs, ok := c.serviceRefs[svcName]
+
+	if !ok {
+		refs = map[string]struct{}{}
+		c.serviceRefs[svcName] = refs
+	}
+
+	refs[ref] = struct{}{}
+}
+
+// resolveBackend returns the proxy config of an ingress backend, it fails
+// when the Service or its port does not exist.
+func (c *Controller) resolveBackend(is *ingress.Ingress, isBackend ingress.Service) (*nginx.ProxyPassConf, error) {
+	name := is.Metadata.Namespace + "/" + isBackend.Name
+
+	return c.resolveService(is.Name(), name, isBackend.Port.Name, isBackend.Port.Number)
+}
+
+// resolveService returns the proxy config of a Service port referenced by
+// ref, the port is selected by portName or else by portNumber.
+func (c *Controller) resolveService(ref, svcName, portName string, portNumber int) (*nginx.ProxyPassConf, error) {
+	c.refService(ref, svcName)
+
+	svc, ok := c.services.Get(svcName)
+
+	if !ok {
+		return nil, fmt.Errorf("service %s not found", svcName)
+	}
+
+	port := svc.FindPort(portName, portNumber)
+
+	if svc.Spec.Type == service.TypeExternalName {
+		number := portNumber
+
+		if port != nil {
+			number = port.Port
+		} else if portName != "" {
+			return nil, fmt.Errorf("service %s has no port %s", svcName, portName)
+		}
+
+		return &nginx.ProxyPassConf{
+			Upstream: "http://" + net.JoinHostPort(svc.Spec.ExternalName, strconv.Itoa(number)),
+			Resolve:  true,
+		}, nil
+	}
+
+	if port == nil {
+		if portName == "" {
+			portName = strconv.Itoa(portNumber)
+		}
+
+		return nil, fmt.Errorf("service %s has no port %s", svcName, portName)
+	}
+
+	return &nginx.ProxyPassConf{
+		UpstreamName: c.acquireBackend(ref, svcName, port, false),
+	}, nil
+}
+
+// releaseBackends drops the references of an ingress or a stream server,
+// upstreams that are no longer referenced are removed.
+func (c *Controller) releaseBackends(ref string) {
+	for name, refs := range c.serviceRefs {
+		delete(refs, ref)
+
+		if len(refs) == 0 {
+			delete(c.serviceRefs, name)
+		}
+	}
+
+	for key, b := range c.backends {
+		delete(b.refs, ref)
+
+		if len(b.refs) > 0 {
+			continue
+		}
+
+		delete(c.backends, key)
+
+		if b.stream {
+			c.ngx.DeleteStreamUpstream(b.name)
+		} else {
+			c.ngx.DeleteUpstream(b.name)
+		}
+	}
+}
+
+// syncEndpoints regenerates the upstreams of a Service after its endpoints
+// changed.
+func (c *Controller) syncEndpoints(svcName string) error {
+	for _, b := range c.backends {
+		if b.service == svcName {
+			c.setUpstream(b)
+		}
+	}
+
+	return nil
+}
+
+// syncService queues the ingresses, stream servers and routes referencing a
+// Service after it changed, its ports or type decide how they proxy to it.
+func (c *Controller) syncService(svcName string) error {
+	for ref := range c.serviceRefs[svcName] {
+		if isStreamRef(ref) {
+			c.queue.Add(workItem{kind: kindStream})
+		} else if isRouteRef(ref) {
+			c.queue.Add(workItem{kind: kindGateway})
+		} else if ref == defaultBackendRef {
+			c.queue.Add(workItem{kind: kindDefaultBackend})
+		} else {
+			c.enqueueIngress(ref)
+		}
+	}
+
+	return nil
+}
+
+// syncDefaultBackend resolves the Service of -default-backend-service,
+// unmatched requests are answered with 404 while it can not be resolved.
+func (c *Controller) syncDefaultBackend() error {
+	c.releaseBackends(defaultBackendRef)
+
+	if *defaultBackendService == "" {
+		return nil
+	}
+
+	svcName, port, _ := strings.Cut(*defaultBackendService, ":")
+
+	if ns, name, ok := strings.Cut(svcName, "/"); !ok || ns == "" || name == "" {
+		log.Printf("controller: default backend: %q is not namespace/name[:port]", *defaultBackendService)
+		return nil
+	}
+
+	var (
+		portName   string
+		portNumber int
+	)
+
+	if n, err := strconv.Atoi(port); err == nil {
+		portNumber = n
+	} else {
+		portName = port
+	}
+
+	proxyPass, err := c.resolveDefaultBackend(svcName, portName, portNumber)
+
+	if err != nil {
+		log.Printf("controller: default backend: %s", err)
+	}
+
+	c.ngx.SetDefaultBackend(proxyPass)
+	return nil
+}
+
+// resolveDefaultBackend resolves the default backend, on the first port of
+// the Service when no port is given.
+func (c *Controller) resolveDefaultBackend(svcName, portName string, portNumber int) (*nginx.ProxyPassConf, error) {
+	if portName == "" && portNumber == 0 {
+		c.refService(defaultBackendRef, svcName)
+
+		svc, ok := c.services.Get(svcName)
+
+		if !ok {
+			return nil, fmt.Errorf("service %s not found", svcName)
+		}
+
+		if len(svc.Spec.Ports) == 0 {
+			return nil, fmt.Errorf("service %s has no ports", svcName)
+		}
+
+		portName, portNumber = svc.Spec.Ports[0].Name, svc.Spec.Ports[0].Port
+	}
+
+	return c.resolveService(defaultBackendRef, svcName, portName, portNumber)
+}
@@ -0,0 +1,271 @@
+package controller
+
+import (
+	"ingress-controller/kube"
+	"ingress-controller/kube/endpointslice"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/kube/service"
+	"ingress-controller/nginx"
+	"strings"
+	"testing"
+)
+
+func newTestSlice(svcName, name, addressType string, ports map[string]int, endpoints ...*endpointslice.Endpoint) *endpointslice.EndpointSlice {
+	slice := &endpointslice.EndpointSlice{
+		Metadata: &kube.Metadata{
+			Namespace: "default",
+			Name:      name,
+			Labels:    map[string]string{endpointslice.LabelServiceName: svcName},
+		},
+		AddressType: addressType,
+		Endpoints:   endpoints,
+	}
+
+	for name, port := range ports {
+		slice.Ports = append(slice.Ports, &endpointslice.Port{Name: name, Port: port})
+	}
+
+	return slice
+}
+
+func newTestEndpoint(ready *bool, addresses ...string) *endpointslice.Endpoint {
+	ep := &endpointslice.Endpoint{Addresses: addresses}
+	ep.Conditions.Ready = ready
+	return ep
+}
+
+func TestBuildUpstream(t *testing.T) {
+	ready, notReady := true, false
+
+	slices := []interface{}{
+		newTestSlice("web", "web-a", "IPv4", map[string]int{"http": 8080, "metrics": 9090},
+			newTestEndpoint(nil, "10.0.0.1"),
+			newTestEndpoint(&notReady, "10.0.0.2"),
+			newTestEndpoint(&ready, "10.0.0.3"),
+		),
+		newTestSlice("web", "web-b", "IPv4", map[string]int{"http": 8080},
+			newTestEndpoint(nil, "10.0.0.4", "10.0.0.1"),
+		),
+		newTestSlice("web", "web-c", "IPv6", map[string]int{"http": 8080},
+			newTestEndpoint(nil, "fd00::1"),
+		),
+		newTestSlice("web", "web-d", "IPv4", map[string]int{"metrics": 9090},
+			newTestEndpoint(nil, "10.0.0.5"),
+		),
+		newTestSlice("web", "web-fqdn", "FQDN", map[string]int{"http": 8080},
+			newTestEndpoint(nil, "web.example.com"),
+		),
+		newTestSlice("api", "api-a", "IPv4", map[string]int{"http": 8080},
+			newTestEndpoint(nil, "10.1.0.1"),
+		),
+		newTestSlice("single", "single-a", "IPv4", map[string]int{"": 3000},
+			newTestEndpoint(nil, "10.2.0.1"),
+		),
+	}
+
+	tests := []struct {
+		name    string
+		service string
+		port    *service.Port
+		servers []string
+	}{
+		{
+			name:    "ready endpoints of the named port",
+			service: "default/web",
+			port:    &service.Port{Name: "http", Port: 80},
+			servers: []string{"10.0.0.1:8080", "10.0.0.3:8080", "10.0.0.4:8080", "[fd00::1]:8080"},
+		},
+		{
+			name:    "other port of the same slices",
+			service: "default/web",
+			port:    &service.Port{Name: "metrics", Port: 9090},
+			servers: []string{"10.0.0.1:9090", "10.0.0.3:9090", "10.0.0.5:9090"},
+		},
+		{
+			name:    "port without endpoints",
+			service: "default/web",
+			port:    &service.Port{Name: "grpc", Port: 9000},
+		},
+		{
+			name:    "unnamed port",
+			service: "default/single",
+			port:    &service.Port{Port: 80},
+			servers: []string{"10.2.0.1:3000"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSecretClient{lists: map[string][]interface{}{"/apis/discovery.k8s.io/v1/endpointslices": slices}}
+			c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), client)
+
+			if err := c.endpointSlices.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			up := c.buildUpstream(&backend{name: "up", service: tt.service, port: tt.port})
+
+			if strings.Join(up.Servers, ",") != strings.Join(tt.servers, ",") {
+				t.Errorf("got servers %v, want %v", up.Servers, tt.servers)
+			}
+		})
+	}
+}
+
+func newTestService(name, typ, externalName string, ports ...*service.Port) *service.Service {
+	svc := &service.Service{Metadata: &kube.Metadata{Namespace: "default", Name: name}}
+	svc.Spec.Type = typ
+	svc.Spec.ExternalName = externalName
+	svc.Spec.Ports = ports
+	return svc
+}
+
+func TestResolveService(t *testing.T) {
+	services := []interface{}{
+		newTestService("web", service.TypeClusterIP, "", &service.Port{Name: "http", Port: 80}, &service.Port{Name: "metrics", Port: 9090}),
+		newTestService("api", service.TypeExternalName, "api.example.com", &service.Port{Name: "https", Port: 443}),
+		newTestService("db", service.TypeExternalName, "db.example.com"),
+	}
+
+	tests := []struct {
+		name       string
+		service    string
+		portName   string
+		portNumber int
+		want       nginx.ProxyPassConf
+		err        string
+	}{
+		{
+			name:       "port number",
+			service:    "default/web",
+			portNumber: 80,
+			want:       nginx.ProxyPassConf{UpstreamName: "default_web_80"},
+		},
+		{
+			name:     "named port",
+			service:  "default/web",
+			portName: "metrics",
+			want:     nginx.ProxyPassConf{UpstreamName: "default_web_9090"},
+		},
+		{
+			name:     "missing named port",
+			service:  "default/web",
+			portName: "grpc",
+			err:      "service default/web has no port grpc",
+		},
+		{
+			name:       "missing port number",
+			service:    "default/web",
+			portNumber: 81,
+			err:        "service default/web has no port 81",
+		},
+		{
+			name:       "missing service",
+			service:    "default/missing",
+			portNumber: 80,
+			err:        "service default/missing not found",
+		},
+		{
+			name:     "named port of an ExternalName",
+			service:  "default/api",
+			portName: "https",
+			want:     nginx.ProxyPassConf{Upstream: "http://api.example.com:443", Resolve: true},
+		},
+		{
+			name:       "port number of an ExternalName",
+			service:    "default/api",
+			portNumber: 8443,
+			want:       nginx.ProxyPassConf{Upstream: "http://api.example.com:8443", Resolve: true},
+		},
+		{
+			name:     "missing named port of an ExternalName",
+			service:  "default/api",
+			portName: "grpc",
+			err:      "service default/api has no port grpc",
+		},
+		{
+			name:       "ExternalName without ports",
+			service:    "default/db",
+			portNumber: 5432,
+			want:       nginx.ProxyPassConf{Upstream: "http://db.example.com:5432", Resolve: true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeSecretClient{lists: map[string][]interface{}{"/api/v1/services": services}}
+			c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), client)
+
+			if err := c.services.Sync(); err != nil {
+				t.Fatal(err)
+			}
+
+			proxyPass, err := c.resolveService("default/web", tt.service, tt.portName, tt.portNumber)
+
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Errorf("got error %v, want %s", err, tt.err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if *proxyPass != tt.want {
+				t.Errorf("got %+v, want %+v", *proxyPass, tt.want)
+			}
+
+			// the Service is referenced, so the ingress is synced when it changes
+			if _, ok := c.serviceRefs[tt.service]["default/web"]; !ok {
+				t.Errorf("%s is not referenced", tt.service)
+			}
+		})
+	}
+}
+
+// TestIngressBackendErrors checks that a path with an unresolved backend is
+// skipped with a warning while the other paths are served.
+func TestIngressBackendErrors(t *testing.T) {
+	c := newController(nginx.New(&nginx.Main{}, &nginx.Http{}), &fakeSecretClient{lists: newTestServices("web")})
+
+	if err := c.services.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	is := &ingress.Ingress{Metadata: &kube.Metadata{Namespace: "default", Name: "web"}}
+	is.Spec.Rules = append(is.Spec.Rules, &ingress.Rule{Host: "example.com"})
+
+	for _, backend := range []struct{ path, service, port string }{
+		{"/", "web", "http"},
+		{"/missing", "missing", "http"},
+		{"/port", "web", "grpc"},
+	} {
+		p := &ingress.Path{Path: backend.path, PathType: ingress.PathTypePrefix}
+		p.Backend.Service.Name = backend.service
+		p.Backend.Service.Port.Name = backend.port
+		is.Spec.Rules[0].Http.Paths = append(is.Spec.Rules[0].Http.Paths, p)
+	}
+
+	_, builtin := c.ngx.Counts()
+	c.review = new(review)
+
+	if err := c.addIngress(is); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"path /missing: service default/missing not found",
+		"path /port: service default/web has no port grpc",
+	}
+
+	if strings.Join(c.review.warnings, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got warnings %q, want %q", c.review.warnings, want)
+	}
+
+	if _, locations := c.ngx.Counts(); locations-builtin != 1 {
+		t.Errorf("%d locations served, want 1", locations-builtin)
+	}
+}
@@ -0,0 +1,40 @@
+package admission
+
+import (
+	"encoding/json"
+	"ingress-controller/kube"
+)
+
+const APIVersion = "admission.k8s.io/v1"
+
+type GroupVersionResource struct {
+	Group    string `json:"group"`
+	Version  string `json:"version"`
+	Resource string `json:"resource"`
+}
+
+type Request struct {
+	UID       string               `json:"uid"`
+	Resource  GroupVersionResource `json:"resource"`
+	Namespace string               `json:"namespace"`
+	Name      string               `json:"name"`
+	Operation string               `json:"operation"`
+	Object    json.RawMessage      `json:"object"`
+	DryRun    bool                 `json:"dryRun"`
+}
+
+type Response struct {
+	UID      string       `json:"uid"`
+	Allowed  bool         `json:"allowed"`
+	Result   *kube.Status `json:"status,omitempty"`
+	Warnings []string     `json:"warnings,omitempty"`
+}
+
+// Review is an AdmissionReview, the apiserver sends the Request and expects
+// the Response in return.
+type Review struct {
+	APIVersion string    `json:"apiVersion"`
+	Kind       string    `json:"kind"`
+	Request    *Request  `json:"request,omitempty"`
+	Response   *Response `json:"response,omitempty"`
+}
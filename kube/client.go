@@ -1,30 +1,126 @@
 package kube
 
 import (
+	"bytes"
 	"crypto/tls"
 	"crypto/x509"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"strings"
+	"sync"
+	"time"
 )
 
+// credentialRefreshPeriod is how often the projected service account token
+// and CA bundle are read again, the kubelet rotates the token well before it
+// expires.
+const credentialRefreshPeriod = time.Minute
+
 type Client interface {
 	Do(r *http.Request) (*http.Response, error)
 }
 
 type InClusterClient struct {
-	client *http.Client
-	token  string
+	// dir holds the token and ca.crt of the service account
+	dir string
+	// host is the host:port of the apiserver
+	host        string
+	mu          sync.Mutex
+	client      *http.Client
+	token       string
+	ca          []byte
+	refreshedAt time.Time
+}
+
+// refresh reads the token and the CA bundle again, the transport is
+// replaced when the CA bundle changed.
+func (i *InClusterClient) refresh() error {
+	token, err := ioutil.ReadFile(i.dir + "/token")
+
+	if err != nil {
+		return err
+	}
+
+	ca, err := ioutil.ReadFile(i.dir + "/ca.crt")
+
+	if err != nil {
+		return err
+	}
+
+	if i.client == nil || !bytes.Equal(ca, i.ca) {
+		certPool := x509.NewCertPool()
+		certPool.AppendCertsFromPEM(ca)
+
+		if i.client != nil {
+			log.Printf("kube: CA bundle changed, reloading")
+			i.client.CloseIdleConnections()
+		}
+
+		i.client = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{
+					RootCAs: certPool,
+				},
+			},
+		}
+
+		i.ca = ca
+	}
+
+	i.token = strings.TrimSpace(string(token))
+	i.refreshedAt = time.Now()
+	return nil
+}
+
+// credentials returns the client and token to send a request with, they
+// are refreshed every credentialRefreshPeriod or when force is set.
+func (i *InClusterClient) credentials(force bool) (*http.Client, string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if force || time.Since(i.refreshedAt) > credentialRefreshPeriod {
+		// the files are briefly missing while the kubelet swaps them, the
+		// previous credentials are kept until the next attempt
+		if err := i.refresh(); err != nil {
+			log.Printf("kube: refresh service account credentials: %s", err)
+		}
+	}
+
+	return i.client, i.token
 }
 
 func (i *InClusterClient) Do(r *http.Request) (*http.Response, error) {
 	u := r.URL
 	u.Scheme = "https"
-	u.Host = os.Getenv("KUBERNETES_SERVICE_HOST") + ":" + os.Getenv("KUBERNETES_SERVICE_PORT_HTTPS")
-	r.Header.Set("Authorization", "Bearer "+i.token)
+	u.Host = i.host
 
-	return i.client.Do(r)
+	client, token := i.credentials(false)
+	r.Header.Set("Authorization", "Bearer "+token)
+
+	res, err := client.Do(r)
+
+	// the token may have been rotated since it was last read
+	if err == nil && res.StatusCode == http.StatusUnauthorized && (r.Body == nil || r.GetBody != nil) {
+		res.Body.Close()
+
+		retry := r.Clone(r.Context())
+
+		if r.GetBody != nil {
+			if retry.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		client, token = i.credentials(true)
+		retry.Header.Set("Authorization", "Bearer "+token)
+
+		return client.Do(retry)
+	}
+
+	return res, err
 }
 
 func NewInClusterClient() *InClusterClient {
@@ -32,32 +128,25 @@ func NewInClusterClient() *InClusterClient {
 		panic("not in cluster")
 	}
 
-	certPool := x509.NewCertPool()
-
-	if ca, err := ioutil.ReadFile(serviceaccountMountPath + "/ca.crt"); err != nil {
-		panic(err)
-	} else {
-		certPool.AppendCertsFromPEM(ca)
-	}
-
-	token, err := ioutil.ReadFile(serviceaccountMountPath + "/token")
+	i, err := newInClusterClient(serviceaccountMountPath, os.Getenv("KUBERNETES_SERVICE_HOST")+":"+os.Getenv("KUBERNETES_SERVICE_PORT_HTTPS"))
 
 	if err != nil {
 		panic(err)
 	}
 
-	httpClient := new(http.Client)
+	return i
+}
 
-	httpClient.Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs: certPool,
-		},
-	}
+// newInClusterClient returns a client of the apiserver at host with the
+// service account mounted at dir.
+func newInClusterClient(dir, host string) (*InClusterClient, error) {
+	i := &InClusterClient{dir: dir, host: host}
 
-	return &InClusterClient{
-		client: httpClient,
-		token:  string(token),
+	if err := i.refresh(); err != nil {
+		return nil, err
 	}
+
+	return i, nil
 }
 
 type ProxyClient struct {
@@ -78,3 +167,13 @@ func NewProxyClient(proxyAddr string) *ProxyClient {
 		return &ProxyClient{endpoint: u}
 	}
 }
+
+// InClusterNamespace returns the namespace of the pod the controller runs
+// in, or "" outside a cluster.
+func InClusterNamespace() string {
+	if ns, err := ioutil.ReadFile(serviceaccountMountPath + "/namespace"); err == nil {
+		return string(ns)
+	}
+
+	return ""
+}
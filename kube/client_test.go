@@ -0,0 +1,226 @@
+package kube
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestInClusterClient returns a client of server with the service account
+// files of dir.
+func newTestInClusterClient(t *testing.T, server *testAPIServer, dir, token string, ca []byte) *InClusterClient {
+	t.Helper()
+
+	writeFile(t, dir, "token", []byte(token+"\n"), 0600)
+	writeFile(t, dir, "ca.crt", ca, 0600)
+
+	i, err := newInClusterClient(dir, server.Listener.Addr().String())
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return i
+}
+
+func doRequest(i *InClusterClient, method, path string, body []byte) (int, error) {
+	r := newRequest()
+	r.Method = method
+	r.URL.Path = path
+
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.GetBody = func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+
+	res, err := i.Do(r)
+
+	if err != nil {
+		return 0, err
+	}
+
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+func TestInClusterTokenReread(t *testing.T) {
+	server := newTestAPIServer(t)
+	dir := t.TempDir()
+	i := newTestInClusterClient(t, server, dir, "first", server.caPEM())
+
+	writeFile(t, dir, "token", []byte("second"), 0600)
+
+	// the token is cached for credentialRefreshPeriod
+	if _, err := doRequest(i, http.MethodGet, "/api", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	i.refreshedAt = time.Now().Add(-credentialRefreshPeriod - time.Second)
+
+	if _, err := doRequest(i, http.MethodGet, "/api", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the previous token is kept while the file is missing
+	i.refreshedAt = time.Time{}
+
+	if err := os.Remove(filepath.Join(dir, "token")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := doRequest(i, http.MethodGet, "/api", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []string
+
+	for _, seen := range server.seen {
+		tokens = append(tokens, seen.authorization)
+	}
+
+	if want := "Bearer first,Bearer second,Bearer second"; strings.Join(tokens, ",") != want {
+		t.Errorf("tokens %v, want %s", tokens, want)
+	}
+}
+
+func TestInClusterRetry(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		body         []byte
+		unauthorized []string
+		wantStatus   int
+		wantTokens   []string
+	}{
+		{
+			name:       "valid",
+			method:     http.MethodGet,
+			wantStatus: http.StatusOK,
+			wantTokens: []string{"Bearer first"},
+		},
+		{
+			name:         "rotated",
+			method:       http.MethodGet,
+			unauthorized: []string{"Bearer first"},
+			wantStatus:   http.StatusOK,
+			wantTokens:   []string{"Bearer first", "Bearer second"},
+		},
+		{
+			name:         "rotated with a body",
+			method:       http.MethodPost,
+			body:         []byte(`{"kind":"Event"}`),
+			unauthorized: []string{"Bearer first"},
+			wantStatus:   http.StatusOK,
+			wantTokens:   []string{"Bearer first", "Bearer second"},
+		},
+		{
+			name:         "revoked",
+			method:       http.MethodGet,
+			unauthorized: []string{"Bearer first", "Bearer second"},
+			wantStatus:   http.StatusUnauthorized,
+			wantTokens:   []string{"Bearer first", "Bearer second"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestAPIServer(t)
+			dir := t.TempDir()
+			i := newTestInClusterClient(t, server, dir, "first", server.caPEM())
+
+			for _, token := range tt.unauthorized {
+				server.unauthorized[token] = true
+			}
+
+			// the kubelet rotated the token since it was read
+			writeFile(t, dir, "token", []byte("second"), 0600)
+
+			status, err := doRequest(i, tt.method, "/api/v1/namespaces/default/events", tt.body)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if status != tt.wantStatus {
+				t.Fatalf("status %d, want %d", status, tt.wantStatus)
+			}
+
+			var tokens []string
+
+			for n, seen := range server.seen {
+				tokens = append(tokens, seen.authorization)
+
+				if seen.body != string(tt.body) {
+					t.Errorf("request %d: body %q, want %q", n, seen.body, tt.body)
+				}
+			}
+
+			if strings.Join(tokens, ",") != strings.Join(tt.wantTokens, ",") {
+				t.Errorf("tokens %v, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestInClusterRetryWithoutGetBody(t *testing.T) {
+	server := newTestAPIServer(t)
+	dir := t.TempDir()
+	i := newTestInClusterClient(t, server, dir, "first", server.caPEM())
+	server.unauthorized["Bearer first"] = true
+
+	// a body that cannot be read again is not retried
+	r := newRequest()
+	r.Method = http.MethodPost
+	r.URL.Path = "/api/v1/namespaces/default/events"
+	r.Body = io.NopCloser(strings.NewReader(`{"kind":"Event"}`))
+
+	res, err := i.Do(r)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusUnauthorized || len(server.seen) != 1 {
+		t.Errorf("status %d after %d requests, want 401 after 1", res.StatusCode, len(server.seen))
+	}
+}
+
+func TestInClusterCAReload(t *testing.T) {
+	server := newTestAPIServer(t)
+	dir := t.TempDir()
+	other, _ := testCert(t)
+	i := newTestInClusterClient(t, server, dir, "first", other)
+
+	if _, err := doRequest(i, http.MethodGet, "/api", nil); err == nil {
+		t.Fatal("the apiserver was trusted with another CA")
+	}
+
+	client := i.client
+
+	// the transport is kept while the CA bundle does not change
+	i.refreshedAt = time.Time{}
+
+	if _, err := doRequest(i, http.MethodGet, "/api", nil); err == nil || i.client != client {
+		t.Fatalf("the transport was replaced without a new CA bundle: %v", err)
+	}
+
+	writeFile(t, dir, "ca.crt", server.caPEM(), 0600)
+	i.refreshedAt = time.Time{}
+
+	if status, err := doRequest(i, http.MethodGet, "/api", nil); err != nil || status != http.StatusOK {
+		t.Fatalf("status %d after the CA bundle changed: %v", status, err)
+	}
+
+	if i.client == client {
+		t.Error("the transport was not replaced")
+	}
+}
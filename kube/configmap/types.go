@@ -0,0 +1,43 @@
+package configmap
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"net/http"
+)
+
+type ConfigMap struct {
+	Metadata *kube.Metadata    `json:"metadata"`
+	Data     map[string]string `json:"data"`
+}
+
+func (c *ConfigMap) Name() string {
+	return fmt.Sprintf("%s/%s", c.Metadata.Namespace, c.Metadata.Name)
+}
+
+func (c *ConfigMap) Meta() *kube.Metadata {
+	return c.Metadata
+}
+
+func (c *ConfigMap) Reference() *kube.ObjectReference {
+	return &kube.ObjectReference{
+		APIVersion:      "v1",
+		Kind:            "ConfigMap",
+		Namespace:       c.Metadata.Namespace,
+		Name:            c.Metadata.Name,
+		UID:             c.Metadata.Uid,
+		ResourceVersion: c.Metadata.ResourceVersion,
+	}
+}
+
+func WatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/api/v1/watch", namespace, "configmaps")
+	}
+}
+
+func ListFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/api/v1", namespace, "configmaps")
+	}
+}
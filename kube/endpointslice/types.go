@@ -0,0 +1,61 @@
+package endpointslice
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"net/http"
+)
+
+// LabelServiceName is the label of an EndpointSlice naming its Service.
+const LabelServiceName = "kubernetes.io/service-name"
+
+type EndpointSlice struct {
+	Metadata    *kube.Metadata `json:"metadata"`
+	AddressType string         `json:"addressType"`
+	Endpoints   []*Endpoint    `json:"endpoints"`
+	Ports       []*Port        `json:"ports"`
+}
+
+type Endpoint struct {
+	Addresses  []string `json:"addresses"`
+	Conditions struct {
+		Ready *bool `json:"ready"`
+	} `json:"conditions"`
+}
+
+// Ready reports whether the endpoint can receive traffic, an unknown state
+// is taken as ready.
+func (e *Endpoint) Ready() bool {
+	return e.Conditions.Ready == nil || *e.Conditions.Ready
+}
+
+type Port struct {
+	Name     string `json:"name"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+func (e *EndpointSlice) Name() string {
+	return fmt.Sprintf("%s/%s", e.Metadata.Namespace, e.Metadata.Name)
+}
+
+func (e *EndpointSlice) Meta() *kube.Metadata {
+	return e.Metadata
+}
+
+// ServiceName returns the namespaced name of the Service owning the slice.
+func (e *EndpointSlice) ServiceName() string {
+	return fmt.Sprintf("%s/%s", e.Metadata.Namespace, e.Metadata.Labels[LabelServiceName])
+}
+
+func WatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/apis/discovery.k8s.io/v1/watch", namespace, "endpointslices")
+	}
+}
+
+func ListFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/apis/discovery.k8s.io/v1", namespace, "endpointslices")
+	}
+}
@@ -0,0 +1,183 @@
+package event
+
+import (
+	"context"
+	"fmt"
+	"ingress-controller/kube"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// aggregateWindow is how long an event is counted up instead of
+	// posting a new one when it is recorded again.
+	aggregateWindow = time.Minute * 10
+	// patchInterval is the minimum interval between two count updates of
+	// the same event.
+	patchInterval = time.Minute
+	// flushInterval is how often the counts that were not posted because
+	// of patchInterval are flushed.
+	flushInterval = time.Second * 15
+)
+
+type aggregateKey struct {
+	object  kube.ObjectReference
+	typ     string
+	reason  string
+	message string
+}
+
+type aggregated struct {
+	event     *Event
+	lastPatch time.Time
+	// patched is the count the event was last posted with
+	patched int
+}
+
+// Recorder posts Events about objects to the apiserver. Identical events
+// recorded within aggregateWindow update the count of the first one instead
+// of flooding the API with new events.
+type Recorder struct {
+	Client    kube.Client
+	Component string
+	Host      string
+	// IsEnabled decides whether events are posted, e.g. only by the
+	// elected leader. Events are dropped while it returns false.
+	IsEnabled func() bool
+	ch        chan *Event
+	mu        sync.Mutex
+	cache     map[aggregateKey]*aggregated
+}
+
+func (r *Recorder) Init() {
+	r.ch = make(chan *Event, 256)
+	r.cache = make(map[aggregateKey]*aggregated)
+}
+
+// Eventf records an event about ref, it never blocks.
+func (r *Recorder) Eventf(ref *kube.ObjectReference, eventType, reason, messageFmt string, args ...interface{}) {
+	if r == nil || (r.IsEnabled != nil && !r.IsEnabled()) {
+		return
+	}
+
+	now := time.Now()
+
+	e := &Event{
+		Metadata: &kube.Metadata{
+			Name:      fmt.Sprintf("%s.%x", ref.Name, now.UnixNano()),
+			Namespace: ref.Namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        fmt.Sprintf(messageFmt, args...),
+		Type:           eventType,
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Source: Source{
+			Component: r.Component,
+			Host:      r.Host,
+		},
+	}
+
+	select {
+	case r.ch <- e:
+	default:
+		log.Printf("event: queue is full, drop event %s %s", reason, e.Message)
+	}
+}
+
+func (r *Recorder) record(e *Event) error {
+	ref := e.InvolvedObject
+
+	key := aggregateKey{
+		// the version changes with every update of the object
+		object: kube.ObjectReference{
+			Kind:      ref.Kind,
+			Namespace: ref.Namespace,
+			Name:      ref.Name,
+			UID:       ref.UID,
+		},
+		typ:     e.Type,
+		reason:  e.Reason,
+		message: e.Message,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if agg, ok := r.cache[key]; ok && time.Since(agg.event.LastTimestamp) <= aggregateWindow {
+		agg.event.Count++
+		agg.event.LastTimestamp = e.LastTimestamp
+
+		// the count is posted by flush once patchInterval has passed
+		if time.Since(agg.lastPatch) < patchInterval {
+			return nil
+		}
+
+		return r.patch(agg)
+	}
+
+	if err := kube.Create(r.Client, CreateFunc(e.Metadata.Namespace), e); err != nil {
+		return err
+	}
+
+	r.cache[key] = &aggregated{event: e, lastPatch: time.Now(), patched: e.Count}
+	return nil
+}
+
+// patch posts the count of an aggregated event.
+func (r *Recorder) patch(agg *aggregated) error {
+	patch := map[string]interface{}{
+		"count":         agg.event.Count,
+		"lastTimestamp": agg.event.LastTimestamp,
+	}
+
+	agg.lastPatch = time.Now()
+
+	if err := kube.Patch(r.Client, PatchFunc(agg.event.Metadata.Namespace, agg.event.Metadata.Name), patch); err != nil {
+		return err
+	}
+
+	agg.patched = agg.event.Count
+	return nil
+}
+
+// flush posts the counts that were held back by patchInterval and forgets
+// the events outside aggregateWindow.
+func (r *Recorder) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for k, agg := range r.cache {
+		if agg.patched != agg.event.Count && time.Since(agg.lastPatch) >= patchInterval {
+			if err := r.patch(agg); err != nil {
+				log.Printf("event: update count of %s %s: %s", agg.event.Reason, agg.event.Message, err)
+			}
+		}
+
+		if agg.patched == agg.event.Count && time.Since(agg.event.LastTimestamp) > aggregateWindow {
+			delete(r.cache, k)
+		}
+	}
+}
+
+// Run posts recorded events until ctx is done.
+func (r *Recorder) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			r.flush()
+		case e := <-r.ch:
+			if err := r.record(e); err != nil {
+				log.Printf("event: record %s %s: %s", e.Reason, e.Message, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package event
+
+import (
+	"bytes"
+	"encoding/json"
+	"ingress-controller/kube"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClient records the events created and the counts patched.
+type fakeClient struct {
+	mu      sync.Mutex
+	created int
+	patches []int
+}
+
+func (f *fakeClient) Do(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+
+	switch r.Method {
+	case http.MethodPost:
+		f.created++
+	case http.MethodPatch:
+		var patch struct {
+			Count int `json:"count"`
+		}
+
+		json.Unmarshal(body, &patch)
+		f.patches = append(f.patches, patch.Count)
+	}
+
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       io.NopCloser(bytes.NewReader(body)),
+	}, nil
+}
+
+func newTestEvent(message string) *Event {
+	now := time.Now()
+
+	return &Event{
+		Metadata:       &kube.Metadata{Name: "web.1", Namespace: "default"},
+		InvolvedObject: kube.ObjectReference{Kind: "Ingress", Namespace: "default", Name: "web"},
+		Reason:         "Rejected",
+		Message:        message,
+		Type:           TypeWarning,
+		Count:          1,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+	}
+}
+
+func TestRecorderAggregate(t *testing.T) {
+	client := new(fakeClient)
+	r := &Recorder{Client: client}
+	r.Init()
+
+	for i := 0; i < 3; i++ {
+		if err := r.record(newTestEvent("path /: duplicated location")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := r.record(newTestEvent("other")); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.created != 2 || len(client.patches) != 0 {
+		t.Fatalf("created %d events and %d patches, want 2 and none within patchInterval", client.created, len(client.patches))
+	}
+
+	// nothing is flushed before patchInterval has passed
+	r.flush()
+
+	if len(client.patches) != 0 {
+		t.Fatalf("flushed %v before patchInterval", client.patches)
+	}
+
+	for _, agg := range r.cache {
+		agg.lastPatch = agg.lastPatch.Add(-patchInterval)
+	}
+
+	r.flush()
+
+	if len(client.patches) != 1 || client.patches[0] != 3 {
+		t.Fatalf("flushed %v, want the count 3 of the repeated event", client.patches)
+	}
+
+	// counts that were posted are not posted again
+	for _, agg := range r.cache {
+		agg.lastPatch = agg.lastPatch.Add(-patchInterval)
+	}
+
+	r.flush()
+
+	if len(client.patches) != 1 {
+		t.Fatalf("flushed %v, want no more patches", client.patches)
+	}
+}
+
+func TestRecorderExpire(t *testing.T) {
+	client := new(fakeClient)
+	r := &Recorder{Client: client}
+	r.Init()
+
+	if err := r.record(newTestEvent("expired")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, agg := range r.cache {
+		agg.event.LastTimestamp = agg.event.LastTimestamp.Add(-aggregateWindow - time.Second)
+	}
+
+	r.flush()
+
+	if len(r.cache) != 0 {
+		t.Fatalf("%d events cached after aggregateWindow", len(r.cache))
+	}
+
+	if err := r.record(newTestEvent("expired")); err != nil {
+		t.Fatal(err)
+	}
+
+	if client.created != 2 {
+		t.Fatalf("created %d events, want a new event after aggregateWindow", client.created)
+	}
+}
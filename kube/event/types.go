@@ -0,0 +1,51 @@
+package event
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"net/http"
+	"time"
+)
+
+const (
+	TypeNormal  = "Normal"
+	TypeWarning = "Warning"
+)
+
+type Source struct {
+	Component string `json:"component,omitempty"`
+	Host      string `json:"host,omitempty"`
+}
+
+// Event is a core/v1 Event.
+type Event struct {
+	Metadata       *kube.Metadata       `json:"metadata"`
+	InvolvedObject kube.ObjectReference `json:"involvedObject"`
+	Reason         string               `json:"reason"`
+	Message        string               `json:"message"`
+	Type           string               `json:"type"`
+	Count          int                  `json:"count"`
+	FirstTimestamp time.Time            `json:"firstTimestamp"`
+	LastTimestamp  time.Time            `json:"lastTimestamp"`
+	Source         Source               `json:"source"`
+}
+
+func (e *Event) Name() string {
+	return fmt.Sprintf("%s/%s", e.Metadata.Namespace, e.Metadata.Name)
+}
+
+func (e *Event) Meta() *kube.Metadata {
+	return e.Metadata
+}
+
+func CreateFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = fmt.Sprintf("/api/v1/namespaces/%s/events", namespace)
+	}
+}
+
+func PatchFunc(namespace, name string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = fmt.Sprintf("/api/v1/namespaces/%s/events/%s", namespace, name)
+	}
+}
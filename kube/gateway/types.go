@@ -0,0 +1,271 @@
+package gateway
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"net/http"
+	"time"
+)
+
+const apiPrefix = "/apis/gateway.networking.k8s.io/v1"
+
+const (
+	ProtocolHTTP  = "HTTP"
+	ProtocolHTTPS = "HTTPS"
+)
+
+const (
+	PathMatchExact             = "Exact"
+	PathMatchPathPrefix        = "PathPrefix"
+	PathMatchRegularExpression = "RegularExpression"
+)
+
+const (
+	FilterRequestHeaderModifier = "RequestHeaderModifier"
+	FilterRequestRedirect       = "RequestRedirect"
+)
+
+// namespaces from which a listener accepts routes
+const (
+	NamespacesFromSame = "Same"
+	NamespacesFromAll  = "All"
+)
+
+// condition types and reasons of route statuses
+const (
+	ConditionAccepted     = "Accepted"
+	ConditionResolvedRefs = "ResolvedRefs"
+
+	ReasonAccepted              = "Accepted"
+	ReasonNotAllowedByListeners = "NotAllowedByListeners"
+	ReasonNoMatchingParent      = "NoMatchingParent"
+	ReasonNoMatchingHostname    = "NoMatchingListenerHostname"
+	ReasonUnsupportedValue      = "UnsupportedValue"
+	ReasonResolvedRefs          = "ResolvedRefs"
+	ReasonBackendNotFound       = "BackendNotFound"
+	ReasonRefNotPermitted       = "RefNotPermitted"
+	ReasonInvalidKind           = "InvalidKind"
+)
+
+type GatewayClass struct {
+	Metadata *kube.Metadata `json:"metadata"`
+	Spec     struct {
+		ControllerName string `json:"controllerName"`
+	} `json:"spec"`
+}
+
+func (c *GatewayClass) Name() string {
+	return c.Metadata.Name
+}
+
+func (c *GatewayClass) Meta() *kube.Metadata {
+	return c.Metadata
+}
+
+type SecretObjectReference struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type Listener struct {
+	Name     string `json:"name"`
+	Hostname string `json:"hostname"`
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	TLS      *struct {
+		Mode            string                  `json:"mode"`
+		CertificateRefs []SecretObjectReference `json:"certificateRefs"`
+	} `json:"tls"`
+	AllowedRoutes *struct {
+		Namespaces *struct {
+			From string `json:"from"`
+		} `json:"namespaces"`
+	} `json:"allowedRoutes"`
+}
+
+// NamespacesFrom returns from which namespaces the listener accepts
+// routes.
+func (l *Listener) NamespacesFrom() string {
+	if l.AllowedRoutes == nil || l.AllowedRoutes.Namespaces == nil || l.AllowedRoutes.Namespaces.From == "" {
+		return NamespacesFromSame
+	}
+
+	return l.AllowedRoutes.Namespaces.From
+}
+
+type Gateway struct {
+	Metadata *kube.Metadata `json:"metadata"`
+	Spec     struct {
+		GatewayClassName string     `json:"gatewayClassName"`
+		Listeners        []Listener `json:"listeners"`
+	} `json:"spec"`
+}
+
+func (g *Gateway) Name() string {
+	return fmt.Sprintf("%s/%s", g.Metadata.Namespace, g.Metadata.Name)
+}
+
+func (g *Gateway) Meta() *kube.Metadata {
+	return g.Metadata
+}
+
+type ParentReference struct {
+	Group       string `json:"group,omitempty"`
+	Kind        string `json:"kind,omitempty"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name"`
+	SectionName string `json:"sectionName,omitempty"`
+	Port        int    `json:"port,omitempty"`
+}
+
+type HTTPHeader struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HTTPRouteMatch struct {
+	Path *struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	} `json:"path"`
+	Headers []struct {
+		Type  string `json:"type"`
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"headers"`
+	QueryParams []struct {
+		Type  string `json:"type"`
+		Name  string `json:"name"`
+		Value string `json:"value"`
+	} `json:"queryParams"`
+	Method string `json:"method"`
+}
+
+type HTTPRouteFilter struct {
+	Type                  string `json:"type"`
+	RequestHeaderModifier *struct {
+		Set    []HTTPHeader `json:"set"`
+		Add    []HTTPHeader `json:"add"`
+		Remove []string     `json:"remove"`
+	} `json:"requestHeaderModifier"`
+	RequestRedirect *struct {
+		Scheme   string `json:"scheme"`
+		Hostname string `json:"hostname"`
+		Port     int    `json:"port"`
+		Path     *struct {
+			Type            string `json:"type"`
+			ReplaceFullPath string `json:"replaceFullPath"`
+		} `json:"path"`
+		StatusCode int `json:"statusCode"`
+	} `json:"requestRedirect"`
+}
+
+type HTTPBackendRef struct {
+	Group     string `json:"group,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+	Port      int    `json:"port"`
+	Weight    *int   `json:"weight"`
+}
+
+// EffectiveWeight returns the weight of the backend, 1 when it is not set.
+func (b *HTTPBackendRef) EffectiveWeight() int {
+	if b.Weight == nil {
+		return 1
+	}
+
+	return *b.Weight
+}
+
+type HTTPRouteRule struct {
+	Matches     []HTTPRouteMatch  `json:"matches"`
+	Filters     []HTTPRouteFilter `json:"filters"`
+	BackendRefs []HTTPBackendRef  `json:"backendRefs"`
+}
+
+type Condition struct {
+	Type               string    `json:"type"`
+	Status             string    `json:"status"`
+	ObservedGeneration int       `json:"observedGeneration"`
+	LastTransitionTime time.Time `json:"lastTransitionTime"`
+	Reason             string    `json:"reason"`
+	Message            string    `json:"message"`
+}
+
+type RouteParentStatus struct {
+	ParentRef      ParentReference `json:"parentRef"`
+	ControllerName string          `json:"controllerName"`
+	Conditions     []Condition     `json:"conditions"`
+}
+
+type HTTPRoute struct {
+	Metadata *kube.Metadata `json:"metadata"`
+	Spec     struct {
+		ParentRefs []ParentReference `json:"parentRefs"`
+		Hostnames  []string          `json:"hostnames"`
+		Rules      []HTTPRouteRule   `json:"rules"`
+	} `json:"spec"`
+	Status struct {
+		Parents []RouteParentStatus `json:"parents"`
+	} `json:"status"`
+}
+
+func (r *HTTPRoute) Name() string {
+	return fmt.Sprintf("%s/%s", r.Metadata.Namespace, r.Metadata.Name)
+}
+
+func (r *HTTPRoute) Meta() *kube.Metadata {
+	return r.Metadata
+}
+
+func (r *HTTPRoute) Reference() *kube.ObjectReference {
+	return &kube.ObjectReference{
+		APIVersion:      "gateway.networking.k8s.io/v1",
+		Kind:            "HTTPRoute",
+		Namespace:       r.Metadata.Namespace,
+		Name:            r.Metadata.Name,
+		UID:             r.Metadata.Uid,
+		ResourceVersion: r.Metadata.ResourceVersion,
+	}
+}
+
+func ClassWatchFunc(r *http.Request) {
+	r.URL.Path = apiPrefix + "/watch/gatewayclasses"
+}
+
+func ClassListFunc(r *http.Request) {
+	r.URL.Path = apiPrefix + "/gatewayclasses"
+}
+
+func WatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath(apiPrefix+"/watch", namespace, "gateways")
+	}
+}
+
+func ListFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath(apiPrefix, namespace, "gateways")
+	}
+}
+
+func RouteWatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath(apiPrefix+"/watch", namespace, "httproutes")
+	}
+}
+
+func RouteListFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath(apiPrefix, namespace, "httproutes")
+	}
+}
+
+func RouteStatusFunc(namespace, name string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = fmt.Sprintf("%s/namespaces/%s/httproutes/%s/status", apiPrefix, namespace, name)
+	}
+}
@@ -2,10 +2,17 @@ package kube
 
 import (
 	"context"
+	"strings"
+	"sync"
 )
 
 type informerHandler[T Object] func(T)
 
+type informerWatch struct {
+	fieldSelector string
+	cancel        context.CancelFunc
+}
+
 type informerRef[T Object] struct {
 	refCount int
 	obj      T
@@ -16,21 +23,31 @@ func (ref *informerRef[T]) add(i int) int {
 	return ref.refCount
 }
 
+// Informer caches referenced objects and keeps them up to date. Only the
+// namespaces holding referenced objects are watched, with a field selector
+// on the object name when a namespace holds a single one.
 type Informer[T Object] struct {
 	Client    Client
 	OnModify  informerHandler[T]
 	OnRelease informerHandler[T]
-	WatchFunc ReadFunc
+	WatchFunc func(namespace string) ReadFunc
+	mu        sync.Mutex
 	ref       map[string]*informerRef[T]
+	ctx       context.Context
+	watches   map[string]*informerWatch
 }
 
 func (i *Informer[T]) Init() {
 	i.ref = make(map[string]*informerRef[T])
+	i.watches = make(map[string]*informerWatch)
 }
 
 func (i *Informer[T]) Get(namespace, name string, readFunc ReadFunc, obj *T) error {
 	fullname := namespace + "/" + name
 
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
 	if ref, ok := i.ref[fullname]; ok {
 		ref.add(1)
 		*obj = ref.obj
@@ -46,32 +63,157 @@ func (i *Informer[T]) Get(namespace, name string, readFunc ReadFunc, obj *T) err
 	ref.add(1)
 
 	i.ref[fullname] = ref
+	i.rewatch(namespace)
 	return nil
 }
 
+// Refs returns the reference counts of the cached objects by full name.
+func (i *Informer[T]) Refs() map[string]int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	refs := make(map[string]int, len(i.ref))
+
+	for fullname, ref := range i.ref {
+		refs[fullname] = ref.refCount
+	}
+
+	return refs
+}
+
+// Lookup returns the cached object without taking a reference.
+func (i *Informer[T]) Lookup(fullname string) (obj T, ok bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if ref, found := i.ref[fullname]; found {
+		return ref.obj, true
+	}
+
+	return
+}
+
 func (i *Informer[T]) Release(namespace, name string) {
 	fullname := namespace + "/" + name
 
-	if ref, ok := i.ref[fullname]; ok {
-		if ref.add(-1) <= 0 {
-			i.OnRelease(ref.obj)
-			delete(i.ref, fullname)
-		}
+	i.mu.Lock()
+
+	ref, ok := i.ref[fullname]
+
+	if !ok || ref.add(-1) > 0 {
+		i.mu.Unlock()
+		return
 	}
+
+	delete(i.ref, fullname)
+	i.rewatch(namespace)
+	i.mu.Unlock()
+
+	i.OnRelease(ref.obj)
 }
 
-func (i *Informer[T]) Run(ctx context.Context) {
-	handler := WatchHandler[T]{
-		Modified: func(obj T) {
-			if ref, ok := i.ref[obj.Name()]; ok {
-				ref.obj = obj
-				i.OnModify(obj)
-			}
-		},
+func (i *Informer[T]) handler() WatchHandler[T] {
+	// the watch has no list to resume from, so it replays the current state
+	// as ADDED events and only objects whose version changed are updated
+	update := func(obj T) {
+		i.mu.Lock()
+
+		ref, ok := i.ref[obj.Name()]
+		changed := ok && ref.obj.Meta().ResourceVersion != obj.Meta().ResourceVersion
+
+		if changed {
+			ref.obj = obj
+		}
+
+		i.mu.Unlock()
+
+		if changed {
+			i.OnModify(obj)
+		}
+	}
+
+	return WatchHandler[T]{
+		Added:    update,
+		Modified: update,
 		Deleted: func(obj T) {
-			delete(i.ref, obj.Name())
+			i.mu.Lock()
+			defer i.mu.Unlock()
+
+			if _, ok := i.ref[obj.Name()]; ok {
+				delete(i.ref, obj.Name())
+				i.rewatch(obj.Meta().Namespace)
+			}
 		},
 	}
+}
+
+// rewatch restarts the watch of a namespace when the objects referenced in
+// it need another selector, it is called with i.mu held.
+func (i *Informer[T]) rewatch(namespace string) {
+	// watches are started by Run
+	if i.ctx == nil {
+		return
+	}
+
+	var names []string
+
+	for fullname := range i.ref {
+		if ns, name, _ := strings.Cut(fullname, "/"); ns == namespace {
+			names = append(names, name)
+		}
+	}
+
+	var fieldSelector string
+
+	if len(names) == 1 {
+		fieldSelector = "metadata.name=" + names[0]
+	}
+
+	w, ok := i.watches[namespace]
+
+	if ok && len(names) > 0 && w.fieldSelector == fieldSelector {
+		return
+	}
+
+	if ok {
+		w.cancel()
+		delete(i.watches, namespace)
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	watchFunc := i.WatchFunc(namespace)
+
+	if fieldSelector != "" {
+		watchFunc = WithQuery(watchFunc, "fieldSelector", fieldSelector)
+	}
+
+	ctx, cancel := context.WithCancel(i.ctx)
+	i.watches[namespace] = &informerWatch{fieldSelector: fieldSelector, cancel: cancel}
+
+	go Watch(ctx, i.Client, watchFunc, "", i.handler())
+}
+
+// Run watches the referenced objects until ctx is done.
+func (i *Informer[T]) Run(ctx context.Context) {
+	i.mu.Lock()
+
+	i.ctx = ctx
+
+	namespaces := map[string]struct{}{}
+
+	for fullname := range i.ref {
+		ns, _, _ := strings.Cut(fullname, "/")
+		namespaces[ns] = struct{}{}
+	}
+
+	for ns := range namespaces {
+		i.rewatch(ns)
+	}
+
+	i.mu.Unlock()
 
-	Watch(ctx, i.Client, i.WatchFunc, handler)
+	<-ctx.Done()
 }
@@ -0,0 +1,84 @@
+package ingress
+
+import (
+	"flag"
+	"ingress-controller/kube"
+	"net/http"
+)
+
+// AnnotationIsDefaultClass marks the IngressClass of Ingresses without a
+// class.
+const AnnotationIsDefaultClass = "ingressclass.kubernetes.io/is-default-class"
+
+var controllerName = flag.String(
+	"controller-class",
+	"github.com/yxwuxuanl/mini-ingress-controller",
+	"spec.controller of the IngressClasses handled by this controller",
+)
+
+type IngressClass struct {
+	Metadata *kube.Metadata `json:"metadata"`
+	Spec     struct {
+		Controller string `json:"controller"`
+	} `json:"spec"`
+}
+
+func (c *IngressClass) Name() string {
+	return c.Metadata.Name
+}
+
+func (c *IngressClass) Meta() *kube.Metadata {
+	return c.Metadata
+}
+
+func (c *IngressClass) IsDefault() bool {
+	return c.Metadata.Annotations[AnnotationIsDefaultClass] == "true"
+}
+
+func ClassWatchFunc(r *http.Request) {
+	r.URL.Path = "/apis/networking.k8s.io/v1/watch/ingressclasses"
+}
+
+func ClassListFunc(r *http.Request) {
+	r.URL.Path = "/apis/networking.k8s.io/v1/ingressclasses"
+}
+
+// Classes is the set of IngressClasses handled by this controller, next to
+// the class named by the -ingress-class flag.
+type Classes struct {
+	names      map[string]struct{}
+	hasDefault bool
+}
+
+func NewClasses(classes []*IngressClass) *Classes {
+	cs := &Classes{names: map[string]struct{}{}}
+
+	for _, class := range classes {
+		if class.Spec.Controller != *controllerName {
+			continue
+		}
+
+		cs.names[class.Name()] = struct{}{}
+
+		if class.IsDefault() {
+			cs.hasDefault = true
+		}
+	}
+
+	if *ingressClassName != "" {
+		cs.names[*ingressClassName] = struct{}{}
+	}
+
+	return cs
+}
+
+func (cs *Classes) Has(name string) bool {
+	_, ok := cs.names[name]
+	return ok
+}
+
+// ControllerName returns the controller name of this controller, as used
+// in IngressClasses and GatewayClasses.
+func ControllerName() string {
+	return *controllerName
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"ingress-controller/kube"
 	"net/http"
+	"strconv"
 )
 
 const AnnotationKubernetesIngressClass = "kubernetes.io/ingress.class"
@@ -25,9 +26,18 @@ type TLS struct {
 type Ingress struct {
 	Metadata *kube.Metadata `json:"metadata"`
 	Spec     struct {
-		Rules []*Rule `json:"rules"`
-		TLS   []*TLS  `json:"tls"`
+		IngressClassName *string `json:"ingressClassName"`
+		// DefaultBackend serves the requests to the hosts of the Ingress
+		// that match none of its paths.
+		DefaultBackend *Backend `json:"defaultBackend"`
+		Rules          []*Rule  `json:"rules"`
+		TLS            []*TLS   `json:"tls"`
 	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []kube.LoadBalancerIngress `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
 }
 
 type Rule struct {
@@ -38,42 +48,90 @@ type Rule struct {
 }
 
 type Path struct {
-	Path     string `json:"path"`
-	PathType string `json:"pathType"`
-	Backend  struct {
-		Service Service `json:"service"`
-	} `json:"backend"`
+	Path     string  `json:"path"`
+	PathType string  `json:"pathType"`
+	Backend  Backend `json:"backend"`
+}
+
+type Backend struct {
+	Service Service `json:"service"`
 }
 
 type Service struct {
 	Name string `json:"name"`
 	Port struct {
-		Number int `json:"number"`
+		Name   string `json:"name"`
+		Number int    `json:"number"`
 	} `json:"port"`
 }
 
+func (s Service) PortString() string {
+	if s.Port.Name != "" {
+		return s.Port.Name
+	}
+
+	return strconv.Itoa(s.Port.Number)
+}
+
 func (i *Ingress) Name() string {
 	return fmt.Sprintf("%s/%s", i.Metadata.Namespace, i.Metadata.Name)
 }
 
-func WatchFunc(r *http.Request) {
-	r.URL.Path = "/apis/networking.k8s.io/v1/watch/ingresses"
+func (i *Ingress) Meta() *kube.Metadata {
+	return i.Metadata
+}
+
+func (i *Ingress) Reference() *kube.ObjectReference {
+	return &kube.ObjectReference{
+		APIVersion:      "networking.k8s.io/v1",
+		Kind:            "Ingress",
+		Namespace:       i.Metadata.Namespace,
+		Name:            i.Metadata.Name,
+		UID:             i.Metadata.Uid,
+		ResourceVersion: i.Metadata.ResourceVersion,
+	}
+}
+
+func WatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/apis/networking.k8s.io/v1/watch", namespace, "ingresses")
+	}
+}
+
+func ListFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/apis/networking.k8s.io/v1", namespace, "ingresses")
+	}
 }
 
-func ListFunc(r *http.Request) {
-	r.URL.Path = "/apis/networking.k8s.io/v1/ingresses"
+func StatusFunc(namespace, name string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = fmt.Sprintf("/apis/networking.k8s.io/v1/namespaces/%s/ingresses/%s/status", namespace, name)
+	}
 }
 
-func FilterIngress(is *Ingress) bool {
-	if *ingressClassName == "" {
-		return true
+// ClassName returns the class of an Ingress from spec.ingressClassName or
+// the deprecated annotation.
+func (i *Ingress) ClassName() (string, bool) {
+	if name := i.Spec.IngressClassName; name != nil {
+		return *name, true
+	}
+
+	if v, ok := i.Metadata.Annotations[AnnotationKubernetesIngressClass]; ok {
+		return v, true
 	}
 
-	if annos := is.Metadata.Annotations; annos != nil {
-		if v, ok := annos[AnnotationKubernetesIngressClass]; ok {
-			return v == *ingressClassName
-		}
+	return "", false
+}
+
+// FilterIngress reports whether an Ingress is handled by this controller.
+// Without the -ingress-class flag and an own IngressClass the Ingresses
+// without a class are handled, as before IngressClasses were supported, but
+// never the Ingresses of other classes.
+func FilterIngress(is *Ingress, classes *Classes) bool {
+	if name, ok := is.ClassName(); ok {
+		return classes.Has(name)
 	}
 
-	return false
+	return classes.hasDefault || (*ingressClassName == "" && len(classes.names) == 0)
 }
@@ -0,0 +1,58 @@
+package ingress
+
+import (
+	"ingress-controller/kube"
+	"testing"
+)
+
+func TestFilterIngress(t *testing.T) {
+	own := &IngressClass{Metadata: &kube.Metadata{Name: "own"}}
+	own.Spec.Controller = *controllerName
+
+	ownDefault := &IngressClass{Metadata: &kube.Metadata{
+		Name:        "own-default",
+		Annotations: map[string]string{AnnotationIsDefaultClass: "true"},
+	}}
+	ownDefault.Spec.Controller = *controllerName
+
+	other := &IngressClass{Metadata: &kube.Metadata{Name: "other"}}
+	other.Spec.Controller = "example.com/other"
+
+	tests := []struct {
+		name      string
+		flag      string
+		classes   []*IngressClass
+		className *string
+		want      bool
+	}{
+		{"no class, no own classes", "", []*IngressClass{other}, nil, true},
+		{"other class, no own classes", "", []*IngressClass{other}, strptr("other"), false},
+		{"unknown class, no own classes", "", nil, strptr("nginx"), false},
+		{"own class", "", []*IngressClass{own, other}, strptr("own"), true},
+		{"other class", "", []*IngressClass{own, other}, strptr("other"), false},
+		{"no class, own class", "", []*IngressClass{own}, nil, false},
+		{"no class, own default class", "", []*IngressClass{ownDefault}, nil, true},
+		{"flag class", "flag", nil, strptr("flag"), true},
+		{"no class, flag", "flag", nil, nil, false},
+		{"other class, flag", "flag", []*IngressClass{other}, strptr("other"), false},
+	}
+
+	defer func(v string) { *ingressClassName = v }(*ingressClassName)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			*ingressClassName = tt.flag
+
+			is := &Ingress{Metadata: &kube.Metadata{Name: "web", Namespace: "default"}}
+			is.Spec.IngressClassName = tt.className
+
+			if got := FilterIngress(is, NewClasses(tt.classes)); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func strptr(s string) *string {
+	return &s
+}
@@ -1,26 +1,41 @@
 package kube
 
 import (
-	"bufio"
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"ingress-controller/metrics"
+	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"time"
 )
 
 const serviceaccountMountPath = "/var/run/secrets/kubernetes.io/serviceaccount"
 
+// listPageSize is the number of objects List reads per request.
+const listPageSize = 500
+
 const (
-	EventAdd    = "ADDED"
-	EventDelete = "DELETED"
-	EventModify = "MODIFIED"
+	EventAdd      = "ADDED"
+	EventDelete   = "DELETED"
+	EventModify   = "MODIFIED"
+	EventBookmark = "BOOKMARK"
+	EventError    = "ERROR"
 )
 
+// ErrGone is returned when the requested resourceVersion is too old to resume
+// a watch from, the caller has to list the resource again.
+var ErrGone = errors.New("kube: resource version expired")
+
 type Object interface {
 	Name() string
+	Meta() *Metadata
 }
 
 type Metadata struct {
@@ -30,20 +45,190 @@ type Metadata struct {
 	ResourceVersion   string            `json:"resourceVersion"`
 	Generation        int               `json:"generation"`
 	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	Labels            map[string]string `json:"labels"`
 	Annotations       map[string]string `json:"annotations"`
 }
 
+// IntOrString holds a value that is either a number or a name, like the
+// targetPort of a Service port.
+type IntOrString struct {
+	IntVal int
+	StrVal string
+}
+
+func (v *IntOrString) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &v.StrVal)
+	}
+
+	return json.Unmarshal(b, &v.IntVal)
+}
+
+func (v IntOrString) MarshalJSON() ([]byte, error) {
+	if v.StrVal != "" {
+		return json.Marshal(v.StrVal)
+	}
+
+	return json.Marshal(v.IntVal)
+}
+
+func (v IntOrString) String() string {
+	if v.StrVal != "" {
+		return v.StrVal
+	}
+
+	return strconv.Itoa(v.IntVal)
+}
+
+// ObjectReference points to an object, e.g. the object an Event is about.
+type ObjectReference struct {
+	APIVersion      string `json:"apiVersion,omitempty"`
+	Kind            string `json:"kind,omitempty"`
+	Namespace       string `json:"namespace,omitempty"`
+	Name            string `json:"name,omitempty"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// LoadBalancerIngress is an address of a load balancer, as published in the
+// status of Services and Ingresses.
+type LoadBalancerIngress struct {
+	IP       string `json:"ip,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// StatusError is returned when the apiserver answers with an unexpected
+// status code.
+type StatusError struct {
+	Code   int
+	Status string
+}
+
+func (e *StatusError) Error() string {
+	return "http: " + e.Status
+}
+
+func IsNotFound(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusNotFound
+}
+
+func IsConflict(err error) bool {
+	var statusErr *StatusError
+	return errors.As(err, &statusErr) && statusErr.Code == http.StatusConflict
+}
+
+type ListMeta struct {
+	ResourceVersion string `json:"resourceVersion"`
+	Continue        string `json:"continue"`
+}
+
+type Status struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
 type ReadFunc func(r *http.Request)
 
-type Event[T Object] struct {
-	Type   string `json:"type"`
-	Object T      `json:"object"`
+// WithQuery returns a ReadFunc that sets the query parameter key on the
+// request of f, e.g. a label or field selector.
+func WithQuery(f ReadFunc, key, value string) ReadFunc {
+	return func(r *http.Request) {
+		f(r)
+
+		query := r.URL.Query()
+		query.Set(key, value)
+		r.URL.RawQuery = query.Encode()
+	}
+}
+
+// ClusterScoped adapts the ReadFunc of a cluster-scoped resource to the
+// namespaced ReadFuncs of a Store.
+func ClusterScoped(f ReadFunc) func(namespace string) ReadFunc {
+	return func(string) ReadFunc {
+		return f
+	}
+}
+
+// CollectionPath returns the path of the resource collection under prefix
+// in namespace, or across all namespaces when namespace is "".
+func CollectionPath(prefix, namespace, resource string) string {
+	if namespace == "" {
+		return prefix + "/" + resource
+	}
+
+	return prefix + "/namespaces/" + namespace + "/" + resource
+}
+
+// MatchLabels reports whether labels match an equality-based label
+// selector, e.g. "tier=public,!canary". ok is false when the selector uses
+// set-based requirements, which are only evaluated by the apiserver.
+func MatchLabels(selector string, labels map[string]string) (match, ok bool) {
+	match = true
+
+	for _, req := range strings.Split(selector, ",") {
+		req = strings.TrimSpace(req)
+
+		if req == "" {
+			continue
+		}
+
+		if strings.ContainsAny(req, "() ") {
+			return false, false
+		}
+
+		var (
+			key, value string
+			negate     bool
+		)
+
+		switch {
+		case strings.Contains(req, "!="):
+			key, value, _ = strings.Cut(req, "!=")
+			negate = true
+		case strings.Contains(req, "=="):
+			key, value, _ = strings.Cut(req, "==")
+		case strings.Contains(req, "="):
+			key, value, _ = strings.Cut(req, "=")
+		case strings.HasPrefix(req, "!"):
+			if _, has := labels[req[1:]]; has {
+				match = false
+			}
+
+			continue
+		default:
+			if _, has := labels[req]; !has {
+				match = false
+			}
+
+			continue
+		}
+
+		v, has := labels[key]
+
+		if negate == (has && v == value) {
+			match = false
+		}
+	}
+
+	return match, true
+}
+
+type Event struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
 }
 
 type WatchHandler[T Object] struct {
 	Added    func(T)
 	Deleted  func(T)
 	Modified func(T)
+	// Relist is called when the watch can not be resumed because its
+	// resourceVersion has expired. It lists the resource again, reconciles
+	// the handler state against it and returns the list resourceVersion.
+	// Without Relist the watch restarts from the current state.
+	Relist func() (string, error)
 }
 
 func newRequest() *http.Request {
@@ -53,35 +238,84 @@ func newRequest() *http.Request {
 	return r
 }
 
-func List[T Object](client Client, listFunc ReadFunc, items *[]T) error {
+// listPage reads a page of at most listPageSize objects, starting at the
+// continue token.
+func listPage[T Object](client Client, listFunc ReadFunc, continueToken string) (*ListMeta, []T, error) {
 	r := newRequest()
 	listFunc(r)
 
+	query := r.URL.Query()
+	query.Set("limit", strconv.Itoa(listPageSize))
+
+	if continueToken != "" {
+		query.Set("continue", continueToken)
+	}
+
+	r.URL.RawQuery = query.Encode()
+
 	res, err := client.Do(r)
 
 	log.Printf("kube: list %s", r.URL.Path)
 
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	if res.StatusCode != http.StatusOK {
-		return errors.New("list: http: " + res.Status)
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusGone {
+		return nil, nil, ErrGone
 	}
 
-	dec := json.NewDecoder(res.Body)
-	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, nil, errors.New("list: http: " + res.Status)
+	}
 
 	list := new(struct {
-		Items []T `json:"items"`
+		Metadata ListMeta `json:"metadata"`
+		Items    []T      `json:"items"`
 	})
 
-	if err := dec.Decode(list); err != nil {
-		return err
+	if err := json.NewDecoder(res.Body).Decode(list); err != nil {
+		return nil, nil, err
 	}
 
-	*items = list.Items
-	return nil
+	return &list.Metadata, list.Items, nil
+}
+
+// List reads all objects of a resource page by page, calling add with every
+// object, and returns the resourceVersion of the list, which a following
+// Watch resumes from. The pages of a list are a consistent snapshot, when
+// its continue token expires before the last page the list starts over from
+// a new snapshot and reset is called to drop the objects added so far.
+func List[T Object](client Client, listFunc ReadFunc, reset func(), add func(T)) (string, error) {
+	var continueToken string
+
+	for {
+		meta, items, err := listPage[T](client, listFunc, continueToken)
+
+		if errors.Is(err, ErrGone) && continueToken != "" {
+			log.Printf("kube: list: continue token expired, restarting")
+
+			continueToken = ""
+			reset()
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		for _, obj := range items {
+			add(obj)
+		}
+
+		if meta.Continue == "" {
+			return meta.ResourceVersion, nil
+		}
+
+		continueToken = meta.Continue
+	}
 }
 
 func Get[T Object](client Client, listFunc ReadFunc, obj T) error {
@@ -95,85 +329,238 @@ func Get[T Object](client Client, listFunc ReadFunc, obj T) error {
 		return err
 	}
 
+	defer res.Body.Close()
+
 	if res.StatusCode != http.StatusOK {
-		return errors.New("http: " + res.Status)
+		return &StatusError{Code: res.StatusCode, Status: res.Status}
 	}
 
-	defer res.Body.Close()
 	return json.NewDecoder(res.Body).Decode(obj)
 }
 
+// write sends body as JSON with method and decodes the response into out
+// when it is not nil.
+func write(client Client, method, contentType string, reqFunc ReadFunc, body, out interface{}) error {
+	data, err := json.Marshal(body)
+
+	if err != nil {
+		return err
+	}
+
+	r := newRequest()
+	reqFunc(r)
+
+	r.Method = method
+	r.Header.Set("Content-Type", contentType)
+	r.Body = io.NopCloser(bytes.NewReader(data))
+	r.ContentLength = int64(len(data))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(data)), nil
+	}
+
+	res, err := client.Do(r)
+	log.Printf("kube: %s %s", strings.ToLower(method), r.URL.Path)
+
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return &StatusError{Code: res.StatusCode, Status: res.Status}
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+// Create posts obj to the collection selected by createFunc and decodes the
+// created object into obj.
+func Create[T Object](client Client, createFunc ReadFunc, obj T) error {
+	return write(client, http.MethodPost, "application/json", createFunc, obj, obj)
+}
+
+// Update replaces the object selected by updateFunc with obj, it fails with
+// a 409 StatusError when obj has an outdated resourceVersion.
+func Update[T Object](client Client, updateFunc ReadFunc, obj T) error {
+	return write(client, http.MethodPut, "application/json", updateFunc, obj, obj)
+}
+
+// Patch sends a JSON merge patch to the object selected by patchFunc.
+func Patch(client Client, patchFunc ReadFunc, patch interface{}) error {
+	return write(client, http.MethodPatch, "application/merge-patch+json", patchFunc, patch, nil)
+}
+
+var (
+	watchReconnects = metrics.NewCounter("watch_reconnects_total", "Watches started again after they ended, by resource.", "resource")
+	watchEvents     = metrics.NewCounter("watch_events_total", "Watch events received, by resource and type.", "resource", "type")
+)
+
+// Watch streams events of a resource to handler, starting after
+// resourceVersion. The watch is resumed from the last seen resourceVersion
+// when the connection breaks, and handler.Relist is used to recover when that
+// version has expired. Watch returns when ctx is done.
 func Watch[T Object](
 	ctx context.Context,
 	client Client,
 	watchFunc ReadFunc,
+	resourceVersion string,
 	handler WatchHandler[T],
 ) {
-	eventCh := make(chan Event[T])
-	defer close(eventCh)
+	dispatch := func(event *Event) error {
+		if event.Type == EventError {
+			status := new(Status)
+
+			if err := json.Unmarshal(event.Object, status); err != nil {
+				return errors.New("watch: unmarshal status: " + err.Error())
+			}
+
+			if status.Code == http.StatusGone {
+				return ErrGone
+			}
+
+			return fmt.Errorf("watch: %s: %s", status.Reason, status.Message)
+		}
+
+		var obj T
+
+		if err := json.Unmarshal(event.Object, &obj); err != nil {
+			log.Printf("kube: watch: unmarshal object: %s", err)
+			return nil
+		}
+
+		if mt := obj.Meta(); mt != nil && mt.ResourceVersion != "" {
+			resourceVersion = mt.ResourceVersion
+		}
+
+		switch event.Type {
+		case EventModify:
+			if handler.Modified != nil {
+				handler.Modified(obj)
+			}
+		case EventAdd:
+			if handler.Added != nil {
+				handler.Added(obj)
+			}
+		case EventDelete:
+			if handler.Deleted != nil {
+				handler.Deleted(obj)
+			}
+		}
+
+		return nil
+	}
+
+	r := newRequest()
+	watchFunc(r)
+	resource := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
 
 	doWatch := func() error {
 		r := newRequest()
 		watchFunc(r)
 
-		log.Printf("kube: watch %s", r.URL.Path)
+		query := r.URL.Query()
+		query.Set("allowWatchBookmarks", "true")
+
+		if resourceVersion != "" {
+			query.Set("resourceVersion", resourceVersion)
+		}
+
+		r.URL.RawQuery = query.Encode()
+
+		log.Printf("kube: watch %s, resourceVersion=%s", r.URL.Path, resourceVersion)
 		res, err := client.Do(r.WithContext(ctx))
 
 		if err != nil {
 			return err
 		}
 
+		defer res.Body.Close()
+
+		if res.StatusCode == http.StatusGone {
+			return ErrGone
+		}
+
 		if res.StatusCode != http.StatusOK {
 			return errors.New("http: " + res.Status)
 		}
 
-		reader := bufio.NewReader(res.Body)
-		defer res.Body.Close()
+		dec := json.NewDecoder(res.Body)
 
 		for {
-			chunk, _, err := reader.ReadLine()
+			event := new(Event)
 
-			if err != nil {
+			if err := dec.Decode(event); err != nil {
 				return err
 			}
 
-			event := Event[T]{}
+			watchEvents.Inc(resource, event.Type)
 
-			if err := json.Unmarshal(chunk, &event); err != nil {
-				err = errors.New("watch: unmarshal event: " + err.Error())
-				continue
+			if err := dispatch(event); err != nil {
+				return err
 			}
+		}
+	}
 
-			eventCh <- event
+	sleep := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(time.Second * 5):
+			return true
 		}
 	}
 
-	go func() {
-		for event := range eventCh {
-			switch event.Type {
-			case EventModify:
-				if handler.Modified != nil {
-					handler.Modified(event.Object)
-				}
-			case EventAdd:
-				if handler.Added != nil {
-					handler.Added(event.Object)
-				}
-			case EventDelete:
-				if handler.Deleted != nil {
-					handler.Deleted(event.Object)
+	var relist, started bool
+
+	for {
+		if started {
+			watchReconnects.Inc(resource)
+		}
+
+		started = true
+
+		if relist {
+			rv, err := handler.Relist()
+
+			if err != nil {
+				log.Printf("kube: relist: %s", err)
+
+				if sleep() {
+					continue
 				}
+
+				return
 			}
+
+			resourceVersion = rv
+			relist = false
 		}
-	}()
 
-	for {
-		if err := doWatch(); !errors.Is(err, context.Canceled) {
-			log.Printf("kube: watch: %s", err)
-			time.Sleep(time.Second * 5)
-			continue
+		err := doWatch()
+
+		if ctx.Err() != nil {
+			return
 		}
 
-		return
+		switch {
+		case errors.Is(err, ErrGone):
+			log.Printf("kube: watch: resourceVersion %s expired", resourceVersion)
+
+			resourceVersion = ""
+			relist = handler.Relist != nil
+		case errors.Is(err, io.EOF):
+			// the apiserver closes watches after a timeout, resume right away
+		default:
+			log.Printf("kube: watch: %s", err)
+
+			if !sleep() {
+				return
+			}
+		}
 	}
 }
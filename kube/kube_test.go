@@ -0,0 +1,317 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testObject struct {
+	Metadata *Metadata `json:"metadata"`
+}
+
+func (o *testObject) Name() string {
+	return o.Metadata.Namespace + "/" + o.Metadata.Name
+}
+
+func (o *testObject) Meta() *Metadata {
+	return o.Metadata
+}
+
+func newTestObject(namespace, name, resourceVersion string) *testObject {
+	return &testObject{Metadata: &Metadata{Namespace: namespace, Name: name, ResourceVersion: resourceVersion}}
+}
+
+// fakeAPIClient answers requests with its responses in order, a request
+// beyond them blocks until its context is done.
+type fakeAPIClient struct {
+	mu        sync.Mutex
+	responses []*http.Response
+	queries   []url.Values
+	// idle is closed when the responses ran out
+	idle chan struct{}
+}
+
+func newFakeAPIClient(responses ...*http.Response) *fakeAPIClient {
+	return &fakeAPIClient{responses: responses, idle: make(chan struct{})}
+}
+
+func (f *fakeAPIClient) Do(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	f.queries = append(f.queries, r.URL.Query())
+
+	if len(f.responses) == 0 {
+		close(f.idle)
+		f.mu.Unlock()
+
+		<-r.Context().Done()
+		return nil, r.Context().Err()
+	}
+
+	res := f.responses[0]
+	f.responses = f.responses[1:]
+	f.mu.Unlock()
+
+	return res, nil
+}
+
+// watchStream returns a watch response streaming events, the watch ends
+// after the last one.
+func watchStream(events ...string) *http.Response {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       io.NopCloser(strings.NewReader(strings.Join(events, "\n"))),
+	}
+}
+
+func watchEvent(typ, name, resourceVersion string) string {
+	data, _ := json.Marshal(Event{Type: typ, Object: mustMarshal(newTestObject("default", name, resourceVersion))})
+	return string(data)
+}
+
+func mustMarshal(v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return data
+}
+
+func listPageResponse(resourceVersion, continueToken string, items ...*testObject) *http.Response {
+	return respond(http.StatusOK, map[string]interface{}{
+		"metadata": ListMeta{ResourceVersion: resourceVersion, Continue: continueToken},
+		"items":    items,
+	})
+}
+
+func testReadFunc(r *http.Request) {
+	r.URL.Path = "/api/v1/tests"
+}
+
+func TestWatch(t *testing.T) {
+	expired := func() string {
+		data, _ := json.Marshal(Event{Type: EventError, Object: mustMarshal(Status{Code: http.StatusGone, Reason: "Expired"})})
+		return string(data)
+	}()
+
+	tests := []struct {
+		name      string
+		responses []*http.Response
+		relist    bool
+		// versions are the resourceVersions the watches start from
+		versions []string
+		events   []string
+		relists  int
+	}{
+		{
+			name: "resume after the last event",
+			responses: []*http.Response{
+				watchStream(watchEvent(EventAdd, "a", "4"), watchEvent(EventModify, "a", "5")),
+				watchStream(watchEvent(EventDelete, "a", "6")),
+			},
+			versions: []string{"3", "5", "6"},
+			events:   []string{"ADDED a", "MODIFIED a", "DELETED a"},
+		},
+		{
+			name: "resume after a bookmark",
+			responses: []*http.Response{
+				watchStream(watchEvent(EventAdd, "a", "4"), watchEvent(EventBookmark, "", "9")),
+			},
+			versions: []string{"3", "9"},
+			events:   []string{"ADDED a"},
+		},
+		{
+			name: "expired by an error event",
+			responses: []*http.Response{
+				watchStream(watchEvent(EventAdd, "a", "4"), expired),
+			},
+			relist:   true,
+			versions: []string{"3", "20"},
+			events:   []string{"ADDED a"},
+			relists:  1,
+		},
+		{
+			name: "expired by 410",
+			responses: []*http.Response{
+				respond(http.StatusGone, nil),
+			},
+			relist:   true,
+			versions: []string{"3", "20"},
+			relists:  1,
+		},
+		{
+			name: "expired without relist",
+			responses: []*http.Response{
+				respond(http.StatusGone, nil),
+			},
+			versions: []string{"3", ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeAPIClient(tt.responses...)
+
+			var (
+				events  []string
+				relists int
+			)
+
+			record := func(typ string) func(*testObject) {
+				return func(obj *testObject) {
+					events = append(events, typ+" "+obj.Metadata.Name)
+				}
+			}
+
+			handler := WatchHandler[*testObject]{
+				Added:    record(EventAdd),
+				Modified: record(EventModify),
+				Deleted:  record(EventDelete),
+			}
+
+			if tt.relist {
+				handler.Relist = func() (string, error) {
+					relists++
+					return "20", nil
+				}
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+
+			go func() {
+				Watch(ctx, client, testReadFunc, "3", handler)
+				close(done)
+			}()
+
+			select {
+			case <-client.idle:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the watch did not consume the responses")
+			}
+
+			cancel()
+			<-done
+
+			var versions []string
+
+			for _, query := range client.queries {
+				if query.Get("allowWatchBookmarks") != "true" {
+					t.Errorf("watch without bookmarks: %v", query)
+				}
+
+				versions = append(versions, query.Get("resourceVersion"))
+			}
+
+			if strings.Join(versions, ",") != strings.Join(tt.versions, ",") {
+				t.Errorf("watched from %q, want %q", versions, tt.versions)
+			}
+
+			if strings.Join(events, ",") != strings.Join(tt.events, ",") {
+				t.Errorf("got events %v, want %v", events, tt.events)
+			}
+
+			if relists != tt.relists {
+				t.Errorf("relisted %d times, want %d", relists, tt.relists)
+			}
+		})
+	}
+}
+
+func TestList(t *testing.T) {
+	tests := []struct {
+		name      string
+		responses []*http.Response
+		// continues are the continue tokens of the requests
+		continues       []string
+		resourceVersion string
+		objects         []string
+		resets          int
+		err             error
+	}{
+		{
+			name: "pages",
+			responses: []*http.Response{
+				listPageResponse("5", "c1", newTestObject("default", "a", "1"), newTestObject("default", "b", "2")),
+				listPageResponse("5", "c2", newTestObject("default", "c", "3")),
+				listPageResponse("5", ""),
+			},
+			continues:       []string{"", "c1", "c2"},
+			resourceVersion: "5",
+			objects:         []string{"a", "b", "c"},
+		},
+		{
+			name: "expired continue token",
+			responses: []*http.Response{
+				listPageResponse("5", "c1", newTestObject("default", "a", "1")),
+				respond(http.StatusGone, nil),
+				listPageResponse("9", "c3", newTestObject("default", "a", "7")),
+				listPageResponse("9", "", newTestObject("default", "c", "8")),
+			},
+			continues:       []string{"", "c1", "", "c3"},
+			resourceVersion: "9",
+			objects:         []string{"a", "c"},
+			resets:          1,
+		},
+		{
+			name:      "expired first page",
+			responses: []*http.Response{respond(http.StatusGone, nil)},
+			continues: []string{""},
+			err:       ErrGone,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newFakeAPIClient(tt.responses...)
+
+			var (
+				objects []string
+				resets  int
+			)
+
+			reset := func() {
+				resets++
+				objects = nil
+			}
+
+			add := func(obj *testObject) {
+				objects = append(objects, obj.Metadata.Name)
+			}
+
+			resourceVersion, err := List(client, testReadFunc, reset, add)
+
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+
+			var continues []string
+
+			for _, query := range client.queries {
+				if query.Get("limit") != "500" {
+					t.Errorf("list without limit: %v", query)
+				}
+
+				continues = append(continues, query.Get("continue"))
+			}
+
+			if strings.Join(continues, ",") != strings.Join(tt.continues, ",") {
+				t.Errorf("continued from %q, want %q", continues, tt.continues)
+			}
+
+			if resourceVersion != tt.resourceVersion || strings.Join(objects, ",") != strings.Join(tt.objects, ",") || resets != tt.resets {
+				t.Errorf("got %s %v after %d resets, want %s %v after %d", resourceVersion, objects, resets, tt.resourceVersion, tt.objects, tt.resets)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package kube
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Clusters       []struct {
+		Name    string            `yaml:"name"`
+		Cluster kubeconfigCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string         `yaml:"name"`
+		User kubeconfigUser `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+type kubeconfigCluster struct {
+	Server                   string `yaml:"server"`
+	TLSServerName            string `yaml:"tls-server-name"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+}
+
+type kubeconfigUser struct {
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	Username              string `yaml:"username"`
+	Password              string `yaml:"password"`
+	Exec                  *struct {
+		APIVersion string   `yaml:"apiVersion"`
+		Command    string   `yaml:"command"`
+		Args       []string `yaml:"args"`
+		Env        []struct {
+			Name  string `yaml:"name"`
+			Value string `yaml:"value"`
+		} `yaml:"env"`
+	} `yaml:"exec"`
+}
+
+// execCredential is the output of an exec credential plugin.
+type execCredential struct {
+	Status struct {
+		Token                 string     `json:"token"`
+		ClientCertificateData string     `json:"clientCertificateData"`
+		ClientKeyData         string     `json:"clientKeyData"`
+		ExpirationTimestamp   *time.Time `json:"expirationTimestamp"`
+	} `json:"status"`
+}
+
+// KubeconfigClient talks to the cluster of the current context of a
+// kubeconfig file.
+type KubeconfigClient struct {
+	server   *url.URL
+	client   *http.Client
+	dir      string
+	user     kubeconfigUser
+	mu       sync.Mutex
+	cred     *execCredential
+	credCert *tls.Certificate
+}
+
+// readData returns inline base64 data, or the content of file relative to
+// the kubeconfig directory.
+func (k *KubeconfigClient) readData(data, file string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+
+	if file == "" {
+		return nil, nil
+	}
+
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(k.dir, file)
+	}
+
+	return os.ReadFile(file)
+}
+
+// execCredential runs the exec plugin of the user, its credential is
+// cached until it expires or is invalidated after a 401.
+func (k *KubeconfigClient) execCredential() (*execCredential, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.cred != nil {
+		if exp := k.cred.Status.ExpirationTimestamp; exp == nil || time.Now().Before(*exp) {
+			return k.cred, nil
+		}
+	}
+
+	plugin := k.user.Exec
+
+	cmd := exec.Command(plugin.Command, plugin.Args...)
+	cmd.Env = os.Environ()
+	cmd.Stderr = os.Stderr
+
+	for _, env := range plugin.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+
+	cmd.Env = append(cmd.Env, fmt.Sprintf(
+		`KUBERNETES_EXEC_INFO={"apiVersion":%q,"kind":"ExecCredential","spec":{"interactive":false}}`,
+		plugin.APIVersion,
+	))
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return nil, fmt.Errorf("kubeconfig: exec %s: %s", plugin.Command, err)
+	}
+
+	cred := new(execCredential)
+
+	if err := json.Unmarshal(out, cred); err != nil {
+		return nil, fmt.Errorf("kubeconfig: exec %s: %s", plugin.Command, err)
+	}
+
+	k.credCert = nil
+
+	if cred.Status.ClientCertificateData != "" {
+		cert, err := tls.X509KeyPair([]byte(cred.Status.ClientCertificateData), []byte(cred.Status.ClientKeyData))
+
+		if err != nil {
+			return nil, fmt.Errorf("kubeconfig: exec %s: %s", plugin.Command, err)
+		}
+
+		k.credCert = &cert
+	}
+
+	k.cred = cred
+	return cred, nil
+}
+
+func (k *KubeconfigClient) invalidateCredential() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.cred = nil
+}
+
+func (k *KubeconfigClient) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if _, err := k.execCredential(); err != nil {
+		return nil, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.credCert == nil {
+		return new(tls.Certificate), nil
+	}
+
+	return k.credCert, nil
+}
+
+func (k *KubeconfigClient) authorize(r *http.Request) error {
+	user := k.user
+
+	switch {
+	case user.Exec != nil:
+		cred, err := k.execCredential()
+
+		if err != nil {
+			return err
+		}
+
+		if cred.Status.Token != "" {
+			r.Header.Set("Authorization", "Bearer "+cred.Status.Token)
+		}
+	case user.TokenFile != "":
+		token, err := k.readData("", user.TokenFile)
+
+		if err != nil {
+			return err
+		}
+
+		r.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	case user.Token != "":
+		r.Header.Set("Authorization", "Bearer "+user.Token)
+	case user.Username != "":
+		r.SetBasicAuth(user.Username, user.Password)
+	}
+
+	return nil
+}
+
+func (k *KubeconfigClient) Do(r *http.Request) (*http.Response, error) {
+	// the caller may send r again, e.g. after a 410 Gone
+	r = r.Clone(r.Context())
+	r.URL.Scheme = k.server.Scheme
+	r.URL.Host = k.server.Host
+	r.URL.Path = strings.TrimSuffix(k.server.Path, "/") + r.URL.Path
+
+	if err := k.authorize(r); err != nil {
+		return nil, err
+	}
+
+	res, err := k.client.Do(r)
+
+	// the credential of an exec plugin may be revoked before it expires
+	if err == nil && res.StatusCode == http.StatusUnauthorized && k.user.Exec != nil && (r.Body == nil || r.GetBody != nil) {
+		res.Body.Close()
+		k.invalidateCredential()
+
+		retry := r.Clone(r.Context())
+
+		if r.GetBody != nil {
+			if retry.Body, err = r.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		if err = k.authorize(retry); err != nil {
+			return nil, err
+		}
+
+		return k.client.Do(retry)
+	}
+
+	return res, err
+}
+
+func loadKubeconfig(path string) (*kubeconfig, error) {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	conf := new(kubeconfig)
+
+	if err := yaml.NewDecoder(bytes.NewReader(data)).Decode(conf); err != nil {
+		return nil, fmt.Errorf("kubeconfig: %s: %s", path, err)
+	}
+
+	return conf, nil
+}
+
+// NewKubeconfigClient creates a client for the current context of the
+// kubeconfig at path, or of the first file of $KUBECONFIG when path is
+// empty.
+func NewKubeconfigClient(path string) *KubeconfigClient {
+	if path == "" {
+		path = strings.Split(os.Getenv("KUBECONFIG"), string(os.PathListSeparator))[0]
+	}
+
+	if path == "" {
+		panic("kubeconfig: no kubeconfig")
+	}
+
+	k, err := newKubeconfigClient(path)
+
+	if err != nil {
+		panic(err)
+	}
+
+	return k
+}
+
+func newKubeconfigClient(path string) (*KubeconfigClient, error) {
+	conf, err := loadKubeconfig(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var clusterName, userName string
+
+	for _, c := range conf.Contexts {
+		if c.Name == conf.CurrentContext {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+
+	if clusterName == "" {
+		return nil, fmt.Errorf("kubeconfig: context %q not found", conf.CurrentContext)
+	}
+
+	k := &KubeconfigClient{dir: filepath.Dir(path)}
+
+	var cluster *kubeconfigCluster
+
+	for i := range conf.Clusters {
+		if conf.Clusters[i].Name == clusterName {
+			cluster = &conf.Clusters[i].Cluster
+		}
+	}
+
+	if cluster == nil {
+		return nil, fmt.Errorf("kubeconfig: cluster %q not found", clusterName)
+	}
+
+	for _, u := range conf.Users {
+		if u.Name == userName {
+			k.user = u.User
+		}
+	}
+
+	if k.server, err = url.Parse(cluster.Server); err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		ServerName:         cluster.TLSServerName,
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+	}
+
+	if ca, err := k.readData(cluster.CertificateAuthorityData, cluster.CertificateAuthority); err != nil {
+		return nil, err
+	} else if ca != nil {
+		tlsConfig.RootCAs = x509.NewCertPool()
+
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, errors.New("kubeconfig: invalid certificate authority")
+		}
+	}
+
+	if k.user.Exec != nil {
+		tlsConfig.GetClientCertificate = k.getClientCertificate
+	} else {
+		crt, err := k.readData(k.user.ClientCertificateData, k.user.ClientCertificate)
+
+		if err != nil {
+			return nil, err
+		}
+
+		key, err := k.readData(k.user.ClientKeyData, k.user.ClientKey)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if crt != nil {
+			cert, err := tls.X509KeyPair(crt, key)
+
+			if err != nil {
+				return nil, err
+			}
+
+			tlsConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	k.client = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tlsConfig,
+		},
+	}
+
+	return k, nil
+}
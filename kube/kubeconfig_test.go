@@ -0,0 +1,497 @@
+package kube
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCert returns a self-signed certificate and its key in PEM.
+func testCert(t *testing.T) (crt, key []byte) {
+	t.Helper()
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "tester"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(priv)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+// seenRequest is what the test apiserver received.
+type seenRequest struct {
+	path          string
+	authorization string
+	body          string
+	clientCert    string
+}
+
+// testAPIServer answers 401 to the tokens of unauthorized and 200 else.
+type testAPIServer struct {
+	*httptest.Server
+	mu           sync.Mutex
+	seen         []seenRequest
+	unauthorized map[string]bool
+}
+
+func newTestAPIServer(t *testing.T) *testAPIServer {
+	s := &testAPIServer{unauthorized: map[string]bool{}}
+
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		seen := seenRequest{
+			path:          r.URL.Path,
+			authorization: r.Header.Get("Authorization"),
+			body:          string(body),
+		}
+
+		if len(r.TLS.PeerCertificates) > 0 {
+			seen.clientCert = r.TLS.PeerCertificates[0].Subject.CommonName
+		}
+
+		s.mu.Lock()
+		s.seen = append(s.seen, seen)
+		unauthorized := s.unauthorized[seen.authorization]
+		s.mu.Unlock()
+
+		if unauthorized {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Write([]byte("{}"))
+	}))
+
+	s.TLS = &tls.Config{ClientAuth: tls.RequestClientCert}
+	s.StartTLS()
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func (s *testAPIServer) caPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+}
+
+func writeFile(t *testing.T, dir, name string, data []byte, perm os.FileMode) string {
+	t.Helper()
+
+	file := filepath.Join(dir, name)
+
+	if err := os.WriteFile(file, data, perm); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+// kubeconfigFixture has the contexts "token", "other", "file" and "exec",
+// user holds the user config of the context under test.
+const kubeconfigFixture = `apiVersion: v1
+kind: Config
+current-context: %s
+clusters:
+- name: test
+  cluster:
+    server: %s/prefix
+    certificate-authority-data: %s
+- name: test-file-ca
+  cluster:
+    server: %s
+    certificate-authority: ca.crt
+- name: other
+  cluster:
+    server: https://other.invalid
+    insecure-skip-tls-verify: true
+contexts:
+- name: other
+  context:
+    cluster: other
+    user: other
+- name: test
+  context:
+    cluster: test
+    user: test
+- name: test-file-ca
+  context:
+    cluster: test-file-ca
+    user: test
+- name: missing-cluster
+  context:
+    cluster: missing
+    user: test
+users:
+- name: other
+  user:
+    token: other-token
+- name: test
+  user:
+%s
+`
+
+func TestKubeconfigClient(t *testing.T) {
+	crt, key := testCert(t)
+
+	tests := []struct {
+		name    string
+		context string
+		// user is the YAML of the user of the context, files are
+		// relative to the directory of the kubeconfig
+		user      string
+		files     map[string]string
+		wantErr   bool
+		wantDoErr bool
+		wantAuth  string
+		wantCert  string
+	}{
+		{
+			name:     "token",
+			context:  "test",
+			user:     "    token: abc",
+			wantAuth: "Bearer abc",
+		},
+		{
+			name:     "token file",
+			context:  "test",
+			user:     "    tokenFile: token",
+			files:    map[string]string{"token": "from-file\n"},
+			wantAuth: "Bearer from-file",
+		},
+		{
+			name:     "basic auth",
+			context:  "test",
+			user:     "    username: admin\n    password: secret",
+			wantAuth: "Basic " + base64.StdEncoding.EncodeToString([]byte("admin:secret")),
+		},
+		{
+			name:    "client certificate data",
+			context: "test",
+			user: fmt.Sprintf("    client-certificate-data: %s\n    client-key-data: %s",
+				base64.StdEncoding.EncodeToString(crt), base64.StdEncoding.EncodeToString(key)),
+			wantCert: "tester",
+		},
+		{
+			name:     "client certificate files",
+			context:  "test",
+			user:     "    client-certificate: client.crt\n    client-key: client.key",
+			files:    map[string]string{"client.crt": string(crt), "client.key": string(key)},
+			wantCert: "tester",
+		},
+		{
+			name:     "certificate authority file",
+			context:  "test-file-ca",
+			user:     "    token: abc",
+			wantAuth: "Bearer abc",
+		},
+		{
+			name:      "missing token file",
+			context:   "test",
+			user:      "    tokenFile: missing",
+			wantDoErr: true,
+		},
+		{
+			name:    "missing context",
+			context: "missing",
+			user:    "    token: abc",
+			wantErr: true,
+		},
+		{
+			name:    "missing cluster",
+			context: "missing-cluster",
+			user:    "    token: abc",
+			wantErr: true,
+		},
+		{
+			name:    "invalid client certificate",
+			context: "test",
+			user:    "    client-certificate-data: " + base64.StdEncoding.EncodeToString([]byte("invalid")),
+			wantErr: true,
+		},
+	}
+
+	server := newTestAPIServer(t)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			writeFile(t, dir, "ca.crt", server.caPEM(), 0600)
+
+			for name, content := range tt.files {
+				writeFile(t, dir, name, []byte(content), 0600)
+			}
+
+			conf := fmt.Sprintf(kubeconfigFixture,
+				tt.context,
+				server.URL, base64.StdEncoding.EncodeToString(server.caPEM()),
+				server.URL,
+				tt.user,
+			)
+
+			k, err := newKubeconfigClient(writeFile(t, dir, "config", []byte(conf), 0600))
+
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("newKubeconfigClient() succeeded, want an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := newRequest()
+			r.URL.Path = "/api/v1/namespaces"
+
+			server.mu.Lock()
+			server.seen = nil
+			server.mu.Unlock()
+
+			res, err := k.Do(r)
+
+			if tt.wantDoErr {
+				if err == nil {
+					res.Body.Close()
+					t.Fatal("Do() succeeded without the token file")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res.Body.Close()
+
+			if res.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", res.StatusCode)
+			}
+
+			seen := server.seen[0]
+
+			if seen.authorization != tt.wantAuth {
+				t.Errorf("Authorization = %q, want %q", seen.authorization, tt.wantAuth)
+			}
+
+			if seen.clientCert != tt.wantCert {
+				t.Errorf("client certificate = %q, want %q", seen.clientCert, tt.wantCert)
+			}
+
+			wantPath := "/prefix/api/v1/namespaces"
+
+			if tt.context == "test-file-ca" {
+				wantPath = "/api/v1/namespaces"
+			}
+
+			if seen.path != wantPath {
+				t.Errorf("path = %q, want %q", seen.path, wantPath)
+			}
+		})
+	}
+}
+
+func TestKubeconfigTokenFileReread(t *testing.T) {
+	server := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	writeFile(t, dir, "token", []byte("first"), 0600)
+
+	conf := fmt.Sprintf(kubeconfigFixture, "test", server.URL, base64.StdEncoding.EncodeToString(server.caPEM()), server.URL, "    tokenFile: token")
+	k, err := newKubeconfigClient(writeFile(t, dir, "config", []byte(conf), 0600))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{"first", "second"} {
+		writeFile(t, dir, "token", []byte(token), 0600)
+
+		r := newRequest()
+		r.URL.Path = "/api"
+
+		res, err := k.Do(r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+	}
+
+	if got := server.seen[1].authorization; got != "Bearer second" {
+		t.Errorf("Authorization = %q after the token file changed, want Bearer second", got)
+	}
+}
+
+func TestKubeconfigReuseRequest(t *testing.T) {
+	server := newTestAPIServer(t)
+	dir := t.TempDir()
+
+	conf := fmt.Sprintf(kubeconfigFixture, "test", server.URL, base64.StdEncoding.EncodeToString(server.caPEM()), server.URL, "    token: abc")
+	k, err := newKubeconfigClient(writeFile(t, dir, "config", []byte(conf), 0600))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := newRequest()
+	r.URL.Path = "/api/v1/pods"
+
+	for i := 0; i < 2; i++ {
+		res, err := k.Do(r)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+
+		if r.URL.Path != "/api/v1/pods" || r.URL.Host != "" || r.Header.Get("Authorization") != "" {
+			t.Fatalf("Do modified the request: %s %v", r.URL, r.Header)
+		}
+	}
+
+	for _, seen := range server.seen {
+		if seen.path != "/prefix/api/v1/pods" {
+			t.Errorf("path = %q, want /prefix/api/v1/pods", seen.path)
+		}
+	}
+}
+
+// execPlugin returns an exec plugin that issues token-1, token-2, ... on
+// every run.
+func execPlugin(t *testing.T, dir string) string {
+	script := fmt.Sprintf(`#!/bin/sh
+n=$(cat %[1]s/count 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n > %[1]s/count
+printf '{"apiVersion":"client.authentication.k8s.io/v1","kind":"ExecCredential","status":{"token":"token-%%s"}}' $n
+`, dir)
+
+	return writeFile(t, dir, "plugin.sh", []byte(script), 0700)
+}
+
+func TestKubeconfigExecRetry(t *testing.T) {
+	if _, err := os.Stat("/bin/sh"); err != nil {
+		t.Skip("no /bin/sh")
+	}
+
+	tests := []struct {
+		name         string
+		unauthorized []string
+		wantStatus   int
+		wantTokens   []string
+	}{
+		{"valid", nil, http.StatusOK, []string{"Bearer token-1", "Bearer token-1"}},
+		{"revoked", []string{"Bearer token-1"}, http.StatusOK, []string{"Bearer token-1", "Bearer token-2", "Bearer token-2"}},
+		{"revoked twice", []string{"Bearer token-1", "Bearer token-2"}, http.StatusUnauthorized, []string{"Bearer token-1", "Bearer token-2", "Bearer token-2", "Bearer token-3"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestAPIServer(t)
+			dir := t.TempDir()
+
+			for _, token := range tt.unauthorized {
+				server.unauthorized[token] = true
+			}
+
+			user := fmt.Sprintf("    exec:\n      apiVersion: client.authentication.k8s.io/v1\n      command: %s", execPlugin(t, dir))
+			conf := fmt.Sprintf(kubeconfigFixture, "test", server.URL, base64.StdEncoding.EncodeToString(server.caPEM()), server.URL, user)
+			k, err := newKubeconfigClient(writeFile(t, dir, "config", []byte(conf), 0600))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a request with a body is sent again with the same body
+			body := []byte(`{"kind":"Event"}`)
+			r := newRequest()
+			r.Method = http.MethodPost
+			r.URL.Path = "/api/v1/namespaces/default/events"
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.GetBody = func() (io.ReadCloser, error) {
+				return io.NopCloser(bytes.NewReader(body)), nil
+			}
+
+			res, err := k.Do(r)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			res.Body.Close()
+
+			if res.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d", res.StatusCode, tt.wantStatus)
+			}
+
+			// the credential is cached for the following requests
+			r = newRequest()
+			r.URL.Path = "/api"
+
+			if res, err = k.Do(r); err != nil {
+				t.Fatal(err)
+			}
+
+			res.Body.Close()
+
+			var tokens []string
+
+			for i, seen := range server.seen {
+				tokens = append(tokens, seen.authorization)
+
+				if seen.path == "/prefix/api/v1/namespaces/default/events" && seen.body != string(body) {
+					t.Errorf("request %d: body %q, want %q", i, seen.body, body)
+				}
+			}
+
+			if strings.Join(tokens, ",") != strings.Join(tt.wantTokens, ",") {
+				t.Errorf("tokens %v, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,285 @@
+package kube
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const microTimeLayout = "2006-01-02T15:04:05.000000Z07:00"
+
+// MicroTime is a timestamp with microsecond precision, as used by Leases.
+type MicroTime struct {
+	time.Time
+}
+
+func (t MicroTime) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.UTC().Format(microTimeLayout))
+}
+
+func (t *MicroTime) UnmarshalJSON(b []byte) error {
+	var s string
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	parsed, err := time.Parse(time.RFC3339Nano, s)
+
+	if err != nil {
+		return err
+	}
+
+	t.Time = parsed
+	return nil
+}
+
+type Lease struct {
+	Metadata *Metadata `json:"metadata"`
+	Spec     struct {
+		HolderIdentity       string     `json:"holderIdentity,omitempty"`
+		LeaseDurationSeconds int        `json:"leaseDurationSeconds,omitempty"`
+		AcquireTime          *MicroTime `json:"acquireTime,omitempty"`
+		RenewTime            *MicroTime `json:"renewTime,omitempty"`
+		LeaseTransitions     int        `json:"leaseTransitions,omitempty"`
+	} `json:"spec"`
+}
+
+func (l *Lease) Name() string {
+	return fmt.Sprintf("%s/%s", l.Metadata.Namespace, l.Metadata.Name)
+}
+
+func (l *Lease) Meta() *Metadata {
+	return l.Metadata
+}
+
+// LeaderElector elects a leader among the replicas of the controller with
+// a coordination.k8s.io Lease. The leader renews the Lease every
+// RetryPeriod and steps down when it could not renew it within
+// RenewDeadline, other replicas take the Lease over once it was not renewed
+// for LeaseDuration.
+type LeaderElector struct {
+	Client        Client
+	Namespace     string
+	Name          string
+	Identity      string
+	LeaseDuration time.Duration
+	RenewDeadline time.Duration
+	RetryPeriod   time.Duration
+	// OnStartedLeading is called when this replica becomes the leader, ctx
+	// is canceled when it stops leading. It is called before the lease is
+	// renewed and OnStoppedLeading, work it starts that outlives the call
+	// runs in a goroutine of its own.
+	OnStartedLeading func(ctx context.Context)
+	// OnStoppedLeading is called when this replica loses the leadership.
+	OnStoppedLeading func()
+	// OnNewLeader is called when the observed leader changes.
+	OnNewLeader func(identity string)
+
+	observedHolder string
+	observedRenew  time.Time
+	observedTime   time.Time
+}
+
+// Validate checks that the durations leave the leader time to renew the
+// Lease before RenewDeadline, and the others time to see it renewed before
+// it expires.
+func (le *LeaderElector) Validate() error {
+	switch {
+	case le.RetryPeriod <= 0:
+		return errors.New("kube: leader election: retry period must be positive")
+	case le.RenewDeadline <= le.RetryPeriod:
+		return fmt.Errorf("kube: leader election: renew deadline %s must be longer than the retry period %s", le.RenewDeadline, le.RetryPeriod)
+	case le.LeaseDuration <= le.RenewDeadline:
+		return fmt.Errorf("kube: leader election: lease duration %s must be longer than the renew deadline %s", le.LeaseDuration, le.RenewDeadline)
+	}
+
+	return nil
+}
+
+func (le *LeaderElector) leaseFunc(r *http.Request) {
+	r.URL.Path = fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", le.Namespace, le.Name)
+}
+
+func (le *LeaderElector) leasesFunc(r *http.Request) {
+	r.URL.Path = fmt.Sprintf("/apis/coordination.k8s.io/v1/namespaces/%s/leases", le.Namespace)
+}
+
+// observe records the Lease holder, the expiry of a Lease is measured from
+// the local time it was last seen renewed to tolerate clock skew.
+func (le *LeaderElector) observe(lease *Lease) {
+	var renew time.Time
+
+	if lease.Spec.RenewTime != nil {
+		renew = lease.Spec.RenewTime.Time
+	}
+
+	if lease.Spec.HolderIdentity != le.observedHolder && le.OnNewLeader != nil {
+		le.OnNewLeader(lease.Spec.HolderIdentity)
+	}
+
+	if lease.Spec.HolderIdentity != le.observedHolder || !renew.Equal(le.observedRenew) {
+		le.observedTime = time.Now()
+	}
+
+	le.observedHolder = lease.Spec.HolderIdentity
+	le.observedRenew = renew
+}
+
+// tryAcquireOrRenew takes the Lease when it is free or expired, or renews
+// it when this replica holds it.
+func (le *LeaderElector) tryAcquireOrRenew() (bool, error) {
+	now := MicroTime{time.Now()}
+	lease := new(Lease)
+
+	err := Get(le.Client, le.leaseFunc, lease)
+
+	if IsNotFound(err) {
+		lease = &Lease{Metadata: &Metadata{Name: le.Name, Namespace: le.Namespace}}
+		lease.Spec.HolderIdentity = le.Identity
+		lease.Spec.LeaseDurationSeconds = int(le.LeaseDuration / time.Second)
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+
+		if err := Create(le.Client, le.leasesFunc, lease); err != nil {
+			return false, err
+		}
+
+		le.observe(lease)
+		return true, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	le.observe(lease)
+
+	holder := lease.Spec.HolderIdentity
+
+	if holder != "" && holder != le.Identity && time.Since(le.observedTime) < le.LeaseDuration {
+		return false, nil
+	}
+
+	if holder != le.Identity {
+		lease.Spec.AcquireTime = &now
+		lease.Spec.LeaseTransitions++
+	}
+
+	lease.Spec.HolderIdentity = le.Identity
+	lease.Spec.LeaseDurationSeconds = int(le.LeaseDuration / time.Second)
+	lease.Spec.RenewTime = &now
+
+	if err := Update(le.Client, le.leaseFunc, lease); err != nil {
+		return false, err
+	}
+
+	le.observe(lease)
+	return true, nil
+}
+
+// release gives the Lease up so another replica can take it over without
+// waiting for it to expire.
+func (le *LeaderElector) release() {
+	lease := new(Lease)
+
+	if err := Get(le.Client, le.leaseFunc, lease); err != nil {
+		log.Printf("kube: release lease: %s", err)
+		return
+	}
+
+	if lease.Spec.HolderIdentity != le.Identity {
+		return
+	}
+
+	now := MicroTime{time.Now()}
+
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.LeaseDurationSeconds = 1
+	lease.Spec.RenewTime = &now
+
+	if err := Update(le.Client, le.leaseFunc, lease); err != nil {
+		log.Printf("kube: release lease: %s", err)
+	}
+}
+
+func (le *LeaderElector) sleep(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(le.RetryPeriod):
+		return true
+	}
+}
+
+// acquire blocks until the Lease is acquired or ctx is done.
+func (le *LeaderElector) acquire(ctx context.Context) bool {
+	for {
+		ok, err := le.tryAcquireOrRenew()
+
+		if err != nil {
+			log.Printf("kube: acquire lease %s/%s: %s", le.Namespace, le.Name, err)
+		}
+
+		if ok {
+			log.Printf("kube: acquired lease %s/%s", le.Namespace, le.Name)
+			return true
+		}
+
+		if !le.sleep(ctx) {
+			return false
+		}
+	}
+}
+
+// renew keeps renewing the Lease until a renewal did not succeed within
+// RenewDeadline or ctx is done.
+func (le *LeaderElector) renew(ctx context.Context) {
+	lastRenew := time.Now()
+
+	for le.sleep(ctx) {
+		ok, err := le.tryAcquireOrRenew()
+
+		if err != nil {
+			log.Printf("kube: renew lease %s/%s: %s", le.Namespace, le.Name, err)
+		}
+
+		if ok {
+			lastRenew = time.Now()
+			continue
+		}
+
+		if err == nil || time.Since(lastRenew) > le.RenewDeadline {
+			log.Printf("kube: lost lease %s/%s", le.Namespace, le.Name)
+			return
+		}
+	}
+}
+
+// Run takes part in the election until ctx is done. A replica that lost
+// the leadership keeps competing for it.
+func (le *LeaderElector) Run(ctx context.Context) {
+	for le.acquire(ctx) {
+		leaderCtx, cancel := context.WithCancel(ctx)
+
+		if le.OnStartedLeading != nil {
+			le.OnStartedLeading(leaderCtx)
+		}
+
+		le.renew(ctx)
+		cancel()
+
+		if le.OnStoppedLeading != nil {
+			le.OnStoppedLeading()
+		}
+
+		if ctx.Err() != nil {
+			le.release()
+			return
+		}
+	}
+}
@@ -0,0 +1,329 @@
+package kube
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseClient serves a single Lease like the apiserver, updates with an
+// outdated resourceVersion fail with 409 Conflict.
+type fakeLeaseClient struct {
+	mu    sync.Mutex
+	lease *Lease
+	rv    int
+	// conflicts is the number of following writes answered with a
+	// conflict, as if another replica wrote the Lease first
+	conflicts int
+}
+
+func respond(code int, body interface{}) *http.Response {
+	data, _ := json.Marshal(body)
+
+	return &http.Response{
+		StatusCode: code,
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		Body:       io.NopCloser(bytes.NewReader(data)),
+	}
+}
+
+func (f *fakeLeaseClient) Do(r *http.Request) (*http.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if r.Method == "" || r.Method == http.MethodGet {
+		if f.lease == nil {
+			return respond(http.StatusNotFound, nil), nil
+		}
+
+		return respond(http.StatusOK, f.lease), nil
+	}
+
+	lease := new(Lease)
+
+	if err := json.NewDecoder(r.Body).Decode(lease); err != nil {
+		return respond(http.StatusBadRequest, nil), nil
+	}
+
+	if f.conflicts > 0 {
+		f.conflicts--
+		return respond(http.StatusConflict, nil), nil
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		if f.lease != nil {
+			return respond(http.StatusConflict, nil), nil
+		}
+	case http.MethodPut:
+		if f.lease == nil {
+			return respond(http.StatusNotFound, nil), nil
+		}
+
+		if lease.Metadata.ResourceVersion != f.lease.Metadata.ResourceVersion {
+			return respond(http.StatusConflict, nil), nil
+		}
+	}
+
+	f.rv++
+	lease.Metadata.ResourceVersion = strconv.Itoa(f.rv)
+	f.lease = lease
+
+	return respond(http.StatusOK, lease), nil
+}
+
+func (f *fakeLeaseClient) holder() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.lease == nil {
+		return ""
+	}
+
+	return f.lease.Spec.HolderIdentity
+}
+
+func newTestElector(client Client, identity string) *LeaderElector {
+	return &LeaderElector{
+		Client:        client,
+		Namespace:     "default",
+		Name:          "test",
+		Identity:      identity,
+		LeaseDuration: time.Millisecond * 300,
+		RenewDeadline: time.Millisecond * 200,
+		RetryPeriod:   time.Millisecond * 20,
+	}
+}
+
+func TestLeaderElectorValidate(t *testing.T) {
+	tests := []struct {
+		name                                string
+		leaseDuration, renewDeadline, retry time.Duration
+		valid                               bool
+	}{
+		{"defaults", time.Second * 15, time.Second * 10, time.Second * 2, true},
+		{"renew deadline equals lease duration", time.Second * 10, time.Second * 10, time.Second * 2, false},
+		{"renew deadline exceeds lease duration", time.Second * 10, time.Second * 15, time.Second * 2, false},
+		{"retry period equals renew deadline", time.Second * 15, time.Second * 10, time.Second * 10, false},
+		{"retry period exceeds renew deadline", time.Second * 15, time.Second * 10, time.Second * 12, false},
+		{"zero retry period", time.Second * 15, time.Second * 10, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			le := &LeaderElector{LeaseDuration: tt.leaseDuration, RenewDeadline: tt.renewDeadline, RetryPeriod: tt.retry}
+
+			if err := le.Validate(); (err == nil) != tt.valid {
+				t.Errorf("Validate() = %v, want valid=%v", err, tt.valid)
+			}
+		})
+	}
+}
+
+func TestLeaderElectorAcquireAndRenew(t *testing.T) {
+	client := new(fakeLeaseClient)
+	le := newTestElector(client, "a")
+
+	if ok, err := le.tryAcquireOrRenew(); !ok || err != nil {
+		t.Fatalf("acquire: ok=%v, err=%v", ok, err)
+	}
+
+	acquired := client.lease.Spec.AcquireTime.Time
+	renewed := client.lease.Spec.RenewTime.Time
+
+	time.Sleep(time.Millisecond * 5)
+
+	if ok, err := le.tryAcquireOrRenew(); !ok || err != nil {
+		t.Fatalf("renew: ok=%v, err=%v", ok, err)
+	}
+
+	spec := client.lease.Spec
+
+	if spec.HolderIdentity != "a" {
+		t.Errorf("holder = %q, want a", spec.HolderIdentity)
+	}
+
+	if !spec.AcquireTime.Equal(acquired) {
+		t.Errorf("renew changed the acquire time")
+	}
+
+	if !spec.RenewTime.After(renewed) {
+		t.Errorf("renew did not advance the renew time")
+	}
+
+	if spec.LeaseTransitions != 0 {
+		t.Errorf("transitions = %d, want 0", spec.LeaseTransitions)
+	}
+}
+
+func TestLeaderElectorHeldByOther(t *testing.T) {
+	client := new(fakeLeaseClient)
+	a, b := newTestElector(client, "a"), newTestElector(client, "b")
+
+	if ok, _ := a.tryAcquireOrRenew(); !ok {
+		t.Fatal("a did not acquire the free lease")
+	}
+
+	if ok, err := b.tryAcquireOrRenew(); ok || err != nil {
+		t.Fatalf("b took a lease held by a: ok=%v, err=%v", ok, err)
+	}
+
+	// the lease expires when it is not seen renewed for LeaseDuration
+	time.Sleep(b.LeaseDuration + time.Millisecond*20)
+
+	if ok, err := b.tryAcquireOrRenew(); !ok || err != nil {
+		t.Fatalf("b did not take over the expired lease: ok=%v, err=%v", ok, err)
+	}
+
+	if holder := client.holder(); holder != "b" {
+		t.Errorf("holder = %q, want b", holder)
+	}
+
+	if n := client.lease.Spec.LeaseTransitions; n != 1 {
+		t.Errorf("transitions = %d, want 1", n)
+	}
+
+	// a sees the new holder and does not take the lease back
+	if ok, err := a.tryAcquireOrRenew(); ok || err != nil {
+		t.Fatalf("a took the lease back: ok=%v, err=%v", ok, err)
+	}
+}
+
+func TestLeaderElectorConflict(t *testing.T) {
+	client := new(fakeLeaseClient)
+	le := newTestElector(client, "a")
+
+	if ok, _ := le.tryAcquireOrRenew(); !ok {
+		t.Fatal("a did not acquire the free lease")
+	}
+
+	client.conflicts = 1
+
+	ok, err := le.tryAcquireOrRenew()
+
+	if ok || !IsConflict(err) {
+		t.Fatalf("renew: ok=%v, err=%v, want a conflict", ok, err)
+	}
+
+	if ok, err := le.tryAcquireOrRenew(); !ok || err != nil {
+		t.Fatalf("renew after conflict: ok=%v, err=%v", ok, err)
+	}
+}
+
+func TestLeaderElectorRun(t *testing.T) {
+	client := new(fakeLeaseClient)
+
+	var (
+		mu      sync.Mutex
+		leading = map[string]bool{}
+		started = make(chan string, 2)
+	)
+
+	run := func(ctx context.Context, identity string) <-chan struct{} {
+		le := newTestElector(client, identity)
+		le.OnStartedLeading = func(context.Context) {
+			mu.Lock()
+			leading[identity] = true
+			mu.Unlock()
+			started <- identity
+		}
+		le.OnStoppedLeading = func() {
+			mu.Lock()
+			leading[identity] = false
+			mu.Unlock()
+		}
+
+		done := make(chan struct{})
+
+		go func() {
+			le.Run(ctx)
+			close(done)
+		}()
+
+		return done
+	}
+
+	ctxA, cancelA := context.WithCancel(context.Background())
+	doneA := run(ctxA, "a")
+
+	select {
+	case id := <-started:
+		if id != "a" {
+			t.Fatalf("%s started leading, want a", id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("a did not start leading")
+	}
+
+	ctxB, cancelB := context.WithCancel(context.Background())
+	defer cancelB()
+
+	doneB := run(ctxB, "b")
+
+	// b keeps waiting while a renews the lease
+	time.Sleep(time.Millisecond * 500)
+
+	mu.Lock()
+	if leading["b"] {
+		t.Error("b leads while a renews the lease")
+	}
+	mu.Unlock()
+
+	// a releases the lease when it stops, b takes it over
+	cancelA()
+	<-doneA
+
+	select {
+	case id := <-started:
+		if id != "b" {
+			t.Fatalf("%s started leading, want b", id)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("b did not take over the released lease")
+	}
+
+	mu.Lock()
+	if leading["a"] {
+		t.Error("a still leads after it stopped")
+	}
+	mu.Unlock()
+
+	cancelB()
+	<-doneB
+
+	if holder := client.holder(); holder != "" {
+		t.Errorf("holder = %q after both stopped, want none", holder)
+	}
+}
+
+// TestLeaderElectorCallbackOrder checks that OnStoppedLeading follows
+// OnStartedLeading even when the leadership ends while it runs.
+func TestLeaderElectorCallbackOrder(t *testing.T) {
+	le := newTestElector(new(fakeLeaseClient), "a")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var calls []string
+
+	le.OnStartedLeading = func(context.Context) {
+		cancel()
+		time.Sleep(time.Millisecond * 50)
+		calls = append(calls, "started")
+	}
+	le.OnStoppedLeading = func() {
+		calls = append(calls, "stopped")
+	}
+
+	le.Run(ctx)
+
+	if strings.Join(calls, ",") != "started,stopped" {
+		t.Errorf("calls %v, want started and stopped", calls)
+	}
+}
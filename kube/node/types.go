@@ -0,0 +1,47 @@
+package node
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"net/http"
+)
+
+const (
+	AddressExternalIP = "ExternalIP"
+	AddressInternalIP = "InternalIP"
+)
+
+type Node struct {
+	Metadata *kube.Metadata `json:"metadata"`
+	Status   struct {
+		Addresses []struct {
+			Type    string `json:"type"`
+			Address string `json:"address"`
+		} `json:"addresses"`
+	} `json:"status"`
+}
+
+func (n *Node) Name() string {
+	return n.Metadata.Name
+}
+
+func (n *Node) Meta() *kube.Metadata {
+	return n.Metadata
+}
+
+// Address returns the first address of typ.
+func (n *Node) Address(typ string) string {
+	for _, addr := range n.Status.Addresses {
+		if addr.Type == typ {
+			return addr.Address
+		}
+	}
+
+	return ""
+}
+
+func ReadFunc(name string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = fmt.Sprintf("/api/v1/nodes/%s", name)
+	}
+}
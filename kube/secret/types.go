@@ -21,12 +21,18 @@ func (s *Secret) Name() string {
 	return fmt.Sprintf("%s/%s", s.Metadata.Namespace, s.Metadata.Name)
 }
 
+func (s *Secret) Meta() *kube.Metadata {
+	return s.Metadata
+}
+
 func ReadFunc(namespace, name string) kube.ReadFunc {
 	return func(r *http.Request) {
 		r.URL.Path = fmt.Sprintf("/api/v1/namespaces/%s/secrets/%s", namespace, name)
 	}
 }
 
-func WatchFunc(r *http.Request) {
-	r.URL.Path = "/api/v1/watch/secrets"
+func WatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/api/v1/watch", namespace, "secrets")
+	}
 }
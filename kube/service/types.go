@@ -0,0 +1,92 @@
+package service
+
+import (
+	"fmt"
+	"ingress-controller/kube"
+	"net/http"
+)
+
+const (
+	TypeClusterIP    = "ClusterIP"
+	TypeNodePort     = "NodePort"
+	TypeLoadBalancer = "LoadBalancer"
+	TypeExternalName = "ExternalName"
+)
+
+const (
+	ProtocolTCP = "TCP"
+	ProtocolUDP = "UDP"
+)
+
+type Service struct {
+	Metadata *kube.Metadata `json:"metadata"`
+	Spec     struct {
+		Type         string   `json:"type"`
+		ExternalName string   `json:"externalName"`
+		ExternalIPs  []string `json:"externalIPs"`
+		Ports        []*Port  `json:"ports"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []kube.LoadBalancerIngress `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+type Port struct {
+	Name       string           `json:"name"`
+	Protocol   string           `json:"protocol"`
+	Port       int              `json:"port"`
+	TargetPort kube.IntOrString `json:"targetPort"`
+}
+
+func (s *Service) Name() string {
+	return fmt.Sprintf("%s/%s", s.Metadata.Namespace, s.Metadata.Name)
+}
+
+func (s *Service) Meta() *kube.Metadata {
+	return s.Metadata
+}
+
+// FindPort returns the port with name, or with number when name is empty.
+func (s *Service) FindPort(name string, number int) *Port {
+	for _, p := range s.Spec.Ports {
+		if name != "" && p.Name == name {
+			return p
+		}
+
+		if name == "" && p.Port == number {
+			return p
+		}
+	}
+
+	return nil
+}
+
+// FindProtocolPort is FindPort among the ports of protocol, a port without
+// protocol is a TCP port.
+func (s *Service) FindProtocolPort(protocol, name string, number int) *Port {
+	for _, p := range s.Spec.Ports {
+		if p.Protocol != protocol && !(p.Protocol == "" && protocol == ProtocolTCP) {
+			continue
+		}
+
+		if (name != "" && p.Name == name) || (name == "" && p.Port == number) {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func WatchFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/api/v1/watch", namespace, "services")
+	}
+}
+
+func ListFunc(namespace string) kube.ReadFunc {
+	return func(r *http.Request) {
+		r.URL.Path = kube.CollectionPath("/api/v1", namespace, "services")
+	}
+}
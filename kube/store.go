@@ -0,0 +1,212 @@
+package kube
+
+import (
+	"context"
+	"sync"
+)
+
+// Store keeps the latest objects of a resource from a list and a following
+// watch. OnChange is called from the watch with every object that was
+// added, modified or deleted.
+type Store[T Object] struct {
+	Client Client
+	// Namespaces restricts the store to the objects of these namespaces,
+	// each of them is listed and watched on its own. All namespaces are
+	// watched when it is empty.
+	Namespaces []string
+	// LabelSelector and FieldSelector restrict the store to the objects
+	// matching them.
+	LabelSelector string
+	FieldSelector string
+	ListFunc      func(namespace string) ReadFunc
+	WatchFunc     func(namespace string) ReadFunc
+	OnChange      func(T)
+	mu            sync.RWMutex
+	objects       map[string]T
+	versions      map[string]string
+}
+
+func (s *Store[T]) Init() {
+	s.objects = make(map[string]T)
+	s.versions = make(map[string]string)
+}
+
+func (s *Store[T]) namespaces() []string {
+	if len(s.Namespaces) == 0 {
+		return []string{""}
+	}
+
+	return s.Namespaces
+}
+
+func (s *Store[T]) selected(f ReadFunc) ReadFunc {
+	if s.LabelSelector != "" {
+		f = WithQuery(f, "labelSelector", s.LabelSelector)
+	}
+
+	if s.FieldSelector != "" {
+		f = WithQuery(f, "fieldSelector", s.FieldSelector)
+	}
+
+	return f
+}
+
+func (s *Store[T]) list(namespace string) (map[string]T, string, error) {
+	listed := make(map[string]T)
+
+	reset := func() {
+		listed = make(map[string]T)
+	}
+
+	add := func(obj T) {
+		listed[obj.Name()] = obj
+	}
+
+	resourceVersion, err := List(s.Client, s.selected(s.ListFunc(namespace)), reset, add)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	return listed, resourceVersion, nil
+}
+
+// Sync lists the resource into the store, Run resumes from the list
+// resourceVersions.
+func (s *Store[T]) Sync() error {
+	objects := make(map[string]T)
+	versions := make(map[string]string)
+
+	for _, ns := range s.namespaces() {
+		listed, resourceVersion, err := s.list(ns)
+
+		if err != nil {
+			return err
+		}
+
+		for name, obj := range listed {
+			objects[name] = obj
+		}
+
+		versions[ns] = resourceVersion
+	}
+
+	s.mu.Lock()
+	s.objects = objects
+	s.versions = versions
+	s.mu.Unlock()
+
+	return nil
+}
+
+// relist lists a namespace again and notifies every object of it that
+// changed since the last seen state.
+func (s *Store[T]) relist(namespace string) (string, error) {
+	listed, resourceVersion, err := s.list(namespace)
+
+	if err != nil {
+		return "", err
+	}
+
+	var changed []T
+
+	s.mu.Lock()
+
+	for name, obj := range listed {
+		if cached, ok := s.objects[name]; !ok || cached.Meta().ResourceVersion != obj.Meta().ResourceVersion {
+			changed = append(changed, obj)
+		}
+	}
+
+	for name, obj := range s.objects {
+		if namespace != "" && obj.Meta().Namespace != namespace {
+			continue
+		}
+
+		if _, ok := listed[name]; !ok {
+			changed = append(changed, obj)
+			delete(s.objects, name)
+		}
+	}
+
+	for name, obj := range listed {
+		s.objects[name] = obj
+	}
+
+	s.mu.Unlock()
+
+	for _, obj := range changed {
+		s.OnChange(obj)
+	}
+
+	return resourceVersion, nil
+}
+
+func (s *Store[T]) Get(name string) (obj T, ok bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	obj, ok = s.objects[name]
+	return
+}
+
+func (s *Store[T]) List() []T {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	objects := make([]T, 0, len(s.objects))
+
+	for _, obj := range s.objects {
+		objects = append(objects, obj)
+	}
+
+	return objects
+}
+
+// Run watches the resource from the resourceVersions of Sync until ctx is
+// done.
+func (s *Store[T]) Run(ctx context.Context) {
+	update := func(obj T) {
+		s.mu.Lock()
+		s.objects[obj.Name()] = obj
+		s.mu.Unlock()
+
+		s.OnChange(obj)
+	}
+
+	deleted := func(obj T) {
+		s.mu.Lock()
+		delete(s.objects, obj.Name())
+		s.mu.Unlock()
+
+		s.OnChange(obj)
+	}
+
+	var wg sync.WaitGroup
+
+	for _, ns := range s.namespaces() {
+		ns := ns
+
+		handler := WatchHandler[T]{
+			Added:    update,
+			Modified: update,
+			Deleted:  deleted,
+			Relist: func() (string, error) {
+				return s.relist(ns)
+			},
+		}
+
+		s.mu.RLock()
+		resourceVersion := s.versions[ns]
+		s.mu.RUnlock()
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			Watch(ctx, s.Client, s.selected(s.WatchFunc(ns)), resourceVersion, handler)
+		}()
+	}
+
+	wg.Wait()
+}
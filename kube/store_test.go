@@ -0,0 +1,69 @@
+package kube
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStoreRelist(t *testing.T) {
+	client := newFakeAPIClient(
+		// Sync
+		listPageResponse("5", "", newTestObject("default", "a", "1"), newTestObject("default", "b", "2"), newTestObject("default", "c", "3")),
+		listPageResponse("6", "", newTestObject("other", "d", "4")),
+		// relist of default, in two pages
+		listPageResponse("9", "c1", newTestObject("default", "a", "1"), newTestObject("default", "b", "7")),
+		listPageResponse("9", "", newTestObject("default", "e", "8")),
+	)
+
+	var changed []string
+
+	s := &Store[*testObject]{
+		Client:     client,
+		Namespaces: []string{"default", "other"},
+		ListFunc: func(namespace string) ReadFunc {
+			return func(r *http.Request) {
+				r.URL.Path = CollectionPath("/api/v1", namespace, "tests")
+			}
+		},
+		OnChange: func(obj *testObject) {
+			changed = append(changed, obj.Name())
+		},
+	}
+
+	s.Init()
+
+	if err := s.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	resourceVersion, err := s.relist("default")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if resourceVersion != "9" {
+		t.Errorf("relisted at %s, want 9", resourceVersion)
+	}
+
+	// a is unchanged and d is of another namespace
+	sort.Strings(changed)
+
+	if want := "default/b,default/c,default/e"; strings.Join(changed, ",") != want {
+		t.Errorf("changed %v, want %s", changed, want)
+	}
+
+	var names []string
+
+	for _, obj := range s.List() {
+		names = append(names, obj.Name()+"@"+obj.Metadata.ResourceVersion)
+	}
+
+	sort.Strings(names)
+
+	if want := "default/a@1,default/b@7,default/e@8,other/d@4"; strings.Join(names, ",") != want {
+		t.Errorf("stored %v, want %s", names, want)
+	}
+}
@@ -3,14 +3,20 @@ package main
 import (
 	"context"
 	"flag"
+	"fmt"
 	"ingress-controller/controller"
 	"ingress-controller/kube"
+	"ingress-controller/metrics"
 	"ingress-controller/nginx"
+	"log"
+	"net"
 	"net/http"
 	"net/http/pprof"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
@@ -23,8 +29,24 @@ var (
 	ngxHttp2             = flag.Bool("ngx.http2", true, "")
 	ngxLogLevel          = flag.String("ngx.log-level", "notice", "")
 	ngxAccessLog         = flag.String("ngx.access-log", "/dev/stdout", "")
+	ngxResolver          = flag.String("ngx.resolver", "", "nameservers for ExternalName services, defaults to /etc/resolv.conf")
+	ngxInternalListen    = flag.String("ngx.internal-listen", "127.0.0.1:10246", "address of the internal server of /_/stub_status and /_/dump-config, disabled when empty")
+	ngxInternalAllow     = flag.String("ngx.internal-allow", "", "comma separated CIDRs allowed to access the internal server, all when empty")
+	ngxStubStatus        = flag.Bool("ngx.stub-status", true, "serve /_/stub_status on the internal server")
+	ngxDumpConfig        = flag.Bool("ngx.dump-config", true, "serve /_/dump-config/(nginx|http|stream) on the internal server")
 	kubeProxy            = flag.String("kube.proxy", "", "")
+	kubeconfig           = flag.String("kubeconfig", "", "run outside the cluster with a kubeconfig, defaults to $KUBECONFIG")
 	pprofAddr            = flag.String("pprof.addr", "", "")
+	metricsAddr          = flag.String("metrics.addr", "", "address of the Prometheus metrics at /metrics, e.g. :10254, disabled when empty")
+	webhookAddr          = flag.String("webhook.addr", "", "address of the validating admission webhook for ingresses, e.g. :8443, disabled when empty")
+	webhookCert          = flag.String("webhook.cert", "/etc/webhook/tls.crt", "")
+	webhookKey           = flag.String("webhook.key", "/etc/webhook/tls.key", "")
+	electEnabled         = flag.Bool("elect", false, "elect a leader among replicas, only the leader writes to the cluster")
+	electNamespace       = flag.String("elect.namespace", os.Getenv("POD_NAMESPACE"), "")
+	electLease           = flag.String("elect.lease", "mini-ingress-controller", "")
+	electLeaseDuration   = flag.Duration("elect.lease-duration", time.Second*15, "")
+	electRenewDeadline   = flag.Duration("elect.renew-deadline", time.Second*10, "")
+	electRetryPeriod     = flag.Duration("elect.retry-period", time.Second*2, "")
 )
 
 func main() {
@@ -34,6 +56,8 @@ func main() {
 
 	if *kubeProxy != "" {
 		kubeClient = kube.NewProxyClient(*kubeProxy)
+	} else if *kubeconfig != "" || os.Getenv("KUBECONFIG") != "" {
+		kubeClient = kube.NewKubeconfigClient(*kubeconfig)
 	} else {
 		kubeClient = kube.NewInClusterClient()
 	}
@@ -46,11 +70,42 @@ func main() {
 	}
 
 	httpConf := &nginx.Http{
-		Http2:     *ngxHttp2,
-		LogFormat: *ngxLogFormat,
-		Listen:    *ngxListenPort,
-		TLSListen: *ngxHttpsListenPort,
-		AccessLog: *ngxAccessLog,
+		HttpSettings: nginx.HttpSettings{
+			Http2:                 *ngxHttp2,
+			LogFormat:             *ngxLogFormat,
+			Listen:                *ngxListenPort,
+			TLSListen:             *ngxHttpsListenPort,
+			AccessLog:             *ngxAccessLog,
+			Resolver:              *ngxResolver,
+			ClientMaxBodySize:     "1m",
+			ProxyConnectTimeout:   "60s",
+			ProxyReadTimeout:      "60s",
+			ProxySendTimeout:      "60s",
+			SSLProtocols:          "TLSv1.2 TLSv1.3",
+			HSTSMaxAge:            15724800,
+			HSTSIncludeSubdomains: true,
+		},
+		Internal: nginx.InternalSettings{
+			Listen:     *ngxInternalListen,
+			StubStatus: *ngxStubStatus,
+			DumpConfig: *ngxDumpConfig,
+		},
+	}
+
+	for _, cidr := range strings.Split(*ngxInternalAllow, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+
+		if _, _, err := net.ParseCIDR(cidr); err != nil && net.ParseIP(cidr) == nil {
+			panic(fmt.Errorf("ngx.internal-allow: %q is not a CIDR or an address", cidr))
+		}
+
+		httpConf.Internal.Allow = append(httpConf.Internal.Allow, cidr)
+	}
+
+	if httpConf.Resolver == "" {
+		httpConf.Resolver = nginx.SystemResolver()
 	}
 
 	ngx := nginx.New(ngxConf, httpConf)
@@ -64,12 +119,81 @@ func main() {
 
 	ctr := controller.New(ngx, kubeClient)
 
+	if *electEnabled {
+		if *electNamespace == "" {
+			*electNamespace = kube.InClusterNamespace()
+		}
+
+		identity, err := os.Hostname()
+
+		if err != nil {
+			panic(err)
+		}
+
+		elector := &kube.LeaderElector{
+			Client:        kubeClient,
+			Namespace:     *electNamespace,
+			Name:          *electLease,
+			Identity:      identity,
+			LeaseDuration: *electLeaseDuration,
+			RenewDeadline: *electRenewDeadline,
+			RetryPeriod:   *electRetryPeriod,
+			OnStartedLeading: func(context.Context) {
+				ctr.SetLeader(true)
+			},
+			OnStoppedLeading: func() {
+				ctr.SetLeader(false)
+			},
+			OnNewLeader: func(identity string) {
+				log.Printf("main: leader is %s", identity)
+			},
+		}
+
+		if err := elector.Validate(); err != nil {
+			panic(err)
+		}
+
+		ctr.SetLeader(false)
+		go elector.Run(ctx)
+	}
+
 	go func() {
 		if err := ctr.Run(ctx); err != nil {
 			panic(err)
 		}
 	}()
 
+	if *webhookAddr != "" {
+		server := &http.Server{
+			Addr:              *webhookAddr,
+			Handler:           ctr,
+			ReadHeaderTimeout: time.Second * 10,
+		}
+
+		go func() {
+			if err := server.ListenAndServeTLS(*webhookCert, *webhookKey); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
+	if *metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+
+		server := &http.Server{
+			Addr:              *metricsAddr,
+			Handler:           mux,
+			ReadHeaderTimeout: time.Second * 10,
+		}
+
+		go func() {
+			if err := server.ListenAndServe(); err != nil {
+				panic(err)
+			}
+		}()
+	}
+
 	if *pprofAddr != "" {
 		http.HandleFunc("/debug/pprof/heap", pprof.Index)
 		go http.ListenAndServe(*pprofAddr, nil)
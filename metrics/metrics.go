@@ -0,0 +1,285 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const namespace = "ingress_controller_"
+
+// Sample is a value of a metric with the values of its labels.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	mu      sync.Mutex
+	metrics = map[string]metric{}
+)
+
+func register(name string, m metric) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if _, ok := metrics[name]; ok {
+		panic("metrics: duplicate metric " + name)
+	}
+
+	metrics[name] = m
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string, extra ...string) string {
+	var pairs []string
+
+	for i, name := range names {
+		var v string
+
+		if i < len(values) {
+			v = values[i]
+		}
+
+		pairs = append(pairs, name+`="`+labelReplacer.Replace(v)+`"`)
+	}
+
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+extra[i+1]+`"`)
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var helpReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func writeHeader(w io.Writer, name, help, typ string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpReplacer.Replace(help), name, typ)
+}
+
+// vec holds a value per combination of label values.
+type vec struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*Sample
+}
+
+func (v *vec) add(delta float64, labelValues []string) {
+	key := strings.Join(labelValues, "\x00")
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	s, ok := v.values[key]
+
+	if !ok {
+		s = &Sample{LabelValues: append([]string(nil), labelValues...)}
+		v.values[key] = s
+	}
+
+	s.Value += delta
+}
+
+// delete removes the sample of labelValues, e.g. of an object that is gone.
+func (v *vec) delete(labelValues []string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	delete(v.values, strings.Join(labelValues, "\x00"))
+}
+
+func (v *vec) write(w io.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	writeHeader(w, v.name, v.help, v.typ)
+
+	keys := make([]string, 0, len(v.values))
+
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := v.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, s.LabelValues), formatValue(s.Value))
+	}
+}
+
+func newVec(name, help, typ string, labels []string) *vec {
+	v := &vec{
+		name:   namespace + name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: map[string]*Sample{},
+	}
+
+	// a metric without labels is reported before its first change
+	if len(labels) == 0 {
+		v.values[""] = &Sample{}
+	}
+
+	register(v.name, v)
+	return v
+}
+
+// Counter is a monotonically increasing value per label values.
+type Counter struct {
+	*vec
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{newVec(name, help, "counter", labels)}
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Delete removes the series of labelValues, so that the labels of deleted
+// objects do not grow the output forever.
+func (c *Counter) Delete(labelValues ...string) {
+	c.delete(labelValues)
+}
+
+// gaugeFunc collects its samples when the metrics are scraped.
+type gaugeFunc struct {
+	name    string
+	help    string
+	labels  []string
+	collect func() []Sample
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	samples := g.collect()
+
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\x00") < strings.Join(samples[j].LabelValues, "\x00")
+	})
+
+	writeHeader(w, g.name, g.help, "gauge")
+
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, s.LabelValues), formatValue(s.Value))
+	}
+}
+
+// NewGaugeFunc registers a gauge whose samples are returned by collect at
+// scrape time, e.g. the sizes of maps owned by another goroutine.
+func NewGaugeFunc(name, help string, collect func() []Sample, labels ...string) {
+	g := &gaugeFunc{name: namespace + name, help: help, labels: labels, collect: collect}
+	register(g.name, g)
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+// NewHistogram returns a histogram with the upper bounds of buckets in
+// increasing order, the +Inf bucket is added.
+func NewHistogram(name, help string, buckets ...float64) *Histogram {
+	h := &Histogram{
+		name:    namespace + name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+
+	register(h.name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	for i, upper := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(nil, nil, "le", formatValue(upper)), h.counts[i])
+	}
+
+	fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(nil, nil, "le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+
+		names := make([]string, 0, len(metrics))
+
+		for name := range metrics {
+			names = append(names, name)
+		}
+
+		ms := make([]metric, 0, len(names))
+		sort.Strings(names)
+
+		for _, name := range names {
+			ms = append(ms, metrics[name])
+		}
+
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		for _, m := range ms {
+			m.write(w)
+		}
+	})
+}
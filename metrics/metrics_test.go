@@ -0,0 +1,88 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+// isolate runs a test on an empty registry.
+func isolate(t *testing.T) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	registered := metrics
+	metrics = map[string]metric{}
+
+	t.Cleanup(func() {
+		mu.Lock()
+		defer mu.Unlock()
+
+		metrics = registered
+	})
+}
+
+func TestHandler(t *testing.T) {
+	isolate(t)
+
+	requests := NewCounter("test_requests_total", "Requests by path.", "path", "code")
+	requests.Inc(`/a"b\c`+"\n", "200")
+	requests.Inc("/", "200")
+	requests.Inc("/", "200")
+	requests.Inc("/gone", "404")
+	requests.Delete("/gone", "404")
+
+	NewCounter("test_errors_total", "Errors, a\\b\nc.")
+
+	latencies := NewHistogram("test_latency_seconds", "Latencies.", 0.1, 1)
+	latencies.Observe(0.25)
+	latencies.Observe(0.05)
+	latencies.Observe(2.5)
+
+	NewGaugeFunc("test_objects", "Objects by kind.", func() []Sample {
+		return []Sample{{LabelValues: []string{"service"}, Value: 2}, {LabelValues: []string{"ingress"}, Value: 0.5}}
+	}, "kind")
+
+	rec := httptest.NewRecorder()
+	Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP ingress_controller_test_errors_total Errors, a\\b\nc.
+# TYPE ingress_controller_test_errors_total counter
+ingress_controller_test_errors_total 0
+# HELP ingress_controller_test_latency_seconds Latencies.
+# TYPE ingress_controller_test_latency_seconds histogram
+ingress_controller_test_latency_seconds_bucket{le="0.1"} 1
+ingress_controller_test_latency_seconds_bucket{le="1"} 2
+ingress_controller_test_latency_seconds_bucket{le="+Inf"} 3
+ingress_controller_test_latency_seconds_sum 2.8
+ingress_controller_test_latency_seconds_count 3
+# HELP ingress_controller_test_objects Objects by kind.
+# TYPE ingress_controller_test_objects gauge
+ingress_controller_test_objects{kind="ingress"} 0.5
+ingress_controller_test_objects{kind="service"} 2
+# HELP ingress_controller_test_requests_total Requests by path.
+# TYPE ingress_controller_test_requests_total counter
+ingress_controller_test_requests_total{path="/",code="200"} 2
+ingress_controller_test_requests_total{path="/a\"b\\c\n",code="200"} 1
+`
+
+	if got := rec.Body.String(); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestRegisterDuplicate(t *testing.T) {
+	isolate(t)
+	NewCounter("test_duplicate_total", "Duplicate.")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("a duplicate metric was registered")
+		}
+	}()
+
+	NewCounter("test_duplicate_total", "Duplicate.")
+}
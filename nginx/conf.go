@@ -1,7 +1,9 @@
 package nginx
 
 import (
+	"fmt"
 	"ingress-controller/kube/ingress"
+	"sort"
 	"strings"
 )
 
@@ -18,12 +20,61 @@ proxy_set_header X-Forwarded-Proto $scheme;
 proxy_buffering on;
 `
 
+// quoteReplacer escapes the characters that end or alter a quoted string
+// of the nginx config, nginx unescapes them when it parses the string.
+var quoteReplacer = strings.NewReplacer(
+	`\`, `\\`,
+	`"`, `\"`,
+	"\n", `\n`,
+	"\r", `\r`,
+	"\t", `\t`,
+	"\x00", "",
+)
+
+// Quote returns v as a quoted string of the nginx config. User values are
+// always rendered quoted, so `;`, `{` or `}` can not end the directive or
+// block they appear in. Variables are still interpolated.
+func Quote(v string) string {
+	return `"` + quoteReplacer.Replace(v) + `"`
+}
+
+// Comment returns v on a single line, e.g. for a # comment.
+func Comment(v string) string {
+	return strings.NewReplacer("\n", " ", "\r", " ").Replace(v)
+}
+
 type Path struct {
 	Path     string
 	PathType string
 	Regex    bool
 }
 
+// matchOrder is the order in which nginx considers locations: exact
+// matches, then regexes in the order they are defined, then prefixes.
+func (p Path) matchOrder() int {
+	switch {
+	case p.Regex:
+		return 1
+	case p.PathType == ingress.PathTypeExact:
+		return 0
+	default:
+		return 2
+	}
+}
+
+// Quoted returns the location arguments of the path, with the path quoted.
+func (p Path) Quoted() string {
+	if p.Regex {
+		return "~* " + Quote(p.Path)
+	}
+
+	if p.PathType == ingress.PathTypeExact {
+		return "= " + Quote(p.Path)
+	}
+
+	return Quote(p.Path)
+}
+
 func (p Path) String() string {
 	if p.Regex {
 		return "~* " + p.Path
@@ -42,8 +93,45 @@ func (d Directive) String() string {
 	return strings.Join(d, " ")
 }
 
+// Quoted returns the directive with its arguments quoted.
+func (d Directive) Quoted() string {
+	if len(d) == 0 {
+		return ""
+	}
+
+	args := make([]string, 0, len(d))
+	args = append(args, d[0])
+
+	for _, arg := range d[1:] {
+		args = append(args, Quote(arg))
+	}
+
+	return strings.Join(args, " ")
+}
+
 type ProxyPassConf struct {
 	Upstream string
+	// UpstreamName references an upstream block of Http.Upstreams, it is
+	// used instead of Upstream when set.
+	UpstreamName string
+	// Resolve resolves the host of Upstream at request time through
+	// Http.Resolver instead of once when nginx loads the config.
+	Resolve bool
+}
+
+func (p *ProxyPassConf) Target() string {
+	if p.UpstreamName != "" {
+		return "http://" + p.UpstreamName
+	}
+
+	return p.Upstream
+}
+
+type Upstream struct {
+	Name string
+	// Servers are the addresses of the upstream, an upstream without
+	// servers answers 502.
+	Servers []string
 }
 
 type BasicAuthConf struct {
@@ -59,6 +147,130 @@ type Location struct {
 	DisableAccessLog bool
 	IngressRef       string
 	Directives       []Directive
+	// Routes choose how a request is served by matches on it, they are used
+	// instead of ProxyPass and Return when set.
+	Routes []*Route
+}
+
+// Match is a condition on a request variable, e.g. $http_x_version.
+type Match struct {
+	Variable string
+	Value    string
+	Regex    bool
+}
+
+// FailCondition returns the condition of an if directive that holds when
+// the match fails.
+func (m Match) FailCondition() string {
+	if m.Regex {
+		return fmt.Sprintf("%s !~ %s", m.Variable, Quote(m.Value))
+	}
+
+	return fmt.Sprintf("%s != %s", m.Variable, Quote(m.Value))
+}
+
+// Header sets a request header to the upstream. An empty Value removes the
+// header, unless Append is set.
+type Header struct {
+	Name   string
+	Value  string
+	Append bool
+}
+
+// Route is an alternative of a location, the first route whose matches
+// all hold serves the request.
+type Route struct {
+	Matches   []Match
+	ProxyPass *ProxyPassConf
+	Return    *ReturnConf
+	Headers   []Header
+}
+
+type routeCase struct {
+	Index int
+	*Route
+}
+
+// ReversedRoutes returns the routes from last to first, so that the first
+// matching route is the last one to be chosen.
+func (l *Location) ReversedRoutes() []routeCase {
+	cases := make([]routeCase, 0, len(l.Routes))
+
+	for i := len(l.Routes) - 1; i >= 0; i-- {
+		cases = append(cases, routeCase{i, l.Routes[i]})
+	}
+
+	return cases
+}
+
+// RouteHeader is a header set by a route of a location, Var holds the value
+// sent to the upstream.
+type RouteHeader struct {
+	Name   string
+	Var    string
+	Append bool
+	// Values are the values of the header by route index.
+	Values map[int]string
+}
+
+// HttpVar returns the variable of the request header.
+func (h *RouteHeader) HttpVar() string {
+	return "$http_" + strings.ReplaceAll(strings.ToLower(h.Name), "-", "_")
+}
+
+// RouteHeaders returns the headers set by any route, ordered by name.
+func (l *Location) RouteHeaders() []*RouteHeader {
+	byName := map[string]*RouteHeader{}
+
+	for i, route := range l.Routes {
+		for _, header := range route.Headers {
+			key := strings.ToLower(header.Name)
+
+			h, ok := byName[key]
+
+			if !ok {
+				h = &RouteHeader{Name: header.Name, Values: map[int]string{}}
+				byName[key] = h
+			}
+
+			h.Values[i] = header.Value
+			h.Append = h.Append || header.Append
+
+			if header.Append {
+				h.Values[i] = h.HttpVar() + ", " + header.Value
+			}
+		}
+	}
+
+	headers := make([]*RouteHeader, 0, len(byName))
+
+	for _, h := range byName {
+		headers = append(headers, h)
+	}
+
+	sort.Slice(headers, func(i, j int) bool {
+		return strings.ToLower(headers[i].Name) < strings.ToLower(headers[j].Name)
+	})
+
+	for i, h := range headers {
+		h.Var = fmt.Sprintf("$route_header_%d", i)
+	}
+
+	return headers
+}
+
+// SplitTarget is an upstream that receives Percent of the requests, e.g.
+// "12.50%", or "*" for the rest.
+type SplitTarget struct {
+	Percent  string
+	Upstream string
+}
+
+// Split spreads requests over upstreams by weight, the chosen upstream is
+// the value of the variable $Name.
+type Split struct {
+	Name    string
+	Targets []SplitTarget
 }
 
 type ReturnConf struct {
@@ -75,6 +287,40 @@ type Server struct {
 	ServerName string
 	Locations  map[string]*Location
 	SSL        *TLSConf
+	// Listen is the address of a server apart from the http ports, e.g. the
+	// internal server.
+	Listen string
+	// Allow are the CIDRs allowed to access the server, all when empty.
+	Allow []string
+}
+
+// SortedLocations returns the locations ordered like nginx matches them:
+// exact paths, then regexes with longer patterns first since the first
+// matching regex wins, then prefixes from longest to shortest.
+func (s *Server) SortedLocations() []*Location {
+	locs := make([]*Location, 0, len(s.Locations))
+
+	for _, loc := range s.Locations {
+		locs = append(locs, loc)
+	}
+
+	sort.Slice(locs, func(i, j int) bool {
+		a, b := locs[i].Path, locs[j].Path
+
+		if a.matchOrder() != b.matchOrder() {
+			return a.matchOrder() < b.matchOrder()
+		}
+
+		if a.Regex || a.PathType != ingress.PathTypeExact {
+			if len(a.Path) != len(b.Path) {
+				return len(a.Path) > len(b.Path)
+			}
+		}
+
+		return a.Path < b.Path
+	})
+
+	return locs
 }
 
 type Main struct {
@@ -85,16 +331,100 @@ type Main struct {
 	PidFile           string
 }
 
+// HttpSettings are the global settings of the http block.
+type HttpSettings struct {
+	Http2 bool
+	// LogFormat is rendered as is, its strings must be quoted, see
+	// MainLogFormat.
+	LogFormat string
+	AccessLog string
+	Listen    int
+	TLSListen int
+	// Resolver are the addresses and parameters of the resolver directive,
+	// rendered as is.
+	Resolver string
+	// ClientMaxBodySize is the maximum size of request bodies, e.g. 1m.
+	ClientMaxBodySize   string
+	ProxyConnectTimeout string
+	ProxyReadTimeout    string
+	ProxySendTimeout    string
+	SSLProtocols        string
+	SSLCiphers          string
+	// HSTS adds a Strict-Transport-Security header to the responses of
+	// each location of ssl servers.
+	HSTS                  bool
+	HSTSMaxAge            int
+	HSTSIncludeSubdomains bool
+}
+
+func (s *HttpSettings) HSTSHeader() string {
+	header := fmt.Sprintf("max-age=%d", s.HSTSMaxAge)
+
+	if s.HSTSIncludeSubdomains {
+		header += "; includeSubDomains"
+	}
+
+	return header
+}
+
+// InternalSettings configure the internal server of the admin endpoints,
+// it is disabled when Listen is empty.
+type InternalSettings struct {
+	// Listen is the address of the server, e.g. 127.0.0.1:10246.
+	Listen     string
+	Allow      []string
+	StubStatus bool
+	DumpConfig bool
+}
+
 type Http struct {
-	Http2      bool
-	LogFormat  string
-	AccessLog  string
-	Listen     int
-	TLSListen  int
+	HttpSettings
+	Internal   InternalSettings
 	Servers    map[string]*Server
 	SSLServers map[string]*Server
+	Upstreams  map[string]*Upstream
+	Splits     map[string]*Split
+	// DefaultBackend serves the requests of servers without a root
+	// location, they are answered with 404 when it is nil. The root
+	// location of an ingress on the default server wins over it.
+	DefaultBackend *ProxyPassConf
+	internal       *Server
+}
+
+func (h *Http) SortedSplits() []*Split {
+	splits := make([]*Split, 0, len(h.Splits))
+
+	for _, split := range h.Splits {
+		splits = append(splits, split)
+	}
+
+	sort.Slice(splits, func(i, j int) bool {
+		return splits[i].Name < splits[j].Name
+	})
+
+	return splits
 }
 
+func sortedUpstreams(upstreams map[string]*Upstream) []*Upstream {
+	ups := make([]*Upstream, 0, len(upstreams))
+
+	for _, up := range upstreams {
+		ups = append(ups, up)
+	}
+
+	sort.Slice(ups, func(i, j int) bool {
+		return ups[i].Name < ups[j].Name
+	})
+
+	return ups
+}
+
+func (h *Http) SortedUpstreams() []*Upstream {
+	return sortedUpstreams(h.Upstreams)
+}
+
+// AllServers returns the servers ordered by host, with the plain server
+// of a host before its ssl server, and the internal server last.
 func (h *Http) AllServers() []*Server {
 	var ss []*Server
 
@@ -106,5 +436,54 @@ func (h *Http) AllServers() []*Server {
 		ss = append(ss, server)
 	}
 
+	sort.SliceStable(ss, func(i, j int) bool {
+		if ss[i].ServerName != ss[j].ServerName {
+			return ss[i].ServerName < ss[j].ServerName
+		}
+
+		return ss[i].SSL == nil && ss[j].SSL != nil
+	})
+
+	if h.internal != nil {
+		ss = append(ss, h.internal)
+	}
+
+	return ss
+}
+
+// StreamServer proxies a TCP or UDP port to an upstream.
+type StreamServer struct {
+	Listen   int
+	UDP      bool
+	Upstream string
+	// AcceptProxyProtocol expects the PROXY protocol header from clients,
+	// e.g. from a load balancer in front of nginx.
+	AcceptProxyProtocol bool
+	// SendProxyProtocol sends the PROXY protocol header to the upstream.
+	SendProxyProtocol bool
+}
+
+type Stream struct {
+	Servers   []*StreamServer
+	Upstreams map[string]*Upstream
+}
+
+func (s *Stream) SortedUpstreams() []*Upstream {
+	return sortedUpstreams(s.Upstreams)
+}
+
+// SortedServers returns the servers ordered by port, with the TCP server
+// of a port before its UDP server.
+func (s *Stream) SortedServers() []*StreamServer {
+	ss := append([]*StreamServer(nil), s.Servers...)
+
+	sort.Slice(ss, func(i, j int) bool {
+		if ss[i].Listen != ss[j].Listen {
+			return ss[i].Listen < ss[j].Listen
+		}
+
+		return !ss[i].UDP && ss[j].UDP
+	})
+
 	return ss
 }
@@ -0,0 +1,353 @@
+package nginx
+
+import (
+	"bytes"
+	"flag"
+	"ingress-controller/kube/ingress"
+	"ingress-controller/nginx/nginxtest"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files of testdata")
+
+type hostLocation struct {
+	host string
+	loc  *Location
+	tls  *TLSConf
+}
+
+func testLocations() []hostLocation {
+	tls := &TLSConf{Cert: "tls/a.crt", Key: "tls/a.key"}
+	proxy := &ProxyPassConf{UpstreamName: "default_web_80"}
+
+	location := func(path, pathType string, regex bool) *Location {
+		return &Location{
+			Path:       Path{Path: path, PathType: pathType, Regex: regex},
+			ProxyPass:  proxy,
+			IngressRef: "default/web",
+		}
+	}
+
+	return []hostLocation{
+		{"b.example.com", location("/", ingress.PathTypePrefix, false), nil},
+		{"b.example.com", location("/api", ingress.PathTypePrefix, false), nil},
+		{"b.example.com", location("/api/v1", ingress.PathTypePrefix, false), nil},
+		{"b.example.com", location("/api", ingress.PathTypeExact, false), nil},
+		{"b.example.com", location("/healthz", ingress.PathTypeExact, false), nil},
+		{"b.example.com", location("^/(a|b)/", "", true), nil},
+		{"b.example.com", location("^/static/(.*)", "", true), nil},
+		{"a.example.com", location("/", ingress.PathTypePrefix, false), tls},
+		{"a.example.com", location("/", ingress.PathTypePrefix, false), nil},
+		{"a.example.com", location("/docs", ingress.PathTypePrefix, false), tls},
+		{"", location("/fallback", ingress.PathTypePrefix, false), nil},
+		{"", location("/", ingress.PathTypePrefix, false), nil},
+	}
+}
+
+// renderHttp renders http.conf with the locations added in the given order.
+func renderHttp(t *testing.T, locs []hostLocation) []byte {
+	t.Helper()
+
+	ngx := New(&Main{}, &Http{
+		HttpSettings: HttpSettings{
+			LogFormat:  MainLogFormat,
+			AccessLog:  "/dev/stdout",
+			Listen:     80,
+			TLSListen:  443,
+			HSTS:       true,
+			HSTSMaxAge: 15724800,
+		},
+		Internal: InternalSettings{
+			Listen:     "127.0.0.1:10246",
+			StubStatus: true,
+		},
+	})
+
+	ngx.SetUpstream(&Upstream{Name: "default_web_80", Servers: []string{"10.0.0.2:8080", "10.0.0.1:8080"}})
+	ngx.SetUpstream(&Upstream{Name: "default_api_80"})
+
+	for _, hl := range locs {
+		if err := ngx.AddLocation(hl.host, hl.loc, hl.tls); err != nil {
+			t.Fatalf("AddLocation(%q, %s): %s", hl.host, hl.loc.Path, err)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := httpTpl.Execute(&buf, ngx.httpConf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// TestHttpGolden checks that http.conf orders servers and locations the
+// same way whatever the order they were added in, so that equal configs
+// render byte for byte equal files.
+func TestHttpGolden(t *testing.T) {
+	expected := checkGolden(t, "http.conf", renderHttp(t, testLocations()))
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20; i++ {
+		locs := testLocations()
+		r.Shuffle(len(locs), func(i, j int) { locs[i], locs[j] = locs[j], locs[i] })
+
+		if got := renderHttp(t, locs); !bytes.Equal(got, expected) {
+			t.Fatalf("http.conf depends on the order of AddLocation:\n%s", got)
+		}
+	}
+}
+
+// checkGolden compares a rendered file with its golden file of testdata,
+// which go test -update rewrites.
+func checkGolden(t *testing.T, name string, got []byte) []byte {
+	t.Helper()
+
+	golden := filepath.Join("testdata", name+".golden")
+
+	if *update {
+		if err := os.WriteFile(golden, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := os.ReadFile(golden)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, expected) {
+		t.Fatalf("%s differs from %s, run go test -update to rewrite it:\n%s", name, golden, got)
+	}
+
+	return expected
+}
+
+func testStreamServers() []*StreamServer {
+	return []*StreamServer{
+		{Listen: 5432, Upstream: "default_postgres_5432"},
+		{Listen: 53, UDP: true, Upstream: "kube-system_dns_53_udp"},
+		{Listen: 53, Upstream: "kube-system_dns_53"},
+		{Listen: 8443, Upstream: "default_web_443", AcceptProxyProtocol: true},
+		{Listen: 9000, Upstream: "default_api_9000", AcceptProxyProtocol: true, SendProxyProtocol: true},
+		{Listen: 514, UDP: true, Upstream: "default_syslog_514_udp", SendProxyProtocol: true},
+	}
+}
+
+// renderStream renders stream.conf with the servers in the given order.
+func renderStream(t *testing.T, servers []*StreamServer) []byte {
+	t.Helper()
+
+	ngx := New(&Main{}, &Http{})
+	ngx.SetStreamUpstream(&Upstream{Name: "default_postgres_5432", Servers: []string{"10.0.0.2:5432", "10.0.0.1:5432"}})
+	ngx.SetStreamUpstream(&Upstream{Name: "kube-system_dns_53", Servers: []string{"10.0.1.1:53"}})
+	ngx.SetStreamUpstream(&Upstream{Name: "kube-system_dns_53_udp", Servers: []string{"10.0.1.1:53"}})
+	ngx.SetStreamUpstream(&Upstream{Name: "default_web_443", Servers: []string{"[fd00::1]:8443"}})
+	ngx.SetStreamUpstream(&Upstream{Name: "default_api_9000"})
+	ngx.SetStreamUpstream(&Upstream{Name: "default_syslog_514_udp", Servers: []string{"10.0.2.1:514"}})
+	ngx.SetStreamServers(servers)
+
+	var buf bytes.Buffer
+
+	if err := streamTpl.Execute(&buf, ngx.streamConf); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// TestStreamGolden checks the rendering of the TCP and UDP servers, with the
+// PROXY protocol and upstreams without endpoints, ordered whatever the order
+// of the servers.
+func TestStreamGolden(t *testing.T) {
+	expected := checkGolden(t, "stream.conf", renderStream(t, testStreamServers()))
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 20; i++ {
+		servers := testStreamServers()
+		r.Shuffle(len(servers), func(i, j int) { servers[i], servers[j] = servers[j], servers[i] })
+
+		if got := renderStream(t, servers); !bytes.Equal(got, expected) {
+			t.Fatalf("stream.conf depends on the order of the servers:\n%s", got)
+		}
+	}
+}
+
+func TestSortedLocations(t *testing.T) {
+	server := &Server{Locations: map[string]*Location{}}
+
+	for _, hl := range testLocations() {
+		if hl.host == "b.example.com" {
+			server.Locations[hl.loc.Path.String()] = hl.loc
+		}
+	}
+
+	want := []string{
+		"= /api",
+		"= /healthz",
+		"~* ^/static/(.*)",
+		"~* ^/(a|b)/",
+		"/api/v1",
+		"/api",
+		"/",
+	}
+
+	locs := server.SortedLocations()
+
+	if len(locs) != len(want) {
+		t.Fatalf("got %d locations, want %d", len(locs), len(want))
+	}
+
+	for i, loc := range locs {
+		if loc.Path.String() != want[i] {
+			t.Errorf("location %d: got %s, want %s", i, loc.Path, want[i])
+		}
+	}
+}
+
+func TestAllServers(t *testing.T) {
+	h := &Http{
+		Servers: map[string]*Server{
+			"b": {ServerName: "b"},
+			"_": {ServerName: "_"},
+			"a": {ServerName: "a"},
+		},
+		SSLServers: map[string]*Server{
+			"a": {ServerName: "a", SSL: &TLSConf{}},
+			"c": {ServerName: "c", SSL: &TLSConf{}},
+		},
+		internal: &Server{ServerName: "_", Listen: "127.0.0.1:10246"},
+	}
+
+	want := []struct {
+		name     string
+		ssl      bool
+		internal bool
+	}{
+		{"_", false, false},
+		{"a", false, false},
+		{"a", true, false},
+		{"b", false, false},
+		{"c", true, false},
+		{"_", false, true},
+	}
+
+	ss := h.AllServers()
+
+	if len(ss) != len(want) {
+		t.Fatalf("got %d servers, want %d", len(ss), len(want))
+	}
+
+	for i, s := range ss {
+		if s.ServerName != want[i].name || (s.SSL != nil) != want[i].ssl || (s.Listen != "") != want[i].internal {
+			t.Errorf("server %d: got %s ssl=%v listen=%q, want %+v", i, s.ServerName, s.SSL != nil, s.Listen, want[i])
+		}
+	}
+}
+
+// TestCatchAll checks that the root location of an ingress on the default
+// server wins over the default backend.
+func TestCatchAll(t *testing.T) {
+	ngx := New(&Main{}, &Http{})
+	ngx.SetDefaultBackend(&ProxyPassConf{UpstreamName: "default_backend_80"})
+
+	catchAll := &Location{
+		Path:       Path{Path: "/", PathType: ingress.PathTypePrefix},
+		ProxyPass:  &ProxyPassConf{UpstreamName: "default_web_80"},
+		IngressRef: "default/web",
+	}
+
+	render := func() string {
+		var buf bytes.Buffer
+
+		if err := httpTpl.Execute(&buf, ngx.httpConf); err != nil {
+			t.Fatal(err)
+		}
+
+		return buf.String()
+	}
+
+	if err := ngx.AddLocation("", catchAll, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if conf := render(); !strings.Contains(conf, `proxy_pass "http://default_web_80"`) || strings.Contains(conf, "default_backend_80") {
+		t.Fatalf("the default backend is served over the catch-all location:\n%s", conf)
+	}
+
+	other := &Location{Path: catchAll.Path, IngressRef: "default/other"}
+
+	if err := ngx.AddLocation("", other, nil); err == nil {
+		t.Fatal("a second catch-all location was added")
+	}
+
+	ngx.DeleteLocation("", "default/web")
+
+	if conf := render(); !strings.Contains(conf, `proxy_pass "http://default_backend_80"`) {
+		t.Fatalf("the default backend is not served after the catch-all location was deleted:\n%s", conf)
+	}
+
+	if err := ngx.AddLocation("", other, nil); err != nil {
+		t.Fatalf("the catch-all location was not released: %s", err)
+	}
+}
+
+// FuzzAnnotations renders http.conf with arbitrary hosts, paths and values
+// in the places the annotations of an ingress end up, and checks that they
+// do not change the structure of the config. The annotation parsers reject
+// most such values, the quoting of the templates must not rely on it.
+func FuzzAnnotations(f *testing.F) {
+	f.Add("example.com", "/api", "60s", false)
+	f.Add("", "/", `https://example.com/"; include /etc/passwd; #`, false)
+	f.Add("_", "^/(.*)", "/$1 } location / { return 200", true)
+	f.Add("a b;", "/a'b\\", "x\n}\nserver {\n  listen 81;", false)
+	f.Add("#", "/\\\"", "${a} '\\", true)
+
+	location := func(path, value string, regex bool) *Location {
+		return &Location{
+			Path: Path{Path: path, PathType: ingress.PathTypePrefix, Regex: regex},
+			Directives: []Directive{
+				{"proxy_read_timeout", value},
+				{"client_max_body_size", value},
+				{"allow", value},
+				{"deny", "all"},
+				{"rewrite", "(?i)" + path, value, "break"},
+			},
+			Return:           &ReturnConf{Code: 301, Text: value},
+			BasicAuth:        &BasicAuthConf{Realm: "Authentication required", UserFile: "secrets/default-" + value},
+			IngressRef:       "default/" + value,
+			DisableAccessLog: true,
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, host, path, value string, regex bool) {
+		placeholderHost, placeholderPath := "example.com", "/x"
+
+		if host == "" || host == "_" {
+			placeholderHost = host
+		}
+
+		if path == "/" {
+			placeholderPath = path
+		}
+
+		want, err := nginxtest.Skeleton(string(renderHttp(t, []hostLocation{{placeholderHost, location(placeholderPath, "x", regex), nil}})))
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conf := renderHttp(t, []hostLocation{{host, location(path, value, regex), nil}})
+
+		if got, err := nginxtest.Skeleton(string(conf)); err != nil {
+			t.Fatalf("%s:\n%s", err, conf)
+		} else if got != want {
+			t.Fatalf("the structure of http.conf changed:\n%s", conf)
+		}
+	})
+}
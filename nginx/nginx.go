@@ -2,16 +2,20 @@ package nginx
 
 import (
 	"bytes"
+	"crypto/sha256"
 	_ "embed"
 	"errors"
 	"flag"
 	"fmt"
 	"ingress-controller/kube/ingress"
+	"ingress-controller/metrics"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
+	"sync"
 	"syscall"
 	"text/template"
 	"time"
@@ -23,26 +27,104 @@ const MainLogFormat = `'$remote_addr - $remote_user [$time_local] "$request" '
 
 var Prefix = flag.String("ngx.prefix", "/etc/nginx", "")
 
+var (
+	reloadDebounce    = flag.Duration("ngx.reload-debounce", time.Second, "time to merge reload requests into one reload")
+	reloadMinInterval = flag.Duration("ngx.reload-min-interval", time.Second*5, "minimum interval between two reloads")
+	reloadMaxDelay    = flag.Duration("ngx.reload-max-delay", time.Second*10, "maximum time a reload request is delayed by the following ones")
+)
+
 //go:embed templates/nginx.gotpl
 var _nginxTpl string
 
 //go:embed templates/http.gotpl
 var _httpTpl string
 
+//go:embed templates/stream.gotpl
+var _streamTpl string
+
 var (
-	nginxTpl *template.Template
-	httpTpl  *template.Template
+	nginxTpl  *template.Template
+	httpTpl   *template.Template
+	streamTpl *template.Template
 )
 
 var noNgx = os.Getenv("NO_NGINX") == "1"
 
+const (
+	mainConfFile         = "nginx.conf"
+	httpConfFile         = "http.conf"
+	streamConfFile       = "stream.conf"
+	stagedMainConfFile   = "nginx.conf.staged"
+	stagedHttpConfFile   = "http.conf.staged"
+	stagedStreamConfFile = "stream.conf.staged"
+)
+
+var errNotRunning = errors.New("not running")
+
+// restartDelay is the time to wait before nginx is started again after it
+// exited unexpectedly.
+var restartDelay = time.Second
+
+var (
+	reloads          = metrics.NewCounter("nginx_reloads_total", "Reloads of nginx.")
+	reloadFailures   = metrics.NewCounter("nginx_reload_failures_total", "Reloads of nginx that could not be signaled.")
+	processRestarts  = metrics.NewCounter("nginx_process_restarts_total", "Restarts of nginx after it exited unexpectedly.")
+	configBuildTimes = metrics.NewHistogram(
+		"config_build_duration_seconds",
+		"Time to render, test and write http.conf and stream.conf.",
+		0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10,
+	)
+)
+
+// ConfigError is returned when nginx rejects a generated config.
+type ConfigError struct {
+	Output string
+}
+
+func (e *ConfigError) Error() string {
+	return "nginx: invalid config: " + strings.TrimSpace(e.Output)
+}
+
+// SystemResolver returns the nameservers of /etc/resolv.conf in the form of
+// the resolver directive.
+func SystemResolver() string {
+	data, err := os.ReadFile("/etc/resolv.conf")
+
+	if err != nil {
+		return ""
+	}
+
+	var servers []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+
+		if len(fields) < 2 || fields[0] != "nameserver" {
+			continue
+		}
+
+		if strings.Contains(fields[1], ":") {
+			servers = append(servers, "["+fields[1]+"]")
+		} else {
+			servers = append(servers, fields[1])
+		}
+	}
+
+	return strings.Join(servers, " ")
+}
+
+type mainTplData struct {
+	*Main
+	HttpConf   string
+	StreamConf string
+}
+
 func init() {
 	var err error
 
 	funcMap := template.FuncMap{
-		"now": func() string {
-			return time.Now().Format(time.RFC3339)
-		},
+		"quote":   Quote,
+		"comment": Comment,
 	}
 
 	if nginxTpl, err = template.New("nginx.nginx").Funcs(funcMap).Parse(_nginxTpl); err != nil {
@@ -52,23 +134,44 @@ func init() {
 	if httpTpl, err = template.New("nginx.http").Funcs(funcMap).Parse(_httpTpl); err != nil {
 		panic(err)
 	}
+
+	if streamTpl, err = template.New("nginx.stream").Funcs(funcMap).Parse(_streamTpl); err != nil {
+		panic(err)
+	}
 }
 
 type Nginx struct {
-	mainConf *Main
-	httpConf *Http
-	cmd      *exec.Cmd
-	stopCh   chan struct{}
+	mainConf   *Main
+	httpConf   *Http
+	streamConf *Stream
+	// defaultMain and defaultHttp are the settings nginx was created with,
+	// before any ConfigMap was applied
+	defaultMain Main
+	defaultHttp HttpSettings
+	mu          sync.Mutex
+	cmd         *exec.Cmd
+	stopCh      chan struct{}
+	reloadCh    chan struct{}
+	quitCh      chan struct{}
+	quitOnce    sync.Once
+	httpHash    [sha256.Size]byte
+}
+
+// signal sends sig to the running nginx master process.
+func (ngx *Nginx) signal(sig os.Signal) error {
+	ngx.mu.Lock()
+	defer ngx.mu.Unlock()
+
+	if ngx.cmd == nil {
+		return errNotRunning
+	}
+
+	return ngx.cmd.Process.Signal(sig)
 }
 
 func (ngx *Nginx) AddLocation(host string, loc *Location, tlsConf *TLSConf) error {
 	if host == "" {
 		host = "_"
-
-		if loc.Path.Path == "/" {
-			return errors.New("nginx: definition is not allowed")
-		}
-
 		tlsConf = nil
 	}
 
@@ -106,6 +209,10 @@ func (ngx *Nginx) AddLocation(host string, loc *Location, tlsConf *TLSConf) erro
 	locations := server.Locations
 
 	if loc, ok := locations[loc.Path.String()]; ok {
+		if loc.IngressRef != "" {
+			return fmt.Errorf("nginx: duplicated location %s of %s", loc.Path, loc.IngressRef)
+		}
+
 		return fmt.Errorf("nginx: duplicated location %s", loc.Path)
 	}
 
@@ -113,6 +220,52 @@ func (ngx *Nginx) AddLocation(host string, loc *Location, tlsConf *TLSConf) erro
 	return nil
 }
 
+func (ngx *Nginx) SetUpstream(up *Upstream) {
+	ngx.httpConf.Upstreams[up.Name] = up
+}
+
+func (ngx *Nginx) DeleteUpstream(name string) {
+	delete(ngx.httpConf.Upstreams, name)
+}
+
+func (ngx *Nginx) SetDefaultBackend(proxyPass *ProxyPassConf) {
+	ngx.httpConf.DefaultBackend = proxyPass
+}
+
+func (ngx *Nginx) SetSplit(split *Split) {
+	ngx.httpConf.Splits[split.Name] = split
+}
+
+func (ngx *Nginx) DeleteSplit(name string) {
+	delete(ngx.httpConf.Splits, name)
+}
+
+func (ngx *Nginx) SetStreamUpstream(up *Upstream) {
+	ngx.streamConf.Upstreams[up.Name] = up
+}
+
+func (ngx *Nginx) DeleteStreamUpstream(name string) {
+	delete(ngx.streamConf.Upstreams, name)
+}
+
+// SetStreamServers replaces the TCP and UDP servers.
+func (ngx *Nginx) SetStreamServers(servers []*StreamServer) {
+	ngx.streamConf.Servers = servers
+}
+
+// Counts returns the number of servers and locations of http.conf, without
+// the internal server.
+func (ngx *Nginx) Counts() (servers, locations int) {
+	for _, ss := range []map[string]*Server{ngx.httpConf.Servers, ngx.httpConf.SSLServers} {
+		for _, server := range ss {
+			servers++
+			locations += len(server.Locations)
+		}
+	}
+
+	return
+}
+
 func (ngx *Nginx) DeleteLocation(host string, isRef string) {
 	if host == "" {
 		host = "_"
@@ -146,70 +299,329 @@ func (ngx *Nginx) DeleteLocation(host string, isRef string) {
 	}
 }
 
-func (ngx *Nginx) BuildHttpConfig() error {
+// test runs `nginx -t` against the staged http.conf and stream.conf.
+func (ngx *Nginx) test(dir string) error {
+	if noNgx {
+		return nil
+	}
+
 	var buf bytes.Buffer
 
-	if err := httpTpl.Execute(&buf, ngx.httpConf); err != nil {
+	data := mainTplData{ngx.mainConf, path.Join(dir, stagedHttpConfFile), path.Join(dir, stagedStreamConfFile)}
+
+	if err := nginxTpl.Execute(&buf, data); err != nil {
+		return err
+	}
+
+	stagedMainConf := path.Join(*Prefix, stagedMainConfFile)
+
+	if err := ioutil.WriteFile(stagedMainConf, buf.Bytes(), 0777); err != nil {
+		return err
+	}
+
+	defer os.Remove(stagedMainConf)
+
+	out, err := exec.Command("nginx", "-t", "-q", "-p", *Prefix, "-c", stagedMainConf).CombinedOutput()
+
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return &ConfigError{Output: string(out)}
+		}
+
 		return err
 	}
 
-	return ioutil.WriteFile(*Prefix+"/http.conf", buf.Bytes(), 0777)
+	return nil
+}
+
+// stage renders http.conf and stream.conf to the staged files of dir, a
+// directory of the prefix, and tests them. The staged files are removed
+// when nginx rejects them.
+func (ngx *Nginx) stage(dir string) (hash [sha256.Size]byte, err error) {
+	var httpBuf, streamBuf bytes.Buffer
+
+	if err = httpTpl.Execute(&httpBuf, ngx.httpConf); err != nil {
+		return
+	}
+
+	if err = streamTpl.Execute(&streamBuf, ngx.streamConf); err != nil {
+		return
+	}
+
+	h := sha256.New()
+	h.Write(httpBuf.Bytes())
+	h.Write(streamBuf.Bytes())
+	copy(hash[:], h.Sum(nil))
+
+	if hash == ngx.httpHash {
+		return
+	}
+
+	stagedHttp := path.Join(*Prefix, dir, stagedHttpConfFile)
+	stagedStream := path.Join(*Prefix, dir, stagedStreamConfFile)
+
+	if err = ioutil.WriteFile(stagedHttp, httpBuf.Bytes(), 0777); err != nil {
+		return
+	}
+
+	if err = ioutil.WriteFile(stagedStream, streamBuf.Bytes(), 0777); err != nil {
+		os.Remove(stagedHttp)
+		return
+	}
+
+	if err = ngx.test(dir); err != nil {
+		os.Remove(stagedHttp)
+		os.Remove(stagedStream)
+	}
+
+	return
+}
+
+// Validate tests the current config like BuildHttpConfig without touching
+// the live or staged files, e.g. to dry-run a change before it is applied.
+// The config is rendered into scratch, a directory of the prefix.
+func (ngx *Nginx) Validate(scratch string) error {
+	hash, err := ngx.stage(scratch)
+
+	if err != nil || hash == ngx.httpHash {
+		return err
+	}
+
+	os.Remove(path.Join(*Prefix, scratch, stagedHttpConfFile))
+	os.Remove(path.Join(*Prefix, scratch, stagedStreamConfFile))
+	return nil
+}
+
+// BuildHttpConfig renders http.conf and stream.conf to staged files and
+// replaces the live files only when nginx accepts them, so the last
+// known-good config is kept on a *ConfigError. changed is false when the
+// rendered config is the same as the live one.
+func (ngx *Nginx) BuildHttpConfig() (changed bool, err error) {
+	start := time.Now()
+	defer func() { configBuildTimes.Observe(time.Since(start).Seconds()) }()
+
+	hash, err := ngx.stage("")
+
+	if err != nil || hash == ngx.httpHash {
+		return
+	}
+
+	stagedHttp := path.Join(*Prefix, stagedHttpConfFile)
+	stagedStream := path.Join(*Prefix, stagedStreamConfFile)
+
+	if err = os.Rename(stagedStream, path.Join(*Prefix, streamConfFile)); err != nil {
+		return
+	}
+
+	if err = os.Rename(stagedHttp, path.Join(*Prefix, httpConfFile)); err != nil {
+		return
+	}
+
+	ngx.httpHash = hash
+	return true, nil
+}
+
+// Defaults returns the settings nginx was created with.
+func (ngx *Nginx) Defaults() (Main, HttpSettings) {
+	return ngx.defaultMain, ngx.defaultHttp
+}
+
+// Configure replaces the global settings and rebuilds nginx.conf and
+// http.conf. The settings are only applied when nginx accepts them, the
+// previous ones are kept on a *ConfigError.
+func (ngx *Nginx) Configure(main *Main, settings HttpSettings) error {
+	prevMain, prevHttp := ngx.mainConf, ngx.httpConf.HttpSettings
+
+	ngx.mainConf = main
+	ngx.httpConf.HttpSettings = settings
+
+	// http.conf is tested along with the new nginx.conf even if it is
+	// unchanged
+	ngx.httpHash = [sha256.Size]byte{}
+
+	if _, err := ngx.BuildHttpConfig(); err != nil {
+		ngx.mainConf = prevMain
+		ngx.httpConf.HttpSettings = prevHttp
+		return err
+	}
+
+	return ngx.BuildMainConfig()
 }
 
 func (ngx *Nginx) BuildMainConfig() error {
 	var buf bytes.Buffer
 
-	if err := nginxTpl.Execute(&buf, ngx.mainConf); err != nil {
+	if err := nginxTpl.Execute(&buf, mainTplData{ngx.mainConf, httpConfFile, streamConfFile}); err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(*Prefix+"/nginx.conf", buf.Bytes(), 0777)
+	if err := os.WriteFile(path.Join(*Prefix, "proxy_params"), []byte(proxyPassParams), 0777); err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path.Join(*Prefix, mainConfFile), buf.Bytes(), 0777)
 }
 
+// Reload requests a reload of nginx. Requests are merged within the
+// ngx.reload-debounce window and reloads are at least
+// ngx.reload-min-interval apart.
 func (ngx *Nginx) Reload() {
 	if noNgx {
 		return
 	}
 
-	if err := ngx.cmd.Process.Signal(syscall.SIGHUP); err != nil {
-		log.Printf("nginx: reload error: %s", err)
+	select {
+	case ngx.reloadCh <- struct{}{}:
+	default:
 	}
 }
 
-func (ngx *Nginx) Run() error {
-	if noNgx {
-		return nil
-	}
+func (ngx *Nginx) runReloader() {
+	var lastReload time.Time
 
-	if err := os.WriteFile(path.Join(*Prefix, "proxy_params"), []byte(proxyPassParams), 0777); err != nil {
-		return err
+	for {
+		select {
+		case <-ngx.quitCh:
+			return
+		case <-ngx.reloadCh:
+		}
+
+		// every request restarts the debounce window, up to
+		// ngx.reload-max-delay after the first one
+		timer := time.NewTimer(*reloadDebounce)
+		maxDelay := time.NewTimer(*reloadMaxDelay)
+
+	debounce:
+		for {
+			select {
+			case <-ngx.quitCh:
+				timer.Stop()
+				maxDelay.Stop()
+				return
+			case <-ngx.reloadCh:
+				if !timer.Stop() {
+					<-timer.C
+				}
+
+				timer.Reset(*reloadDebounce)
+			case <-timer.C:
+				maxDelay.Stop()
+				break debounce
+			case <-maxDelay.C:
+				timer.Stop()
+				break debounce
+			}
+		}
+
+		if wait := *reloadMinInterval - time.Since(lastReload); wait > 0 {
+			time.Sleep(wait)
+		}
+
+		// requests that arrived while waiting are served by this reload
+		select {
+		case <-ngx.reloadCh:
+		default:
+		}
+
+		log.Printf("nginx: reload")
+		reloads.Inc()
+
+		if err := ngx.signal(syscall.SIGHUP); err != nil && err != errNotRunning {
+			log.Printf("nginx: reload error: %s", err)
+			reloadFailures.Inc()
+		}
+
+		lastReload = time.Now()
 	}
+}
 
+// start starts the nginx master process, unless Shutdown was called.
+func (ngx *Nginx) start() (*exec.Cmd, error) {
 	cmd := exec.Command("nginx", "-p", *Prefix)
 
 	cmd.Stderr = os.Stderr
 	cmd.Stdout = os.Stdout
 
+	ngx.mu.Lock()
+	defer ngx.mu.Unlock()
+
+	select {
+	case <-ngx.quitCh:
+		return nil, nil
+	default:
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
 	ngx.cmd = cmd
+	return cmd, nil
+}
+
+// Run starts nginx and waits for it to exit after Shutdown. nginx is started
+// again when it exits on its own, e.g. after a crash of the master process.
+func (ngx *Nginx) Run() error {
+	if noNgx {
+		return nil
+	}
+
+	// Shutdown waits for Run to return once nginx was started
+	defer func() { ngx.stopCh <- struct{}{} }()
 
-	if err := cmd.Run(); err != nil {
+	cmd, err := ngx.start()
+
+	if err != nil || cmd == nil {
 		return err
 	}
 
-	ngx.stopCh <- struct{}{}
-	return nil
+	go ngx.runReloader()
+
+	for {
+		waitErr := cmd.Wait()
+
+		ngx.mu.Lock()
+		ngx.cmd = nil
+		ngx.mu.Unlock()
+
+		select {
+		case <-ngx.quitCh:
+			return nil
+		default:
+		}
+
+		log.Printf("nginx: exited unexpectedly: %v, restarting", waitErr)
+		processRestarts.Inc()
+
+		select {
+		case <-ngx.quitCh:
+			return nil
+		case <-time.After(restartDelay):
+		}
+
+		if cmd, err = ngx.start(); err != nil || cmd == nil {
+			return err
+		}
+	}
 }
 
+// Shutdown stops nginx gracefully and waits for it to exit, it may be called
+// more than once.
 func (ngx *Nginx) Shutdown() {
 	if noNgx {
 		return
 	}
 
-	if err := ngx.cmd.Process.Signal(syscall.SIGQUIT); err != nil {
-		log.Printf("nginx: shutdown error: %s", err)
-	}
+	ngx.quitOnce.Do(func() {
+		close(ngx.quitCh)
 
-	<-ngx.stopCh
+		if err := ngx.signal(syscall.SIGQUIT); err != nil {
+			log.Printf("nginx: shutdown error: %s", err)
+			return
+		}
+
+		<-ngx.stopCh
+	})
 }
 
 func New(mainConf *Main, httpConf *Http) *Nginx {
@@ -225,46 +637,68 @@ func New(mainConf *Main, httpConf *Http) *Nginx {
 		DisableAccessLog: true,
 	}
 
-	dumpConfig := &Location{
-		Path: Path{
-			Path:  "/_/dump-config/(nginx|http)",
-			Regex: true,
-		},
-		Directives: []Directive{
-			{
-				"alias",
-				fmt.Sprintf("%s/$1.conf", *Prefix),
+	httpConf.Servers = map[string]*Server{
+		"_": {
+			ServerName: "_",
+			Locations: map[string]*Location{
+				healthz.Path.String(): healthz,
 			},
 		},
 	}
 
-	stub := &Location{
-		Path: Path{
-			Path:     "/_/stub_status",
-			PathType: ingress.PathTypeExact,
-		},
-		DisableAccessLog: true,
-		Directives:       []Directive{{"stub_status"}},
-	}
+	if internal := httpConf.Internal; internal.Listen != "" {
+		server := &Server{
+			ServerName: "_",
+			Locations:  map[string]*Location{},
+			Listen:     internal.Listen,
+			Allow:      internal.Allow,
+		}
 
-	locations := map[string]*Location{
-		healthz.Path.String():    healthz,
-		dumpConfig.Path.String(): dumpConfig,
-		stub.Path.String():       stub,
-	}
+		if internal.DumpConfig {
+			dumpConfig := &Location{
+				Path: Path{
+					Path:  "^/_/dump-config/(nginx|http|stream)$",
+					Regex: true,
+				},
+				Directives: []Directive{
+					{
+						"alias",
+						fmt.Sprintf("%s/$1.conf", *Prefix),
+					},
+				},
+			}
 
-	httpConf.Servers = map[string]*Server{
-		"_": {
-			ServerName: "_",
-			Locations:  locations,
-		},
+			server.Locations[dumpConfig.Path.String()] = dumpConfig
+		}
+
+		if internal.StubStatus {
+			stub := &Location{
+				Path: Path{
+					Path:     "/_/stub_status",
+					PathType: ingress.PathTypeExact,
+				},
+				DisableAccessLog: true,
+				Directives:       []Directive{{"stub_status"}},
+			}
+
+			server.Locations[stub.Path.String()] = stub
+		}
+
+		httpConf.internal = server
 	}
 
 	httpConf.SSLServers = map[string]*Server{}
+	httpConf.Upstreams = map[string]*Upstream{}
+	httpConf.Splits = map[string]*Split{}
 
 	return &Nginx{
-		mainConf: mainConf,
-		httpConf: httpConf,
-		stopCh:   make(chan struct{}),
+		mainConf:    mainConf,
+		httpConf:    httpConf,
+		streamConf:  &Stream{Upstreams: map[string]*Upstream{}},
+		defaultMain: *mainConf,
+		defaultHttp: httpConf.HttpSettings,
+		stopCh:      make(chan struct{}, 1),
+		reloadCh:    make(chan struct{}, 1),
+		quitCh:      make(chan struct{}),
 	}
 }
@@ -0,0 +1,90 @@
+package nginx
+
+import (
+	"ingress-controller/metrics"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeNginx puts an nginx script first in $PATH, it exits with 1 on its
+// first run and then sleeps until it is signaled.
+func fakeNginx(t *testing.T) {
+	dir := t.TempDir()
+	script := `#!/bin/sh
+if [ ! -e "` + dir + `/started" ]; then
+	touch "` + dir + `/started"
+	exit 1
+fi
+exec sleep 30
+`
+
+	if err := os.WriteFile(filepath.Join(dir, "nginx"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func scrape(t *testing.T, name string) string {
+	rec := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if strings.HasPrefix(line, name+" ") {
+			return strings.TrimPrefix(line, name+" ")
+		}
+	}
+
+	t.Fatalf("%s not found", name)
+	return ""
+}
+
+func TestRunRestart(t *testing.T) {
+	defer func(noNginx bool, delay time.Duration) { noNgx, restartDelay = noNginx, delay }(noNgx, restartDelay)
+	noNgx, restartDelay = false, 10*time.Millisecond
+
+	fakeNginx(t)
+
+	ngx := New(&Main{}, &Http{})
+	restarts := scrape(t, "ingress_controller_nginx_process_restarts_total")
+	done := make(chan error, 1)
+
+	go func() { done <- ngx.Run() }()
+
+	// the second nginx is running once it was restarted
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		ngx.mu.Lock()
+		running := ngx.cmd != nil
+		ngx.mu.Unlock()
+
+		if running && scrape(t, "ingress_controller_nginx_process_restarts_total") != restarts {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			t.Fatal("nginx was not restarted")
+		}
+	}
+
+	// sleep exits with an error on SIGQUIT, Shutdown must not wait forever
+	shutdown := make(chan struct{})
+
+	go func() {
+		ngx.Shutdown()
+		close(shutdown)
+	}()
+
+	select {
+	case <-shutdown:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+
+	if err := <-done; err != nil {
+		t.Errorf("Run returned %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+// Package nginxtest parses nginx configs, for tests that check the
+// structure of a rendered config.
+package nginxtest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Directive is a directive or a block of an nginx config.
+type Directive struct {
+	Name     string
+	Args     []string
+	Block    bool
+	Children []*Directive
+}
+
+// Parse tokenizes an nginx config the way nginx does and returns its
+// directives, it fails on unclosed quotes or unbalanced braces.
+func Parse(conf string) ([]*Directive, error) {
+	var (
+		root    = &Directive{Block: true}
+		stack   = []*Directive{root}
+		args    []string
+		word    strings.Builder
+		inWord  bool
+		quote   byte
+		escaped bool
+		// braces counts the { of a ${variable} in a word
+		braces int
+	)
+
+	endWord := func() {
+		if inWord {
+			args = append(args, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+
+	statement := func(block bool) (*Directive, error) {
+		if len(args) == 0 {
+			return nil, errors.New("empty directive")
+		}
+
+		d := &Directive{Name: args[0], Args: args[1:], Block: block}
+		parent := stack[len(stack)-1]
+		parent.Children = append(parent.Children, d)
+		args = nil
+		return d, nil
+	}
+
+	for i := 0; i < len(conf); i++ {
+		ch := conf[i]
+
+		switch {
+		case quote != 0:
+			switch {
+			case escaped:
+				escaped = false
+			case ch == '\\':
+				escaped = true
+			case ch == quote:
+				quote = 0
+				endWord()
+
+				if i+1 < len(conf) && !strings.ContainsRune(" \t\r\n;{}", rune(conf[i+1])) {
+					return nil, fmt.Errorf("unexpected %q after a quoted string at %d", conf[i+1], i+1)
+				}
+			default:
+				word.WriteByte(ch)
+			}
+		case escaped:
+			escaped = false
+			word.WriteByte(ch)
+		case inWord && ch == '{' && strings.HasSuffix(word.String(), "$"):
+			braces++
+			word.WriteByte(ch)
+		case inWord && ch == '}' && braces > 0:
+			braces--
+			word.WriteByte(ch)
+		case ch == ' ' || ch == '\t' || ch == '\r' || ch == '\n':
+			endWord()
+		case ch == ';':
+			endWord()
+
+			if _, err := statement(false); err != nil {
+				return nil, err
+			}
+		case ch == '{':
+			endWord()
+
+			d, err := statement(true)
+
+			if err != nil {
+				return nil, err
+			}
+
+			stack = append(stack, d)
+		case ch == '}':
+			endWord()
+
+			if len(stack) == 1 || len(args) > 0 {
+				return nil, fmt.Errorf("unexpected } at %d", i)
+			}
+
+			stack = stack[:len(stack)-1]
+		case ch == '#' && !inWord:
+			for i < len(conf) && conf[i] != '\n' {
+				i++
+			}
+		case (ch == '"' || ch == '\'') && !inWord:
+			quote = ch
+			inWord = true
+		case ch == '\\':
+			escaped = true
+			inWord = true
+		default:
+			word.WriteByte(ch)
+			inWord = true
+		}
+	}
+
+	if quote != 0 || len(stack) != 1 || len(args) > 0 || inWord {
+		return nil, errors.New("unexpected end of file")
+	}
+
+	return root.Children, nil
+}
+
+// Skeleton returns the structure of an nginx config, the names and numbers
+// of arguments of its directives and blocks, with the directives of a block
+// sorted.
+func Skeleton(conf string) (string, error) {
+	directives, err := Parse(conf)
+
+	if err != nil {
+		return "", err
+	}
+
+	return skeleton(directives), nil
+}
+
+func skeleton(directives []*Directive) string {
+	s := make([]string, 0, len(directives))
+
+	for _, d := range directives {
+		v := fmt.Sprintf("%s/%d", d.Name, len(d.Args))
+
+		if d.Block {
+			v += "{" + skeleton(d.Children) + "}"
+		}
+
+		s = append(s, v)
+	}
+
+	sort.Strings(s)
+	return strings.Join(s, ",")
+}
+
+// Find returns the directives named name, in blocks at any depth.
+func Find(directives []*Directive, name string) []*Directive {
+	var found []*Directive
+
+	for _, d := range directives {
+		if d.Name == name {
+			found = append(found, d)
+		}
+
+		found = append(found, Find(d.Children, name)...)
+	}
+
+	return found
+}
@@ -0,0 +1,45 @@
+package nginxtest
+
+import "testing"
+
+func TestSkeleton(t *testing.T) {
+	tests := []struct {
+		conf string
+		want string
+		err  bool
+	}{
+		{conf: `a "b;" 'c}'; # d {`, want: "a/2"},
+		{conf: `s { b ${x}y; a "\"" ; }`, want: "s/0{a/1,b/1}"},
+		{conf: `a "b`, err: true},
+		{conf: `a "b"c;`, err: true},
+		{conf: `s { a; } }`, err: true},
+		{conf: `s { a;`, err: true},
+		{conf: `{ a; }`, err: true},
+	}
+
+	for _, tt := range tests {
+		got, err := Skeleton(tt.conf)
+
+		if (err != nil) != tt.err || got != tt.want {
+			t.Errorf("Skeleton(%q) = %q, %v, want %q", tt.conf, got, err, tt.want)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	directives, err := Parse(`s { l a { b 1; } l c { b 2; } } b 3;`)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var args []string
+
+	for _, d := range Find(directives, "b") {
+		args = append(args, d.Args...)
+	}
+
+	if len(args) != 3 || args[0] != "1" || args[1] != "2" || args[2] != "3" {
+		t.Errorf("found %v, want 1, 2 and 3", args)
+	}
+}
@@ -0,0 +1,40 @@
+package nginx
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	sizeRe = regexp.MustCompile(`^[0-9]+[kKmMgG]?$`)
+	// timeRe matches nginx times, a number without unit is seconds.
+	timeRe = regexp.MustCompile(`^([0-9]+)(ms|s|m|h|d)?$`)
+)
+
+// ParseSize parses an nginx size, e.g. 8m, 0 disables the limit.
+func ParseSize(v string) (string, error) {
+	if !sizeRe.MatchString(v) {
+		return "", fmt.Errorf("%q is not a size, e.g. 8m", v)
+	}
+
+	return v, nil
+}
+
+// ParseTime parses a positive nginx time, e.g. 60, 60s or 500ms, a number
+// without unit is returned in seconds. 0 is rejected, a timeout of 0 fails
+// every request.
+func ParseTime(v string) (string, error) {
+	m := timeRe.FindStringSubmatch(v)
+
+	if m == nil || strings.Trim(m[1], "0") == "" {
+		return "", fmt.Errorf("%q is not a positive time, e.g. 60s", v)
+	}
+
+	if _, err := strconv.Atoi(v); err == nil {
+		v += "s"
+	}
+
+	return v, nil
+}
@@ -0,0 +1,53 @@
+package nginx
+
+import "testing"
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		v    string
+		want string
+	}{
+		{"60", "60s"},
+		{"60s", "60s"},
+		{"500ms", "500ms"},
+		{"1m", "1m"},
+		{"05", "05s"},
+		{"0", ""},
+		{"0s", ""},
+		{"00m", ""},
+		{"-1", ""},
+		{"1w", ""},
+		{"1.5s", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		got, err := ParseTime(tt.v)
+
+		if (err == nil) != (tt.want != "") || got != tt.want {
+			t.Errorf("ParseTime(%q) = %q, %v, want %q", tt.v, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		v     string
+		valid bool
+	}{
+		{"0", true},
+		{"1024", true},
+		{"8m", true},
+		{"1G", true},
+		{"8mb", false},
+		{"-1", false},
+		{"1 m", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got, err := ParseSize(tt.v); (err == nil) != tt.valid || (tt.valid && got != tt.v) {
+			t.Errorf("ParseSize(%q) = %q, %v, want valid=%v", tt.v, got, err, tt.valid)
+		}
+	}
+}